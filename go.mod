@@ -5,6 +5,7 @@ go 1.14
 require (
 	github.com/BurntSushi/toml v0.3.1
 	github.com/alecthomas/units v0.0.0-20190924025748-f65c72e2690d // indirect
+	github.com/andybalholm/brotli v1.0.5
 	github.com/avct/uasurfer v0.0.0-20190308134847-43c6f9a90eeb
 	github.com/cespare/xxhash v0.0.0-20181017004759-096ff4a8a059
 	github.com/didip/tollbooth v0.0.0-20180415195142-b10a036da5f0
@@ -16,6 +17,7 @@ require (
 	github.com/gorilla/websocket v1.4.0 // indirect
 	github.com/jpillora/backoff v1.0.0 // indirect
 	github.com/julienschmidt/httprouter v1.3.0 // indirect
+	github.com/klauspost/compress v1.11.13
 	github.com/klauspost/cpuid v1.2.1
 	github.com/konsorten/go-windows-terminal-sequences v1.0.2 // indirect
 	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
@@ -0,0 +1,470 @@
+package backend
+
+import (
+	"errors"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cespare/xxhash"
+)
+
+// Strategies to choose the backend of the pool
+const (
+	StrategyRoundRobin = "roundrobin"
+	StrategyLeastConn  = "leastconn"
+	StrategyP2C        = "p2c"
+	StrategyHash       = "hash"
+
+	schemeHTTP     = "http"
+	schemeHTTPS    = "https"
+	defaultWeight  = 1
+	hashReplicas   = 160
+	hashKeyDivider = "#"
+)
+
+var (
+	// ErrInvalidStrategy is returned when the strategy of the pool is unknown
+	ErrInvalidStrategy = errors.New("Invalid backend strategy")
+	// ErrEmptyPool is returned when the pool don't have backends
+	ErrEmptyPool = errors.New("The backend pool is empty")
+)
+
+// Config of one backend of the pool
+type Config struct {
+	Host   string
+	Port   string
+	Weight int
+}
+
+// PoolConfig define the backends and how the requests are distributed
+type PoolConfig struct {
+	Strategy string
+	Backends []Config
+	// Backends for the requests received by TLS, empty use Backends
+	TLSBackends []Config
+	// Active health checks, disabled if nil
+	HealthCheck *HealthCheck
+	// Passive health checks with the real responses, disabled if nil
+	Outlier *Outlier
+	// Backends discovered in etcd or in a file, they replace the
+	// static backends when they are loaded
+	Discovery *Discovery
+}
+
+// Backend is an origin server of the pool
+type Backend struct {
+	Host   string
+	Port   string
+	Scheme string
+	Weight int
+
+	active    int64
+	unhealthy int32
+	successes int
+	failures  int
+	breaker   *breaker
+}
+
+// Address return the host and the port of the backend
+func (b *Backend) Address() string {
+	return net.JoinHostPort(b.Host, b.Port)
+}
+
+func (b *Backend) key() string {
+	return b.Scheme + "://" + b.Address()
+}
+
+// Active return the number of requests in progress in the backend
+func (b *Backend) Active() int64 {
+	return atomic.LoadInt64(&b.active)
+}
+
+// Healthy return false if the backend is out of the rotation
+func (b *Backend) Healthy() bool {
+	return atomic.LoadInt32(&b.unhealthy) == 0
+}
+
+// available return true if the backend is healthy, not ejected
+// by the circuit breaker and not tried before
+func (b *Backend) available(now time.Time, tried []*Backend) bool {
+	for _, t := range tried {
+		if t == b {
+			return false
+		}
+	}
+	return b.Healthy() && !b.breaker.ejected(now)
+}
+
+// Acquire should be called before send a request to the backend
+func (b *Backend) Acquire() {
+	atomic.AddInt64(&b.active, 1)
+}
+
+// Release should be called at the end of the request to the backend
+func (b *Backend) Release() {
+	atomic.AddInt64(&b.active, -1)
+}
+
+// Pool choose the backend for each request with the strategy of the config
+type Pool struct {
+	name      string
+	strategy  string
+	outlier   *Outlier
+	health    *HealthCheck
+	discovery *Discovery
+	done      chan struct{}
+
+	mu       sync.Mutex
+	started  bool
+	lb       atomic.Value
+	draining map[string]*Backend
+	// Client of the health checks
+	probeClient *http.Client
+}
+
+// balancers of the plain and the TLS requests, they are replaced
+// when the backends change
+type balancers struct {
+	plain *balancer
+	tls   *balancer
+}
+
+// NewPool build the pool of backends from the config, the name
+// is used in the metrics and in the status
+func NewPool(name string, cfg *PoolConfig) (*Pool, error) {
+	switch cfg.Strategy {
+	case "":
+		cfg.Strategy = StrategyRoundRobin
+	case StrategyRoundRobin, StrategyLeastConn, StrategyP2C, StrategyHash:
+	default:
+		return nil, ErrInvalidStrategy
+	}
+
+	if cfg.HealthCheck != nil {
+		if err := cfg.HealthCheck.parse(); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Outlier != nil {
+		if err := cfg.Outlier.parse(); err != nil {
+			return nil, err
+		}
+	}
+
+	backends, tlsBackends := cfg.Backends, cfg.TLSBackends
+	if cfg.Discovery != nil {
+		if err := cfg.Discovery.parse(name); err != nil {
+			return nil, err
+		}
+		// The file is loaded now, etcd when the pool starts
+		if cfg.Discovery.File != "" {
+			d, err := loadFile(cfg.Discovery.File)
+			if err != nil {
+				return nil, err
+			}
+			backends, tlsBackends = d.Backends, d.TLSBackends
+		}
+	}
+
+	if len(backends) == 0 && cfg.Discovery == nil {
+		return nil, ErrEmptyPool
+	}
+
+	p := &Pool{
+		name:      name,
+		strategy:  cfg.Strategy,
+		outlier:   cfg.Outlier,
+		health:    cfg.HealthCheck,
+		discovery: cfg.Discovery,
+		done:      make(chan struct{}),
+		draining:  make(map[string]*Backend),
+	}
+	if p.health != nil {
+		p.probeClient = p.health.newClient(defaultProbeTLSConfig)
+	}
+	p.lb.Store(p.newBalancers(backends, tlsBackends, nil))
+	return p, nil
+}
+
+// newBalancers build the balancers of the backends, the backends of
+// the old map are reused and removed from the map
+func (p *Pool) newBalancers(backends, tlsBackends []Config, old map[string]*Backend) *balancers {
+	lb := &balancers{
+		plain: newBalancer(p.name, backends, schemeHTTP, p.outlier, old),
+	}
+	if len(tlsBackends) > 0 {
+		lb.tls = newBalancer(p.name, tlsBackends, schemeHTTPS, p.outlier, old)
+	}
+	return lb
+}
+
+func (p *Pool) balancers() *balancers {
+	return p.lb.Load().(*balancers)
+}
+
+// SetBackends replace the backends of the pool. The backends that are
+// still in the pool keep their state, the removed backends don't
+// receive new requests and the requests in progress are not dropped.
+func (p *Pool) SetBackends(backends, tlsBackends []Config) error {
+	if len(backends) == 0 {
+		return ErrEmptyPool
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// The draining backends go back to the rotation if they are added again
+	old := make(map[string]*Backend)
+	for k, b := range p.draining {
+		old[k] = b
+	}
+	current := make(map[*Backend]bool)
+	for _, b := range p.Backends() {
+		old[b.key()] = b
+		current[b] = true
+	}
+
+	lb := p.newBalancers(backends, tlsBackends, old)
+	p.lb.Store(lb)
+
+	for _, b := range p.Backends() {
+		delete(p.draining, b.key())
+		if p.started && !current[b] {
+			p.startMetrics(b)
+		}
+	}
+	for _, b := range old {
+		if current[b] {
+			p.drain(b)
+		}
+	}
+	return nil
+}
+
+// drain wait until the requests in progress of the removed backend
+// finish, or the drain timeout, before remove its metrics
+func (p *Pool) drain(b *Backend) {
+	p.draining[b.key()] = b
+	log.Printf("httpsrv/backend/discovery %s: draining %s", p.name, b.key())
+
+	go func() {
+		deadline := time.Now().Add(p.discovery.drainTimeout())
+		for b.Active() > 0 && time.Now().Before(deadline) {
+			select {
+			case <-p.done:
+				return
+			case <-time.After(drainInterval):
+			}
+		}
+
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if p.draining[b.key()] != b {
+			// Added again to the pool
+			return
+		}
+		delete(p.draining, b.key())
+		p.deleteMetrics(b)
+		log.Printf("httpsrv/backend/discovery %s: drained %s (%d active)", p.name, b.key(), b.Active())
+	}()
+}
+
+// Draining return the backends removed with requests in progress
+func (p *Pool) Draining() []*Backend {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	backends := make([]*Backend, 0, len(p.draining))
+	for _, b := range p.draining {
+		backends = append(backends, b)
+	}
+	return backends
+}
+
+// Name return the name of the pool
+func (p *Pool) Name() string {
+	return p.name
+}
+
+// Next return the backend for the request, the key is used by the
+// consistent hashing so the same URL always go to the same backend.
+// Returns nil if all the backends are unhealthy or ejected.
+func (p *Pool) Next(tls bool, key uint64) *Backend {
+	return p.NextExcept(tls, key, nil)
+}
+
+// NextExcept return the backend for the request like Next, but
+// without the backends already tried
+func (p *Pool) NextExcept(tls bool, key uint64, tried []*Backend) *Backend {
+	lb := p.balancers()
+	b := lb.plain
+	if tls && lb.tls != nil {
+		b = lb.tls
+	}
+
+	now := time.Now()
+	var backend *Backend
+	switch p.strategy {
+	case StrategyLeastConn:
+		backend = b.leastConn(now, tried)
+	case StrategyP2C:
+		backend = b.p2c(now, tried)
+	case StrategyHash:
+		backend = b.hash(key, now, tried)
+	default:
+		backend = b.roundRobin(now, tried)
+	}
+	if backend != nil {
+		backend.breaker.allow(backend, now)
+	}
+	return backend
+}
+
+// Backends return all the backends of the pool
+func (p *Pool) Backends() []*Backend {
+	lb := p.balancers()
+	backends := append([]*Backend(nil), lb.plain.backends...)
+	if lb.tls != nil {
+		backends = append(backends, lb.tls.backends...)
+	}
+	return backends
+}
+
+type balancer struct {
+	mu       sync.Mutex
+	backends []*Backend
+	// Current weights of the smooth weighted round-robin, by index of
+	// the backends. The backends are shared with the next balancers.
+	current []int
+	ring    []uint64
+	ringMap map[uint64]*Backend
+}
+
+func newBalancer(pool string, cfg []Config, scheme string, outlier *Outlier, old map[string]*Backend) *balancer {
+	b := &balancer{
+		backends: make([]*Backend, 0, len(cfg)),
+		ringMap:  make(map[uint64]*Backend),
+	}
+	for _, c := range cfg {
+		w := c.Weight
+		if w <= 0 {
+			w = defaultWeight
+		}
+		backend := &Backend{
+			Host:   c.Host,
+			Port:   c.Port,
+			Scheme: scheme,
+			Weight: w,
+		}
+		// The same backend keep the health, the circuit and the requests in progress
+		if prev, ok := old[backend.key()]; ok && prev.Weight == w {
+			backend = prev
+			delete(old, backend.key())
+		} else if outlier != nil {
+			backend.breaker = newBreaker(outlier, pool)
+		}
+		b.backends = append(b.backends, backend)
+
+		// The virtual nodes of the ring are proportional to the weight
+		for i := 0; i < hashReplicas*w; i++ {
+			h := xxhash.Sum64String(backend.Address() + hashKeyDivider + strconv.Itoa(i))
+			b.ring = append(b.ring, h)
+			b.ringMap[h] = backend
+		}
+	}
+	sort.Slice(b.ring, func(i, j int) bool { return b.ring[i] < b.ring[j] })
+	b.current = make([]int, len(b.backends))
+	return b
+}
+
+// roundRobin is the smooth weighted round-robin of nginx
+func (b *balancer) roundRobin(now time.Time, tried []*Backend) *Backend {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	best := -1
+	total := 0
+	for i, backend := range b.backends {
+		if !backend.available(now, tried) {
+			continue
+		}
+		b.current[i] += backend.Weight
+		total += backend.Weight
+		if best < 0 || b.current[i] > b.current[best] {
+			best = i
+		}
+	}
+	if best < 0 {
+		return nil
+	}
+	b.current[best] -= total
+	return b.backends[best]
+}
+
+// healthy return the backends in the rotation
+func (b *balancer) healthy(now time.Time, tried []*Backend) []*Backend {
+	backends := make([]*Backend, 0, len(b.backends))
+	for _, backend := range b.backends {
+		if backend.available(now, tried) {
+			backends = append(backends, backend)
+		}
+	}
+	return backends
+}
+
+// less return true if the backend a has less load than b
+func less(a, b *Backend) bool {
+	return a.Active()*int64(b.Weight) < b.Active()*int64(a.Weight)
+}
+
+func (b *balancer) leastConn(now time.Time, tried []*Backend) *Backend {
+	var best *Backend
+	for _, backend := range b.backends {
+		if !backend.available(now, tried) {
+			continue
+		}
+		if best == nil || less(backend, best) {
+			best = backend
+		}
+	}
+	return best
+}
+
+// p2c choose two random backends and return the backend with less load
+func (b *balancer) p2c(now time.Time, tried []*Backend) *Backend {
+	backends := b.healthy(now, tried)
+	switch len(backends) {
+	case 0:
+		return nil
+	case 1:
+		return backends[0]
+	}
+	i := rand.Intn(len(backends))
+	j := rand.Intn(len(backends) - 1)
+	if j >= i {
+		j++
+	}
+	if less(backends[j], backends[i]) {
+		return backends[j]
+	}
+	return backends[i]
+}
+
+func (b *balancer) hash(key uint64, now time.Time, tried []*Backend) *Backend {
+	i := sort.Search(len(b.ring), func(i int) bool { return b.ring[i] >= key })
+	// The next backend of the ring if the backend is unhealthy or ejected
+	for n := 0; n < len(b.ring); n++ {
+		backend := b.ringMap[b.ring[(i+n)%len(b.ring)]]
+		if backend.available(now, tried) {
+			return backend
+		}
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package backend
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestPool(t *testing.T, strategy string) *Pool {
+	p, err := NewPool("test", &PoolConfig{
+		Strategy: strategy,
+		Backends: []Config{
+			{Host: "10.0.0.1", Port: "80", Weight: 3},
+			{Host: "10.0.0.2", Port: "80", Weight: 1},
+		},
+		TLSBackends: []Config{
+			{Host: "10.0.1.1", Port: "443"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestPoolRoundRobin(t *testing.T) {
+	p := newTestPool(t, StrategyRoundRobin)
+
+	count := make(map[string]int)
+	for i := 0; i < 8; i++ {
+		count[p.Next(false, 0).Host]++
+	}
+	if count["10.0.0.1"] != 6 || count["10.0.0.2"] != 2 {
+		t.Errorf("Invalid distribution: %v", count)
+	}
+
+	b := p.Next(true, 0)
+	if b.Host != "10.0.1.1" || b.Scheme != schemeHTTPS {
+		t.Errorf("Invalid TLS backend: %+v", b)
+	}
+}
+
+func TestPoolRoundRobinSharedBackends(t *testing.T) {
+	p := newTestPool(t, StrategyRoundRobin)
+	old := p.balancers().plain
+
+	// The new balancer reuse the backends, the requests that loaded the
+	// old balancer can still use it
+	if err := p.SetBackends([]Config{
+		{Host: "10.0.0.1", Port: "80", Weight: 3},
+		{Host: "10.0.0.2", Port: "80", Weight: 1},
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if p.Backends()[0] != old.backends[0] {
+		t.Fatalf("The backends should be reused")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			old.roundRobin(time.Now(), nil)
+		}
+	}()
+	count := make(map[string]int)
+	for i := 0; i < 8; i++ {
+		count[p.Next(false, 0).Host]++
+	}
+	<-done
+	if count["10.0.0.1"] != 6 || count["10.0.0.2"] != 2 {
+		t.Errorf("Each balancer should keep its own state: %v", count)
+	}
+}
+
+func TestPoolLeastConn(t *testing.T) {
+	p := newTestPool(t, StrategyLeastConn)
+
+	first := p.Next(false, 0)
+	first.Acquire()
+	second := p.Next(false, 0)
+	if second == first {
+		t.Errorf("The backend with requests in progress should not be used")
+	}
+	second.Acquire()
+
+	// The weight of the first backend is 3
+	if b := p.Next(false, 0); b.Host != "10.0.0.1" {
+		t.Errorf("The load should be relative to the weight: %s", b.Host)
+	}
+	first.Release()
+	second.Release()
+}
+
+func TestPoolP2C(t *testing.T) {
+	p := newTestPool(t, StrategyP2C)
+
+	busy := p.Backends()[0]
+	busy.Acquire()
+	busy.Acquire()
+	busy.Acquire()
+	busy.Acquire()
+	for i := 0; i < 10; i++ {
+		if b := p.Next(false, 0); b == busy {
+			t.Errorf("The busy backend should not be chosen")
+		}
+	}
+}
+
+func TestPoolHash(t *testing.T) {
+	p := newTestPool(t, StrategyHash)
+
+	count := make(map[string]int)
+	for key := uint64(0); key < 1000; key++ {
+		b := p.Next(false, key*0x9E3779B97F4A7C15)
+		if b != p.Next(false, key*0x9E3779B97F4A7C15) {
+			t.Fatalf("The same key should use the same backend")
+		}
+		count[b.Host]++
+	}
+	if count["10.0.0.1"] < count["10.0.0.2"] {
+		t.Errorf("The distribution should follow the weight: %v", count)
+	}
+}
+
+func TestPoolInvalid(t *testing.T) {
+	if _, err := NewPool("test", &PoolConfig{Strategy: "random", Backends: []Config{{Host: "a", Port: "80"}}}); err != ErrInvalidStrategy {
+		t.Errorf("Expected ErrInvalidStrategy: %v", err)
+	}
+	if _, err := NewPool("test", &PoolConfig{}); err != ErrEmptyPool {
+		t.Errorf("Expected ErrEmptyPool: %v", err)
+	}
+}
+
+func TestPoolNextExcept(t *testing.T) {
+	for _, strategy := range []string{StrategyRoundRobin, StrategyLeastConn, StrategyP2C, StrategyHash} {
+		p := newTestPool(t, strategy)
+		first := p.Next(false, 42)
+		second := p.NextExcept(false, 42, []*Backend{first})
+		if second == nil || second == first {
+			t.Errorf("%s: the retry should use another backend: %v %v", strategy, first, second)
+		}
+		if b := p.NextExcept(false, 42, []*Backend{first, second}); b != nil {
+			t.Errorf("%s: all the backends were tried: %v", strategy, b)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/fsnotify/fsnotify"
+	"go.etcd.io/etcd/clientv3"
+)
+
+const (
+	defaultDiscoveryPrefix    = "/elinproxy/backends/"
+	defaultDiscoveryEndpoints = "http://localhost:2379"
+	defaultDrain              = 30 * time.Second
+	drainInterval             = 100 * time.Millisecond
+	discoveryTimeout          = 2 * time.Second
+	discoveryRetry            = 5 * time.Second
+	discoveryTLSDir           = "tls/"
+)
+
+var (
+	// ErrDiscoverySource is returned when the discovery don't use
+	// etcd or a file, or both of them
+	ErrDiscoverySource = errors.New("The backend discovery should use etcd or a file")
+	// ErrBackendHost is returned when a discovered backend don't have
+	// the Host
+	ErrBackendHost = errors.New("The discovered backend should define the Host")
+)
+
+// Discovery update the backends of the pool without reload the config.
+// The backends removed from the pool don't receive new requests, but
+// the requests in progress are not dropped.
+type Discovery struct {
+	// Backends registered in etcd, each key under the prefix is a
+	// backend. The value is the JSON config of the backend or just
+	// "host:port", the keys under "tls/" are the TLS backends.
+	Etcd          bool
+	EtcdEndpoints []string
+	// "/elinproxy/backends/<pool>/" by default
+	EtcdPrefix string
+	// JSON file, or TOML if the extension is .toml, with the Backends
+	// and the TLSBackends. It is loaded again when it changes.
+	File string
+	// Time to wait the requests in progress of the removed backends, 30s by default
+	Drain string
+
+	drain time.Duration
+}
+
+// discovered is the content of the file of the discovery
+type discovered struct {
+	Backends    []Config
+	TLSBackends []Config
+}
+
+func (d *Discovery) parse(pool string) (err error) {
+	if d.Etcd == (d.File != "") {
+		return ErrDiscoverySource
+	}
+	if d.EtcdPrefix == "" {
+		d.EtcdPrefix = defaultDiscoveryPrefix + pool + "/"
+	}
+	if len(d.EtcdEndpoints) == 0 {
+		d.EtcdEndpoints = []string{defaultDiscoveryEndpoints}
+	}
+	d.drain = defaultDrain
+	if d.Drain != "" {
+		if d.drain, err = time.ParseDuration(d.Drain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Discovery) drainTimeout() time.Duration {
+	if d == nil {
+		return defaultDrain
+	}
+	return d.drain
+}
+
+func loadFile(file string) (*discovered, error) {
+	d := &discovered{}
+	if strings.EqualFold(filepath.Ext(file), ".toml") {
+		if _, err := toml.DecodeFile(file, d); err != nil {
+			return d, err
+		}
+		return d, d.validate()
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, d); err != nil {
+		return d, err
+	}
+	return d, d.validate()
+}
+
+// validate return an error if a backend don't have the Host
+func (d *discovered) validate() error {
+	for _, list := range [][]Config{d.Backends, d.TLSBackends} {
+		for _, c := range list {
+			if strings.TrimSpace(c.Host) == "" {
+				return ErrBackendHost
+			}
+		}
+	}
+	return nil
+}
+
+// discover start the discovery of the backends until the pool stops
+func (p *Pool) discover() {
+	if p.discovery.Etcd {
+		go p.watchEtcd()
+	} else {
+		go p.watchFile()
+	}
+}
+
+// update the backends of the pool, the current backends are kept if
+// the new list is empty
+func (p *Pool) update(backends, tlsBackends []Config) {
+	if err := p.SetBackends(backends, tlsBackends); err != nil {
+		log.Printf("httpsrv/backend/discovery %s ERROR: %s", p.name, err)
+	}
+}
+
+func (p *Pool) loadFile() {
+	d, err := loadFile(p.discovery.File)
+	if err != nil {
+		log.Printf("httpsrv/backend/discovery %s ERROR: %s", p.name, err)
+		return
+	}
+	p.update(d.Backends, d.TLSBackends)
+}
+
+func (p *Pool) watchFile() {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("httpsrv/backend/discovery %s ERROR: %s", p.name, err)
+		return
+	}
+	defer watcher.Close()
+
+	// The directory is watched, the editors replace the file
+	file := filepath.Clean(p.discovery.File)
+	if err := watcher.Add(filepath.Dir(file)); err != nil {
+		log.Printf("httpsrv/backend/discovery %s ERROR: %s", p.name, err)
+		return
+	}
+	// The changes before the watch
+	p.loadFile()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case ev, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(ev.Name) != file || ev.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+				continue
+			}
+			p.loadFile()
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("httpsrv/backend/discovery %s ERROR: %s", p.name, err)
+		}
+	}
+}
+
+func (p *Pool) watchEtcd() {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-p.done
+		cancel()
+	}()
+
+	cli, err := clientv3.New(clientv3.Config{
+		Endpoints:   p.discovery.EtcdEndpoints,
+		DialTimeout: discoveryTimeout,
+	})
+	if err != nil {
+		log.Printf("httpsrv/backend/discovery %s ERROR: %s", p.name, err)
+		return
+	}
+	defer cli.Close()
+
+	for {
+		if err := p.etcdSession(ctx, cli); err != nil {
+			log.Printf("httpsrv/backend/discovery %s ERROR: %s", p.name, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(discoveryRetry):
+		}
+	}
+}
+
+// etcdSession load the backends and update them on each change until
+// the watch fails
+func (p *Pool) etcdSession(ctx context.Context, cli *clientv3.Client) error {
+	rev, err := p.loadEtcd(ctx, cli)
+	if err != nil {
+		return err
+	}
+
+	watch := cli.Watch(ctx, p.discovery.EtcdPrefix, clientv3.WithPrefix(), clientv3.WithRev(rev+1))
+	for resp := range watch {
+		if err := resp.Err(); err != nil {
+			return err
+		}
+		// The full list is loaded again, the events can be compacted
+		if _, err := p.loadEtcd(ctx, cli); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadEtcd update the backends and return the revision to watch the changes
+func (p *Pool) loadEtcd(ctx context.Context, cli *clientv3.Client) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, discoveryTimeout)
+	defer cancel()
+
+	resp, err := cli.Get(ctx, p.discovery.EtcdPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return 0, err
+	}
+	var backends, tlsBackends []Config
+	for _, kv := range resp.Kvs {
+		c, err := parseBackend(kv.Value)
+		if err != nil {
+			log.Printf("httpsrv/backend/discovery %s ERROR %s: %s", p.name, kv.Key, err)
+			continue
+		}
+		if strings.HasPrefix(strings.TrimPrefix(string(kv.Key), p.discovery.EtcdPrefix), discoveryTLSDir) {
+			tlsBackends = append(tlsBackends, c)
+		} else {
+			backends = append(backends, c)
+		}
+	}
+	p.update(backends, tlsBackends)
+	return resp.Header.Revision, nil
+}
+
+// parseBackend read the JSON config of the backend or "host:port"
+func parseBackend(v []byte) (Config, error) {
+	var c Config
+	if err := json.Unmarshal(v, &c); err != nil {
+		host, port, err := net.SplitHostPort(strings.TrimSpace(string(v)))
+		if err != nil {
+			return c, err
+		}
+		c = Config{Host: host, Port: port}
+	}
+	if strings.TrimSpace(c.Host) == "" {
+		return c, ErrBackendHost
+	}
+	return c, nil
+}
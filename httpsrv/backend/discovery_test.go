@@ -0,0 +1,209 @@
+package backend
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/integration"
+)
+
+func addresses(backends []*Backend) string {
+	list := make([]string, 0, len(backends))
+	for _, b := range backends {
+		list = append(list, b.key())
+	}
+	sort.Strings(list)
+	return strings.Join(list, " ")
+}
+
+func waitBackends(t *testing.T, p *Pool, expected string) {
+	deadline := time.Now().Add(10 * time.Second)
+	for addresses(p.Backends()) != expected {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected backends %q: %q", expected, addresses(p.Backends()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPoolSetBackends(t *testing.T) {
+	p, err := NewPool("test-set", &PoolConfig{
+		Backends: []Config{{Host: "10.0.0.1", Port: "80"}, {Host: "10.0.0.2", Port: "80"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Start()
+	defer p.Stop()
+
+	removed, kept := p.Backends()[0], p.Backends()[1]
+	removed.Acquire()
+	atomic.StoreInt32(&kept.unhealthy, 1)
+
+	if err := p.SetBackends(nil, nil); err != ErrEmptyPool {
+		t.Errorf("Expected ErrEmptyPool: %v", err)
+	}
+	if err := p.SetBackends([]Config{{Host: "10.0.0.2", Port: "80"}, {Host: "10.0.0.3", Port: "80"}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	waitBackends(t, p, "http://10.0.0.2:80 http://10.0.0.3:80")
+	if p.Backends()[0] != kept || kept.Healthy() {
+		t.Errorf("The backends still in the pool should keep their state")
+	}
+
+	// The removed backend wait the requests in progress
+	if d := p.Draining(); len(d) != 1 || d[0] != removed {
+		t.Fatalf("The removed backend should be draining: %v", addresses(d))
+	}
+	for i := 0; i < 10; i++ {
+		if b := p.Next(false, 0); b == removed {
+			t.Fatalf("The draining backend should not receive requests")
+		}
+	}
+	var draining bool
+	for _, s := range GetStatus() {
+		if s.Pool == "test-set" && s.Host == "10.0.0.1" {
+			draining = s.Draining
+		}
+	}
+	if !draining {
+		t.Errorf("The status should show the draining backend")
+	}
+
+	removed.Release()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(p.Draining()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("The backend without requests should be drained")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDiscoveryFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "elinproxy-discovery-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "backends.json")
+	write := func(content string) {
+		// Replaced like the editors do
+		tmp := file + ".tmp"
+		if err := ioutil.WriteFile(tmp, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmp, file); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"Backends": [{"Host": "10.0.0.1", "Port": "80"}]}`)
+
+	p, err := NewPool("test-file", &PoolConfig{
+		Discovery: &Discovery{File: file},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addresses(p.Backends()) != "http://10.0.0.1:80" {
+		t.Fatalf("The file should be loaded in the pool: %s", addresses(p.Backends()))
+	}
+	p.Start()
+	defer p.Stop()
+
+	write(`{"Backends": [{"Host": "10.0.0.2", "Port": "80"}], "TLSBackends": [{"Host": "10.0.0.2", "Port": "443"}]}`)
+	waitBackends(t, p, "http://10.0.0.2:80 https://10.0.0.2:443")
+
+	// The invalid files are ignored
+	write(`{"Backends": [`)
+	write(`{"Backends": [{}]}`)
+	write(`{"Backends": [{"Host": "10.0.0.3", "Port": "80"}], "TLSBackends": [{"Port": "443"}]}`)
+	write(`{"Backends": []}`)
+	time.Sleep(100 * time.Millisecond)
+	waitBackends(t, p, "http://10.0.0.2:80 https://10.0.0.2:443")
+}
+
+func TestParseBackend(t *testing.T) {
+	for _, v := range []string{`{"Host": "10.0.0.1", "Port": "80"}`, "10.0.0.1:80", " 10.0.0.1:80\n"} {
+		c, err := parseBackend([]byte(v))
+		if err != nil || c.Host != "10.0.0.1" || c.Port != "80" {
+			t.Errorf("Invalid backend of %q: %+v %v", v, c, err)
+		}
+	}
+	for _, v := range []string{`{}`, `{"Port": "80"}`, `{"Host": " "}`, ":80", "10.0.0.1"} {
+		if _, err := parseBackend([]byte(v)); err == nil {
+			t.Errorf("The backend %q should be invalid", v)
+		}
+	}
+}
+
+func TestDiscoveryFileTOML(t *testing.T) {
+	dir, err := ioutil.TempDir("", "elinproxy-discovery-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "backends.toml")
+	content := "[[Backends]]\nHost = \"10.0.0.1\"\nPort = \"80\"\nWeight = 2\n"
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	d, err := loadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Backends) != 1 || d.Backends[0].Weight != 2 {
+		t.Errorf("Invalid backends: %+v", d.Backends)
+	}
+
+	if _, err := NewPool("test-toml", &PoolConfig{Discovery: &Discovery{Etcd: true, File: file}}); err != ErrDiscoverySource {
+		t.Errorf("Expected ErrDiscoverySource: %v", err)
+	}
+}
+
+func TestDiscoveryEtcd(t *testing.T) {
+	clus := integration.NewClusterV3(t, &integration.ClusterConfig{Size: 1})
+	defer clus.Terminate(t)
+
+	cli := clus.RandClient()
+	prefix := "/elinproxy/backends/test-etcd/"
+	put := func(k, v string) {
+		if _, err := cli.Put(context.Background(), prefix+k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put("a", `{"Host": "10.0.0.1", "Port": "80", "Weight": 2}`)
+	put("b", "10.0.0.2:80")
+
+	p, err := NewPool("test-etcd", &PoolConfig{
+		Strategy: StrategyHash,
+		Discovery: &Discovery{
+			Etcd:          true,
+			EtcdEndpoints: []string{clus.Members[0].GRPCAddr()},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Start()
+	defer p.Stop()
+	waitBackends(t, p, "http://10.0.0.1:80 http://10.0.0.2:80")
+
+	put("tls/a", "10.0.0.1:443")
+	if _, err := cli.Delete(context.Background(), prefix+"b"); err != nil {
+		t.Fatal(err)
+	}
+	waitBackends(t, p, "http://10.0.0.1:80 https://10.0.0.1:443")
+	if b := p.Next(true, 1); b == nil || b.Scheme != schemeHTTPS {
+		t.Errorf("The TLS requests should use the TLS backends: %v", b)
+	}
+}
@@ -0,0 +1,275 @@
+package backend
+
+import (
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	defaultHealthPath     = "/"
+	defaultHealthStatus   = http.StatusOK
+	defaultHealthInterval = 5 * time.Second
+	defaultHealthTimeout  = 2 * time.Second
+	defaultHealthRise     = 2
+	defaultHealthFall     = 3
+	maxHealthBodySize     = 64 * 1024
+
+	metricBackendHealthy = "healthy"
+)
+
+var (
+	backendHealthy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "elinproxy",
+		Subsystem: "backend",
+		Name:      metricBackendHealthy,
+		Help:      "Health of the backend, 1 is in the rotation",
+	}, []string{"pool", "backend"})
+
+	// Pools with the health checks running
+	registry sync.Map
+
+	// Like the requests of the handler, the certificates of the
+	// backends are not verified
+	defaultProbeTLSConfig = &tls.Config{InsecureSkipVerify: true}
+)
+
+// HealthCheck define the HTTP probe sent periodically to each backend
+type HealthCheck struct {
+	Path string
+	// Host header of the probe, empty use the address of the backend
+	Host string
+	// Other headers of the probe
+	Headers map[string]string
+	// Expected status code, 200 by default
+	Status int
+	// The body of the response should contain this string
+	Body     string
+	Interval string
+	Timeout  string
+	// Consecutive successful probes to put the backend in the rotation
+	Rise int
+	// Consecutive failed probes to take the backend out of the rotation
+	Fall int
+
+	interval time.Duration
+	timeout  time.Duration
+}
+
+func (hc *HealthCheck) parse() (err error) {
+	if hc.Path == "" {
+		hc.Path = defaultHealthPath
+	}
+	if hc.Status == 0 {
+		hc.Status = defaultHealthStatus
+	}
+	if hc.Rise <= 0 {
+		hc.Rise = defaultHealthRise
+	}
+	if hc.Fall <= 0 {
+		hc.Fall = defaultHealthFall
+	}
+
+	hc.interval = defaultHealthInterval
+	if hc.Interval != "" {
+		if hc.interval, err = time.ParseDuration(hc.Interval); err != nil {
+			return err
+		}
+	}
+	hc.timeout = defaultHealthTimeout
+	if hc.Timeout != "" {
+		if hc.timeout, err = time.ParseDuration(hc.Timeout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newClient return the client of the probes, it should use the TLS
+// config and the server name of the requests sent to the backends
+func (hc *HealthCheck) newClient(tlsConfig *tls.Config) *http.Client {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = tlsConfig.Clone()
+	return &http.Client{
+		Timeout:   hc.timeout,
+		Transport: t,
+		// The redirects are responses of the backend
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// probe return true if the backend response as expected
+func (hc *HealthCheck) probe(client *http.Client, b *Backend) bool {
+	req, err := http.NewRequest(http.MethodGet, b.Scheme+"://"+b.Address()+hc.Path, nil)
+	if err != nil {
+		return false
+	}
+	if hc.Host != "" {
+		req.Host = hc.Host
+	}
+	for k, v := range hc.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != hc.Status {
+		io.Copy(ioutil.Discard, resp.Body)
+		return false
+	}
+	if hc.Body == "" {
+		io.Copy(ioutil.Discard, resp.Body)
+		return true
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxHealthBodySize))
+	if err != nil {
+		return false
+	}
+	return strings.Contains(string(body), hc.Body)
+}
+
+// update the state of the backend with the result of the probe
+func (hc *HealthCheck) update(pool string, b *Backend, ok bool) {
+	if ok {
+		b.failures = 0
+		b.successes++
+		if !b.Healthy() && b.successes >= hc.Rise {
+			atomic.StoreInt32(&b.unhealthy, 0)
+		}
+	} else {
+		b.successes = 0
+		b.failures++
+		if b.Healthy() && b.failures >= hc.Fall {
+			atomic.StoreInt32(&b.unhealthy, 1)
+		}
+	}
+
+	v := 0.0
+	if b.Healthy() {
+		v = 1
+	}
+	backendHealthy.WithLabelValues(pool, b.Address()).Set(v)
+}
+
+// SetTLSConfig set the TLS config of the probes, it should be the config
+// used in the requests to the backends of the pool
+func (p *Pool) SetTLSConfig(tlsConfig *tls.Config) {
+	if p.health == nil || tlsConfig == nil {
+		return
+	}
+	client := p.health.newClient(tlsConfig)
+	p.mu.Lock()
+	old := p.probeClient
+	p.probeClient = client
+	p.mu.Unlock()
+	old.CloseIdleConnections()
+}
+
+// check send the probes to all the backends of the pool
+func (p *Pool) check() {
+	p.mu.Lock()
+	client := p.probeClient
+	p.mu.Unlock()
+
+	wg := &sync.WaitGroup{}
+	for _, b := range p.Backends() {
+		wg.Add(1)
+		go func(b *Backend) {
+			defer wg.Done()
+			p.health.update(p.name, b, p.health.probe(client, b))
+		}(b)
+	}
+	wg.Wait()
+}
+
+// startMetrics initialize the metrics of the backend in the rotation
+func (p *Pool) startMetrics(b *Backend) {
+	backendHealthy.WithLabelValues(p.name, b.Address()).Set(1)
+	if b.breaker != nil {
+		backendCircuit.WithLabelValues(p.name, b.Address()).Set(float64(CircuitClosed))
+	}
+}
+
+// deleteMetrics remove the metrics of the backend, unless other
+// backend of the pool use the same address
+func (p *Pool) deleteMetrics(b *Backend) {
+	for _, v := range p.Backends() {
+		if v != b && v.Address() == b.Address() {
+			return
+		}
+	}
+	backendHealthy.DeleteLabelValues(p.name, b.Address())
+	backendCircuit.DeleteLabelValues(p.name, b.Address())
+	backendEjections.DeleteLabelValues(p.name, b.Address())
+}
+
+// Start the health checks and the discovery of the pool
+func (p *Pool) Start() {
+	registry.Store(p, struct{}{})
+	p.mu.Lock()
+	p.started = true
+	for _, b := range p.Backends() {
+		p.startMetrics(b)
+	}
+	p.mu.Unlock()
+
+	if p.discovery != nil {
+		p.discover()
+	}
+	if p.health == nil {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(p.health.interval)
+		defer ticker.Stop()
+		p.check()
+		for {
+			select {
+			case <-p.done:
+				return
+			case <-ticker.C:
+				p.check()
+			}
+		}
+	}()
+}
+
+// Stop the health checks and the discovery of the pool
+func (p *Pool) Stop() {
+	registry.Delete(p)
+	select {
+	case <-p.done:
+		return
+	default:
+		close(p.done)
+	}
+
+	// The pools that never started don't have metrics, other pool with
+	// the same name can be using them
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.started {
+		return
+	}
+	for _, b := range p.Backends() {
+		p.deleteMetrics(b)
+	}
+	for _, b := range p.draining {
+		p.deleteMetrics(b)
+	}
+}
@@ -0,0 +1,116 @@
+package backend
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthCheck(t *testing.T) {
+	var down int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" || r.Header.Get("X-Probe") != "1" || atomic.LoadInt32(&down) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("status: ok"))
+	}))
+	defer origin.Close()
+
+	u, _ := url.Parse(origin.URL)
+	host, port, _ := net.SplitHostPort(u.Host)
+
+	p, err := NewPool("health", &PoolConfig{
+		Backends: []Config{{Host: host, Port: port}},
+		HealthCheck: &HealthCheck{
+			Path:     "/health",
+			Headers:  map[string]string{"X-Probe": "1"},
+			Body:     "ok",
+			Interval: "10ms",
+			Rise:     2,
+			Fall:     1,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Start()
+	defer p.Stop()
+
+	waitFor := func(healthy bool) {
+		deadline := time.Now().Add(2 * time.Second)
+		for (p.Next(false, 0) != nil) != healthy {
+			if time.Now().After(deadline) {
+				t.Fatalf("The backend should be healthy %v", healthy)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	waitFor(true)
+	atomic.StoreInt32(&down, 1)
+	waitFor(false)
+
+	status := GetStatus()
+	if len(status) != 1 || status[0].Pool != "health" || status[0].Healthy {
+		t.Errorf("Invalid status: %+v", status)
+	}
+
+	atomic.StoreInt32(&down, 0)
+	waitFor(true)
+}
+
+func TestHealthCheckTLS(t *testing.T) {
+	var sni atomic.Value
+	sni.Store("")
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sni.Store(r.TLS.ServerName)
+		w.Write([]byte("ok"))
+	}))
+	defer origin.Close()
+
+	u, _ := url.Parse(origin.URL)
+	host, port, _ := net.SplitHostPort(u.Host)
+
+	// The certificate of the origin is not signed by a known CA
+	p, err := NewPool("health-tls", &PoolConfig{
+		TLSBackends: []Config{{Host: host, Port: port}},
+		Backends:    []Config{{Host: host, Port: port}},
+		HealthCheck: &HealthCheck{Interval: "10ms", Fall: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetTLSConfig(&tls.Config{InsecureSkipVerify: true, ServerName: "origin.internal"})
+
+	b := p.Next(true, 0)
+	if !p.health.probe(p.probeClient, b) {
+		t.Errorf("The probe should use the TLS config of the pool")
+	}
+	if v := sni.Load().(string); v != "origin.internal" {
+		t.Errorf("The probe should send the SNI of the pool: %q", v)
+	}
+}
+
+func TestHealthCheckSkipUnhealthy(t *testing.T) {
+	for _, strategy := range []string{StrategyRoundRobin, StrategyLeastConn, StrategyP2C, StrategyHash} {
+		p := newTestPool(t, strategy)
+		down := p.Backends()[0]
+		atomic.StoreInt32(&down.unhealthy, 1)
+		for i := uint64(0); i < 20; i++ {
+			if b := p.Next(false, i*0x9E3779B97F4A7C15); b == down || b == nil {
+				t.Errorf("%s: the unhealthy backend should not be used", strategy)
+			}
+		}
+
+		atomic.StoreInt32(&p.Backends()[1].unhealthy, 1)
+		if b := p.Next(false, 0); b != nil {
+			t.Errorf("%s: all the backends are unhealthy: %+v", strategy, b)
+		}
+	}
+}
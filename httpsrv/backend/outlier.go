@@ -0,0 +1,255 @@
+package backend
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// States of the circuit breaker
+const (
+	CircuitClosed int32 = iota
+	CircuitOpen
+	CircuitHalfOpen
+
+	defaultOutlierErrors     = 5
+	defaultOutlierWindow     = 100
+	defaultOutlierPercentile = 99
+	defaultBaseEjection      = 10 * time.Second
+	defaultMaxEjection       = 5 * time.Minute
+
+	metricBackendCircuit   = "circuit_state"
+	metricBackendEjections = "ejections_total"
+)
+
+var (
+	circuitNames = map[int32]string{
+		CircuitClosed:   "closed",
+		CircuitOpen:     "open",
+		CircuitHalfOpen: "half-open",
+	}
+
+	backendCircuit = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "elinproxy",
+		Subsystem: "backend",
+		Name:      metricBackendCircuit,
+		Help:      "State of the circuit breaker of the backend, 0 closed, 1 open and 2 half-open",
+	}, []string{"pool", "backend"})
+
+	backendEjections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "elinproxy",
+		Subsystem: "backend",
+		Name:      metricBackendEjections,
+		Help:      "Number of times the backend was ejected by the circuit breaker",
+	}, []string{"pool", "backend"})
+)
+
+// Outlier define when a backend is ejected from the rotation based on
+// the responses of the real requests
+type Outlier struct {
+	// Consecutive 5xx responses or errors (timeouts, connection refused...)
+	ConsecutiveErrors int
+	// Maximum latency of the Percentile of the last Window responses,
+	// empty disable the latency check
+	MaxLatency string
+	Percentile float64
+	Window     int
+	// The ejection time is doubled on each consecutive ejection
+	BaseEjection string
+	MaxEjection  string
+
+	maxLatency   time.Duration
+	baseEjection time.Duration
+	maxEjection  time.Duration
+}
+
+func (o *Outlier) parse() (err error) {
+	if o.ConsecutiveErrors <= 0 {
+		o.ConsecutiveErrors = defaultOutlierErrors
+	}
+	if o.Window <= 0 {
+		o.Window = defaultOutlierWindow
+	}
+	if o.Percentile <= 0 || o.Percentile > 100 {
+		o.Percentile = defaultOutlierPercentile
+	}
+	if o.MaxLatency != "" {
+		if o.maxLatency, err = time.ParseDuration(o.MaxLatency); err != nil {
+			return err
+		}
+	}
+	o.baseEjection = defaultBaseEjection
+	if o.BaseEjection != "" {
+		if o.baseEjection, err = time.ParseDuration(o.BaseEjection); err != nil {
+			return err
+		}
+	}
+	o.maxEjection = defaultMaxEjection
+	if o.MaxEjection != "" {
+		if o.maxEjection, err = time.ParseDuration(o.MaxEjection); err != nil {
+			return err
+		}
+	}
+	if o.maxEjection < o.baseEjection {
+		o.maxEjection = o.baseEjection
+	}
+	return nil
+}
+
+// breaker is the circuit breaker of one backend
+type breaker struct {
+	sync.Mutex
+	cfg   *Outlier
+	pool  string
+	state int32
+	// Consecutive errors in closed state
+	errors int
+	// Consecutive ejections, reset when the probe of the half-open succeeds
+	ejections int
+	until     time.Time
+	latencies []time.Duration
+	next      int
+}
+
+func newBreaker(cfg *Outlier, pool string) *breaker {
+	return &breaker{
+		cfg:       cfg,
+		pool:      pool,
+		latencies: make([]time.Duration, 0, cfg.Window),
+	}
+}
+
+// ejected return true if the requests should not be sent to the backend
+func (br *breaker) ejected(now time.Time) bool {
+	if br == nil || atomic.LoadInt32(&br.state) == CircuitClosed {
+		return false
+	}
+	br.Lock()
+	defer br.Unlock()
+	return now.Before(br.until)
+}
+
+// allow is called when the backend was chosen, if the ejection time is
+// over the request is the probe of the half-open state
+func (br *breaker) allow(b *Backend, now time.Time) {
+	if br == nil || atomic.LoadInt32(&br.state) != CircuitOpen {
+		return
+	}
+	br.Lock()
+	defer br.Unlock()
+	if br.state == CircuitOpen && !now.Before(br.until) {
+		// Only one request until the probe finish, or the ejection
+		// time if the result of the probe is never reported
+		br.until = now.Add(br.cfg.baseEjection)
+		br.setState(b, CircuitHalfOpen)
+	}
+}
+
+// report the result of a request to the backend
+func (br *breaker) report(b *Backend, ok bool, latency time.Duration, now time.Time) {
+	br.Lock()
+	defer br.Unlock()
+
+	switch br.state {
+	case CircuitHalfOpen:
+		if ok {
+			br.ejections = 0
+			br.errors = 0
+			br.latencies = br.latencies[:0]
+			br.next = 0
+			br.setState(b, CircuitClosed)
+		} else {
+			br.eject(b, now)
+		}
+		return
+	case CircuitOpen:
+		// Requests sent before the ejection
+		return
+	}
+
+	if ok {
+		br.errors = 0
+	} else {
+		br.errors++
+		if br.errors >= br.cfg.ConsecutiveErrors {
+			br.eject(b, now)
+			return
+		}
+	}
+
+	if br.cfg.maxLatency <= 0 {
+		return
+	}
+	if len(br.latencies) < br.cfg.Window {
+		br.latencies = append(br.latencies, latency)
+	} else {
+		br.latencies[br.next] = latency
+	}
+	br.next = (br.next + 1) % br.cfg.Window
+	// The percentile is calculated once per window
+	if br.next == 0 && br.percentile() > br.cfg.maxLatency {
+		br.eject(b, now)
+	}
+}
+
+func (br *breaker) percentile() time.Duration {
+	sorted := append([]time.Duration(nil), br.latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	i := int(float64(len(sorted))*br.cfg.Percentile/100+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+// eject open the circuit with exponential backoff
+func (br *breaker) eject(b *Backend, now time.Time) {
+	d := br.cfg.baseEjection
+	for i := 0; i < br.ejections && d < br.cfg.maxEjection; i++ {
+		d *= 2
+	}
+	if d > br.cfg.maxEjection {
+		d = br.cfg.maxEjection
+	}
+	br.ejections++
+	br.errors = 0
+	br.latencies = br.latencies[:0]
+	br.next = 0
+	br.until = now.Add(d)
+	backendEjections.WithLabelValues(br.pool, b.Address()).Inc()
+	br.setState(b, CircuitOpen)
+}
+
+func (br *breaker) setState(b *Backend, state int32) {
+	if br.state != state {
+		log.Printf("httpsrv/backend/outlier %s %s: circuit %s -> %s", br.pool, b.Address(), circuitNames[br.state], circuitNames[state])
+	}
+	atomic.StoreInt32(&br.state, state)
+	backendCircuit.WithLabelValues(br.pool, b.Address()).Set(float64(state))
+}
+
+// Report the result of a request sent to the backend, ok should be false
+// for the 5xx responses and the errors like timeouts. The latency is the
+// time until the response headers.
+func (b *Backend) Report(ok bool, latency time.Duration) {
+	if b.breaker == nil {
+		return
+	}
+	b.breaker.report(b, ok, latency, time.Now())
+}
+
+// Circuit return the state of the circuit breaker of the backend
+func (b *Backend) Circuit() string {
+	if b.breaker == nil {
+		return circuitNames[CircuitClosed]
+	}
+	return circuitNames[atomic.LoadInt32(&b.breaker.state)]
+}
@@ -0,0 +1,125 @@
+package backend
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestOutlierPool(t *testing.T, o *Outlier) *Pool {
+	p, err := NewPool("outlier", &PoolConfig{
+		Backends: []Config{
+			{Host: "10.0.0.1", Port: "80"},
+			{Host: "10.0.0.2", Port: "80"},
+		},
+		Outlier: o,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestOutlierConsecutiveErrors(t *testing.T) {
+	p := newTestOutlierPool(t, &Outlier{
+		ConsecutiveErrors: 3,
+		BaseEjection:      "1s",
+		MaxEjection:       "3s",
+	})
+	b := p.Backends()[0]
+	now := time.Now()
+
+	// The successful responses reset the errors
+	for _, ok := range []bool{false, false, true, false, false} {
+		b.breaker.report(b, ok, 0, now)
+	}
+	if b.Circuit() != "closed" {
+		t.Fatalf("The circuit should be closed: %s", b.Circuit())
+	}
+
+	b.breaker.report(b, false, 0, now)
+	if b.Circuit() != "open" || !b.breaker.ejected(now) {
+		t.Fatalf("The circuit should be open: %s", b.Circuit())
+	}
+	for i := 0; i < 10; i++ {
+		if p.Next(false, 0) == b {
+			t.Fatalf("The ejected backend should not be used")
+		}
+	}
+
+	// Only one request is sent in half-open state
+	now = now.Add(time.Second)
+	b.breaker.allow(b, now)
+	if b.Circuit() != "half-open" || !b.breaker.ejected(now) {
+		t.Fatalf("The circuit should be half-open: %s", b.Circuit())
+	}
+
+	// The probe fails, the ejection time is doubled
+	b.breaker.report(b, false, 0, now)
+	if b.Circuit() != "open" || !b.breaker.ejected(now.Add(1500*time.Millisecond)) || b.breaker.ejected(now.Add(2*time.Second)) {
+		t.Fatalf("The circuit should be open 2s: %s", b.Circuit())
+	}
+
+	// Limited by the max ejection
+	now = now.Add(2 * time.Second)
+	b.breaker.allow(b, now)
+	b.breaker.report(b, false, 0, now)
+	if b.breaker.ejected(now.Add(3 * time.Second)) {
+		t.Fatalf("The ejection should be limited by MaxEjection")
+	}
+
+	now = now.Add(3 * time.Second)
+	b.breaker.allow(b, now)
+	b.breaker.report(b, true, 0, now)
+	if b.Circuit() != "closed" || b.breaker.ejected(now) || b.breaker.ejections != 0 {
+		t.Fatalf("The circuit should be closed: %s", b.Circuit())
+	}
+}
+
+func TestOutlierLatency(t *testing.T) {
+	p := newTestOutlierPool(t, &Outlier{
+		MaxLatency: "100ms",
+		Percentile: 90,
+		Window:     10,
+	})
+	b := p.Backends()[0]
+	now := time.Now()
+
+	report := func(slow int) {
+		for i := 0; i < 10; i++ {
+			latency := 10 * time.Millisecond
+			if i < slow {
+				latency = time.Second
+			}
+			b.breaker.report(b, true, latency, now)
+		}
+	}
+
+	report(1)
+	if b.Circuit() != "closed" {
+		t.Fatalf("The p90 is under the max latency: %s", b.Circuit())
+	}
+	report(2)
+	if b.Circuit() != "open" {
+		t.Fatalf("The p90 is over the max latency: %s", b.Circuit())
+	}
+}
+
+func TestOutlierAllEjected(t *testing.T) {
+	p := newTestOutlierPool(t, &Outlier{ConsecutiveErrors: 1})
+	for _, b := range p.Backends() {
+		b.Report(false, 0)
+	}
+	if b := p.Next(false, 0); b != nil {
+		t.Errorf("All the backends are ejected: %+v", b)
+	}
+}
+
+func TestOutlierInvalidConfig(t *testing.T) {
+	_, err := NewPool("outlier", &PoolConfig{
+		Backends: []Config{{Host: "10.0.0.1", Port: "80"}},
+		Outlier:  &Outlier{BaseEjection: "10"},
+	})
+	if err == nil {
+		t.Errorf("The invalid duration should return an error")
+	}
+}
@@ -0,0 +1,65 @@
+package backend
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// Status of one backend
+type Status struct {
+	Pool    string
+	Host    string
+	Port    string
+	Scheme  string
+	Weight  int
+	Healthy bool
+	Circuit string
+	Active  int64
+	// Removed from the pool, waiting the requests in progress
+	Draining bool
+}
+
+// GetStatus return the status of the backends of all the running pools
+func GetStatus() []Status {
+	status := make([]Status, 0)
+	registry.Range(func(k, v interface{}) bool {
+		p := k.(*Pool)
+		for _, b := range p.Backends() {
+			status = append(status, newStatus(p, b, false))
+		}
+		for _, b := range p.Draining() {
+			status = append(status, newStatus(p, b, true))
+		}
+		return true
+	})
+	sort.Slice(status, func(i, j int) bool {
+		if status[i].Pool != status[j].Pool {
+			return status[i].Pool < status[j].Pool
+		}
+		return status[i].Host+status[i].Port < status[j].Host+status[j].Port
+	})
+	return status
+}
+
+func newStatus(p *Pool, b *Backend, draining bool) Status {
+	return Status{
+		Pool:     p.name,
+		Host:     b.Host,
+		Port:     b.Port,
+		Scheme:   b.Scheme,
+		Weight:   b.Weight,
+		Healthy:  b.Healthy(),
+		Circuit:  b.Circuit(),
+		Active:   b.Active(),
+		Draining: draining,
+	}
+}
+
+// StatusHandler is the admin endpoint with the status of the backends
+func StatusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(GetStatus())
+	})
+}
@@ -0,0 +1,43 @@
+package cacherules
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	headerExpires = "Expires"
+)
+
+// browserTTL return the TTL for the browsers of the rule, the domain or
+// the global rules. The second value is false if the Cache-Control of the
+// backend should be sent without changes.
+func (rs *Rules) browserTTL(rule *Rule, host string) (time.Duration, bool) {
+	if rule != nil && rule.BrowserTTL != "" {
+		return rule.browserTTL, true
+	}
+	if ir, ok := rs.domain(host); ok && ir.BrowserTTL != "" {
+		return ir.browserTTLDuration, true
+	}
+	if rs.InternalRules.BrowserTTL != "" {
+		return rs.browserTTLDuration, true
+	}
+	return 0, false
+}
+
+// RewriteCacheControl replace the Cache-Control of the response sent to
+// the client, so the TTL of the browsers can be different than the TTL
+// of the cache. The objects stored in the cache are not modified.
+func (rs *Rules) RewriteCacheControl(rule *Rule, host string, h http.Header) {
+	ttl, ok := rs.browserTTL(rule, host)
+	if !ok {
+		return
+	}
+	h.Del(headerExpires)
+	if ttl <= 0 {
+		h.Set(headerCacheControl, "no-cache")
+		return
+	}
+	h.Set(headerCacheControl, directivePublic+", max-age="+strconv.Itoa(int(ttl.Seconds())))
+}
@@ -0,0 +1,47 @@
+package cacherules
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRewriteCacheControl(t *testing.T) {
+	rules := &Rules{
+		InternalRules: InternalRules{BrowserTTL: "5m"},
+		Domain: map[string]InternalRules{
+			"nocache.example.com": {BrowserTTL: "0s"},
+		},
+		Rule: []Rule{
+			{Name: "static", Path: "/static/**", BrowserTTL: "24h"},
+		},
+	}
+	if err := rules.Parse(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		url          string
+		cacheControl string
+	}{
+		{"http://www.example.com/", "public, max-age=300"},
+		{"http://nocache.example.com/", "no-cache"},
+		{"http://nocache.example.com/static/app.js", "public, max-age=86400"},
+	}
+	for _, v := range tests {
+		req := newRuleRequest(http.MethodGet, v.url)
+		h := http.Header{}
+		h.Set("Cache-Control", "max-age=3600")
+		h.Set("Expires", "Thu, 01 Dec 2094 16:00:00 GMT")
+		rules.RewriteCacheControl(rules.Match(req), req.Host, h)
+		if h.Get("Cache-Control") != v.cacheControl || h.Get("Expires") != "" {
+			t.Errorf("%s invalid headers: %v", v.url, h)
+		}
+	}
+
+	h := http.Header{}
+	h.Set("Cache-Control", "max-age=3600")
+	(&Rules{}).RewriteCacheControl(nil, "www.example.com", h)
+	if h.Get("Cache-Control") != "max-age=3600" {
+		t.Errorf("The Cache-Control should not be modified: %v", h)
+	}
+}
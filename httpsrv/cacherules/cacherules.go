@@ -1,6 +1,9 @@
 package cacherules
 
 import (
+	"net"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -19,6 +22,35 @@ type InternalRules struct {
 	NoReqCookieContains []string
 	NoReqHeaders        map[string]string
 
+	// Cookies removed from the cachable requests, support glob patterns
+	StripReqCookies []string
+
+	// Policy for the responses with Set-Cookie: no-cache (default),
+	// strip or no-replay
+	SetCookie string
+
+	// TTL of the Cache-Control sent to the browsers, "0s" is no-cache.
+	// Empty keep the Cache-Control of the backend.
+	BrowserTTL         string
+	browserTTLDuration time.Duration
+
+	// POST requests that can be cached
+	CachePOST []PostRule
+
+	// Remove the URL from the cache after a successful POST, PUT, PATCH
+	// or DELETE. Enabled by default.
+	InvalidateOnUnsafe *bool
+
+	// Elements of the request used to build the cache key
+	CacheKey         []string
+	CacheKeyTemplate KeyTemplate
+
+	// URL normalization before build the cache key
+	Normalize *Normalize
+
+	// Classification of the devices, part of the cache key
+	Devices *Devices
+
 	// Headers that condition the cache, blacklist
 	RespHeadersBlackList map[string][]string
 
@@ -31,6 +63,64 @@ type InternalRules struct {
 type Rules struct {
 	InternalRules
 	Domain map[string]InternalRules
+	// Ordered list of rules, the first rule that match is applied. The deny
+	// lists (NoReqPathPrefix, NoReqCookieContains, ...) are applied before.
+	Rule []Rule
+
+	rules []*Rule
+	// Wildcard domains, the most specific first
+	wildcards []string
+}
+
+// domain return the rules of the host, the host can match with
+// the exact name or with a wildcard like "*.example.com"
+func (rs *Rules) domain(host string) (InternalRules, bool) {
+	if k, ok := rs.domainKey(host); ok {
+		return rs.Domain[k], true
+	}
+	return InternalRules{}, false
+}
+
+// domainKey return the name of the domain rules used by the host, the
+// most specific wildcard is used if the host don't have its own rules
+func (rs *Rules) domainKey(host string) (string, bool) {
+	if len(rs.Domain) == 0 {
+		return "", false
+	}
+	if _, ok := rs.Domain[host]; ok {
+		return host, true
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+		if _, ok := rs.Domain[host]; ok {
+			return host, true
+		}
+	}
+	host = strings.ToLower(host)
+	for _, k := range rs.wildcards {
+		if matchHost(strings.ToLower(k), host) {
+			return k, true
+		}
+	}
+	return "", false
+}
+
+// parseWildcards sort the wildcard domains, the longest pattern is the
+// most specific and it is checked first
+func (rs *Rules) parseWildcards() {
+	wildcards := make([]string, 0)
+	for k := range rs.Domain {
+		if strings.HasPrefix(k, wildcardPrefix) {
+			wildcards = append(wildcards, k)
+		}
+	}
+	sort.Slice(wildcards, func(i, j int) bool {
+		if len(wildcards[i]) != len(wildcards[j]) {
+			return len(wildcards[i]) > len(wildcards[j])
+		}
+		return wildcards[i] < wildcards[j]
+	})
+	rs.wildcards = wildcards
 }
 
 type Between []int
@@ -41,3 +131,15 @@ func (b Between) From() int {
 func (b Between) To() int {
 	return b[1]
 }
+
+// InvalidateUnsafe return true if the unsafe methods invalidate the cache
+// of the host, the domain rules have preference over the global rules
+func (rs *Rules) InvalidateUnsafe(host string) bool {
+	if ir, ok := rs.domain(host); ok && ir.InvalidateOnUnsafe != nil {
+		return *ir.InvalidateOnUnsafe
+	}
+	if rs.InvalidateOnUnsafe != nil {
+		return *rs.InvalidateOnUnsafe
+	}
+	return true
+}
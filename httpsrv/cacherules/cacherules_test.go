@@ -87,3 +87,32 @@ Content-Type: font/woff2
 	}
 
 }
+
+func TestDomainOverlappingWildcards(t *testing.T) {
+	yes, no := true, false
+	tests := map[string]bool{
+		"www.example.com":          true,
+		"img.static.example.com":   false,
+		"IMG.Static.example.com:1": false,
+		"example.org":              false,
+	}
+	// The map of the domains is iterated in random order
+	for i := 0; i < 20; i++ {
+		rules := &Rules{
+			InternalRules: InternalRules{InvalidateOnUnsafe: &no},
+			Domain: map[string]InternalRules{
+				"*.example.com":        {InvalidateOnUnsafe: &yes},
+				"*.static.example.com": {InvalidateOnUnsafe: &no},
+				"*.other.example.com":  {InvalidateOnUnsafe: &yes},
+			},
+		}
+		if err := rules.Parse(); err != nil {
+			t.Fatal(err)
+		}
+		for host, expected := range tests {
+			if rules.InvalidateUnsafe(host) != expected {
+				t.Fatalf("%s should use the most specific wildcard: %v", host, !expected)
+			}
+		}
+	}
+}
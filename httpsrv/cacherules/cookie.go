@@ -0,0 +1,98 @@
+package cacherules
+
+import (
+	"errors"
+	"net/http"
+)
+
+// Policies for the responses with Set-Cookie
+const (
+	// The response is not stored in the cache
+	SetCookieNoCache = "no-cache"
+	// The Set-Cookie is removed from the response and the response is stored
+	SetCookieStrip = "strip"
+	// The response is stored without the Set-Cookie, but the cookie is
+	// sent to the client that did the request to the backend
+	SetCookieNoReplay = "no-replay"
+
+	headerSetCookie = "Set-Cookie"
+)
+
+var (
+	// ErrInvalidSetCookie is returned when the Set-Cookie policy is unknown
+	ErrInvalidSetCookie = errors.New("Invalid Set-Cookie policy")
+)
+
+func parseSetCookie(policy string) error {
+	switch policy {
+	case "", SetCookieNoCache, SetCookieStrip, SetCookieNoReplay:
+		return nil
+	}
+	return ErrInvalidSetCookie
+}
+
+// setCookiePolicy return the policy of the rule, the domain or the global
+// rules, by default the responses with Set-Cookie are not cached
+func (rs *Rules) setCookiePolicy(rule *Rule, host string) string {
+	if rule != nil && rule.SetCookie != "" {
+		return rule.SetCookie
+	}
+	if ir, ok := rs.domain(host); ok && ir.SetCookie != "" {
+		return ir.SetCookie
+	}
+	if rs.SetCookie != "" {
+		return rs.SetCookie
+	}
+	return SetCookieNoCache
+}
+
+// ApplySetCookie apply the Set-Cookie policy to the headers of the response,
+// returns false if the response can't be stored in the cache
+func (rs *Rules) ApplySetCookie(rule *Rule, host string, header http.Header) bool {
+	if len(header.Values(headerSetCookie)) == 0 {
+		return true
+	}
+	switch rs.setCookiePolicy(rule, host) {
+	case SetCookieStrip:
+		header.Del(headerSetCookie)
+		return true
+	case SetCookieNoReplay:
+		// The handler never store the Set-Cookie in the cache
+		return true
+	default:
+		return false
+	}
+}
+
+// StripRequestCookies remove from the request the cookies of the list
+// StripReqCookies of the domain or the global rules, like the analytics
+// cookies, so they don't fragment or bypass the cache
+func (rs *Rules) StripRequestCookies(r *http.Request) {
+	patterns := rs.StripReqCookies
+	if ir, ok := rs.domain(r.Host); ok && ir.StripReqCookies != nil {
+		patterns = ir.StripReqCookies
+	}
+	stripCookies(r, patterns)
+}
+
+// StripRequestCookies remove from the request the cookies that match
+// with the glob patterns of the rule, "*" remove all the cookies
+func (rule *Rule) StripRequestCookies(r *http.Request) {
+	if rule == nil {
+		return
+	}
+	stripCookies(r, rule.StripCookies)
+}
+
+func stripCookies(r *http.Request, patterns []string) {
+	if len(patterns) == 0 || r.Header.Get("Cookie") == "" {
+		return
+	}
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, c := range cookies {
+		if !matchGlob(patterns, c.Name) {
+			r.AddCookie(c)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package cacherules
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestApplySetCookie(t *testing.T) {
+	rules := &Rules{
+		InternalRules: InternalRules{SetCookie: SetCookieNoReplay},
+		Domain: map[string]InternalRules{
+			"strip.example.com": {SetCookie: SetCookieStrip},
+		},
+		Rule: []Rule{
+			{Name: "login", Path: "/login", SetCookie: SetCookieNoCache},
+		},
+	}
+	if err := rules.Parse(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		url       string
+		store     bool
+		setCookie bool
+	}{
+		{"http://www.example.com/", true, true},
+		{"http://strip.example.com/", true, false},
+		{"http://strip.example.com/login", false, true},
+	}
+	for _, v := range tests {
+		req := newRuleRequest(http.MethodGet, v.url)
+		h := http.Header{}
+		h.Set("Set-Cookie", "session=1")
+		if store := rules.ApplySetCookie(rules.Match(req), req.Host, h); store != v.store {
+			t.Errorf("%s should be stored %v", v.url, v.store)
+		}
+		if (h.Get("Set-Cookie") != "") != v.setCookie {
+			t.Errorf("%s Set-Cookie should be kept %v", v.url, v.setCookie)
+		}
+	}
+
+	if !(&Rules{}).ApplySetCookie(nil, "www.example.com", http.Header{}) {
+		t.Errorf("The responses without Set-Cookie should be stored")
+	}
+	h := http.Header{"Set-Cookie": {"a=1"}}
+	if (&Rules{}).ApplySetCookie(nil, "www.example.com", h) {
+		t.Errorf("By default the responses with Set-Cookie should not be stored")
+	}
+
+	if err := (&Rules{Rule: []Rule{{SetCookie: "replay"}}}).Parse(); err != ErrInvalidSetCookie {
+		t.Errorf("Invalid policy should fail: %v", err)
+	}
+}
+
+func TestStripRequestCookies(t *testing.T) {
+	rules := &Rules{
+		InternalRules: InternalRules{StripReqCookies: []string{"_ga*", "_fbp"}},
+		Domain: map[string]InternalRules{
+			"app.example.com": {StripReqCookies: []string{}},
+		},
+	}
+
+	cookies := []*http.Cookie{{Name: "_ga", Value: "1"}, {Name: "_fbp", Value: "2"}, {Name: "lang", Value: "es"}}
+
+	req := newRuleRequest(http.MethodGet, "http://www.example.com/", cookies...)
+	rules.StripRequestCookies(req)
+	if c := req.Header.Get("Cookie"); c != "lang=es" {
+		t.Errorf("Invalid cookies: %s", c)
+	}
+
+	req = newRuleRequest(http.MethodGet, "http://app.example.com/", cookies...)
+	rules.StripRequestCookies(req)
+	if c := req.Header.Get("Cookie"); c != "_ga=1; _fbp=2; lang=es" {
+		t.Errorf("The domain rules don't strip cookies: %s", c)
+	}
+}
@@ -0,0 +1,120 @@
+package cacherules
+
+import (
+	"net/http"
+	"time"
+)
+
+// Override can change the decision of the rules for the request, like
+// the routes of the vhosts. The name is added to the trace when the
+// decision changes. The decisions of the deny lists are not overridden. The decisions of the deny lists are not overridden.
+type Override func(r *http.Request, cachable bool) (bool, string)
+
+// RequestDecision is the decision of the cache for a request, the handler
+// and the simulation of the rules use the same sequence
+type RequestDecision struct {
+	Decision
+	// Request used to build the key, the HEAD requests use the key of GET
+	KeyReq *http.Request
+	Device string
+	Key    string
+	// Checks that made the decision
+	Trace []string
+}
+
+// ResponseDecision is the decision of the cache for the response of
+// the backend
+type ResponseDecision struct {
+	Cachable bool
+	TTL      time.Duration
+	Grace    time.Duration
+	// Checks that made the decision
+	Trace []string
+}
+
+// DecideRequest normalize the request, classify the device, strip the
+// cookies and apply the rules and the override. The cookies are restored
+// if the request is not cachable. The uaDevice is the device type of
+// the User-Agent.
+func (rs *Rules) DecideRequest(r *http.Request, uaDevice int, override Override) RequestDecision {
+	keyReq, rewrite := rs.NormalizeRequest(r)
+	if rewrite {
+		r.URL = keyReq.URL
+	}
+	if r.Method == http.MethodHead {
+		// HEAD requests are served from the GET entries
+		keyReq = keyReq.WithContext(keyReq.Context())
+		keyReq.Method = http.MethodGet
+	}
+	d := RequestDecision{KeyReq: keyReq}
+
+	devices := rs.DeviceRules(keyReq.Host)
+	d.Device = devices.Classify(r, uaDevice)
+	if devices.OriginHeader != "" {
+		r.Header.Set(devices.OriginHeader, d.Device)
+	}
+
+	// The cookies like the analytics cookies are removed before apply the
+	// rules, they are restored if the request is not cachable
+	cookies := r.Header["Cookie"]
+	rs.StripRequestCookies(r)
+
+	// The first rule that match define what to do with the request
+	d.Decision = rs.Evaluate(keyReq)
+	if d.Rule != nil {
+		d.Trace = append(d.Trace, "rule:"+d.Rule.Action)
+	}
+	if override != nil && !d.Rule.DenyList() {
+		if cachable, name := override(r, d.Cachable); cachable != d.Cachable {
+			d.Cachable = cachable
+			d.Trace = append(d.Trace, name)
+		}
+	}
+	if d.Cachable {
+		d.Rule.StripRequestCookies(r)
+	} else if cookies != nil {
+		r.Header["Cookie"] = cookies
+	}
+
+	// The body of the cachable POST requests is part of the key
+	var keyExtra []string
+	if d.Cachable && r.Method == http.MethodPost {
+		bodyHash, ok := rs.PostBodyHash(r)
+		if ok {
+			keyExtra = append(keyExtra, bodyHash)
+		} else {
+			d.Trace = append(d.Trace, "CachePOST body")
+		}
+		d.Cachable = ok
+	}
+
+	d.Key = rs.CacheKey(keyReq, d.Rule, d.Device, keyExtra...)
+	return d
+}
+
+// DecideResponse apply the rules to the response of the backend, the
+// Set-Cookie policy of the rule can remove the cookies of the response
+func (rs *Rules) DecideResponse(r *http.Request, rule *Rule, resp *http.Response) ResponseDecision {
+	ttl, ok, reason := rs.ExplainRespCachable(resp)
+	d := ResponseDecision{Grace: rule.GetGrace(), Trace: []string{reason}}
+
+	// The responses to requests with Authorization are private
+	// unless the backend define them as public
+	if ok && !SharedResponse(r, resp.Header) {
+		ok = false
+		d.Trace = append(d.Trace, headerAuthorization)
+	}
+	// The responses with Set-Cookie follow the policy of the rule
+	if ok && !rs.ApplySetCookie(rule, r.Host, resp.Header) {
+		ok = false
+		d.Trace = append(d.Trace, headerSetCookie)
+	}
+	if ok {
+		if ruleTTL := rule.GetTTL(); ruleTTL > 0 {
+			ttl = ruleTTL
+			d.Trace = append(d.Trace, "rule TTL")
+		}
+	}
+	d.Cachable, d.TTL = ok, ttl
+	return d
+}
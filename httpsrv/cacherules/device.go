@@ -0,0 +1,181 @@
+package cacherules
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+
+	"github.com/avct/uasurfer"
+)
+
+// Policies to classify the devices
+const (
+	DevicePolicyNone   = "none"
+	DevicePolicyMobile = "mobile"
+	DevicePolicyFull   = "full"
+
+	DeviceAll     = "all"
+	DeviceMobile  = "mobile"
+	DeviceDesktop = "desktop"
+
+	clientHintMobileHeader = "Sec-CH-UA-Mobile"
+	clientHintMobile       = "?1"
+	clientHintDesktop      = "?0"
+)
+
+var (
+	// ErrInvalidDevicePolicy is returned when the policy is unknown
+	ErrInvalidDevicePolicy = errors.New("Invalid device policy")
+	// ErrInvalidDeviceClass is returned when a class don't have name or rules
+	ErrInvalidDeviceClass = errors.New("Invalid device class")
+
+	defaultDevices = &Devices{Policy: DevicePolicyFull}
+
+	fullDeviceNames = map[uasurfer.DeviceType]string{
+		uasurfer.DeviceUnknown:  "unknown",
+		uasurfer.DeviceComputer: "computer",
+		uasurfer.DeviceTablet:   "tablet",
+		uasurfer.DevicePhone:    "phone",
+		uasurfer.DeviceConsole:  "console",
+		uasurfer.DeviceWearable: "wearable",
+		uasurfer.DeviceTV:       "tv",
+	}
+	fullDeviceClasses = []string{"unknown", "computer", "tablet", "phone", "console", "wearable", "tv"}
+	mobileClasses     = []string{DeviceDesktop, DeviceMobile}
+	noneClasses       = []string{DeviceAll}
+)
+
+// DeviceClass is a custom class of device defined by a regular expression
+// of the User-Agent or by the Client Hint Sec-CH-UA-Mobile
+type DeviceClass struct {
+	Name             string
+	UARegex          string
+	ClientHintMobile *bool
+	re               *regexp.Regexp
+}
+
+// Devices define how the devices are classified, that class is part
+// of the cache key
+type Devices struct {
+	Policy  string
+	Classes []DeviceClass
+	// Header sent to the backend with the class of the device
+	OriginHeader string
+}
+
+func (d *Devices) parse() (err error) {
+	switch d.Policy {
+	case "":
+		d.Policy = DevicePolicyFull
+	case DevicePolicyNone, DevicePolicyMobile, DevicePolicyFull:
+	default:
+		return ErrInvalidDevicePolicy
+	}
+
+	for i := range d.Classes {
+		c := &d.Classes[i]
+		if c.Name == "" || (c.UARegex == "" && c.ClientHintMobile == nil) {
+			return ErrInvalidDeviceClass
+		}
+		if c.UARegex == "" {
+			continue
+		}
+		c.re, err = regexp.Compile(c.UARegex)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *DeviceClass) match(r *http.Request) bool {
+	if c.ClientHintMobile != nil {
+		switch r.Header.Get(clientHintMobileHeader) {
+		case clientHintMobile:
+			return *c.ClientHintMobile
+		case clientHintDesktop:
+			return !*c.ClientHintMobile
+		}
+	}
+	if c.re != nil {
+		return c.re.MatchString(r.UserAgent())
+	}
+	return false
+}
+
+// Classify return the class of the device of the request, uaDevice
+// is the uasurfer.DeviceType detected from the User-Agent
+func (d *Devices) Classify(r *http.Request, uaDevice int) string {
+	for i := range d.Classes {
+		if d.Classes[i].match(r) {
+			return d.Classes[i].Name
+		}
+	}
+
+	switch d.Policy {
+	case DevicePolicyNone:
+		return DeviceAll
+	case DevicePolicyMobile:
+		switch r.Header.Get(clientHintMobileHeader) {
+		case clientHintMobile:
+			return DeviceMobile
+		case clientHintDesktop:
+			return DeviceDesktop
+		}
+		switch uasurfer.DeviceType(uaDevice) {
+		case uasurfer.DevicePhone, uasurfer.DeviceWearable:
+			return DeviceMobile
+		}
+		return DeviceDesktop
+	}
+
+	if name, ok := fullDeviceNames[uasurfer.DeviceType(uaDevice)]; ok {
+		return name
+	}
+	return fullDeviceNames[uasurfer.DeviceUnknown]
+}
+
+// AllClasses return all the possible classes of this configuration
+func (d *Devices) AllClasses() []string {
+	var classes []string
+	switch d.Policy {
+	case DevicePolicyNone:
+		classes = noneClasses
+	case DevicePolicyMobile:
+		classes = mobileClasses
+	default:
+		classes = fullDeviceClasses
+	}
+
+	if len(d.Classes) == 0 {
+		return classes
+	}
+
+	all := make([]string, 0, len(d.Classes)+len(classes))
+	seen := make(map[string]bool)
+	for _, c := range d.Classes {
+		if !seen[c.Name] {
+			seen[c.Name] = true
+			all = append(all, c.Name)
+		}
+	}
+	for _, c := range classes {
+		if !seen[c] {
+			seen[c] = true
+			all = append(all, c)
+		}
+	}
+	return all
+}
+
+// DeviceRules return the device configuration of the host, the domain
+// rules have preference over the global rules
+func (rs *Rules) DeviceRules(host string) *Devices {
+	if ir, ok := rs.domain(host); ok && ir.Devices != nil {
+		return ir.Devices
+	}
+	if rs.Devices != nil {
+		return rs.Devices
+	}
+	return defaultDevices
+}
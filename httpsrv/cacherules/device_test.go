@@ -0,0 +1,88 @@
+package cacherules
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/avct/uasurfer"
+)
+
+func TestDevicesPolicies(t *testing.T) {
+	req := &http.Request{Header: http.Header{}}
+
+	rules := &Rules{
+		Domain: map[string]InternalRules{
+			"none.example.com":   {Devices: &Devices{Policy: DevicePolicyNone}},
+			"mobile.example.com": {Devices: &Devices{Policy: DevicePolicyMobile}},
+		},
+	}
+	if err := rules.Parse(); err != nil {
+		t.Fatal(err)
+	}
+
+	if d := rules.DeviceRules("www.example.com").Classify(req, int(uasurfer.DeviceTablet)); d != "tablet" {
+		t.Errorf("Default policy should use the full list: %s", d)
+	}
+	if n := len(rules.DeviceRules("www.example.com").AllClasses()); n != 7 {
+		t.Errorf("Full list should have 7 classes: %d", n)
+	}
+
+	if d := rules.DeviceRules("none.example.com").Classify(req, int(uasurfer.DevicePhone)); d != DeviceAll {
+		t.Errorf("Policy none: %s", d)
+	}
+	if n := len(rules.DeviceRules("none.example.com").AllClasses()); n != 1 {
+		t.Errorf("Policy none should have one class: %d", n)
+	}
+
+	mobile := rules.DeviceRules("mobile.example.com")
+	if d := mobile.Classify(req, int(uasurfer.DevicePhone)); d != DeviceMobile {
+		t.Errorf("Phone should be mobile: %s", d)
+	}
+	if d := mobile.Classify(req, int(uasurfer.DeviceTablet)); d != DeviceDesktop {
+		t.Errorf("Tablet should be desktop: %s", d)
+	}
+	req.Header.Set("Sec-CH-UA-Mobile", "?1")
+	if d := mobile.Classify(req, int(uasurfer.DeviceComputer)); d != DeviceMobile {
+		t.Errorf("Client hint mobile should be mobile: %s", d)
+	}
+}
+
+func TestDevicesCustomClasses(t *testing.T) {
+	mobile := true
+	devices := &Devices{
+		Policy: DevicePolicyNone,
+		Classes: []DeviceClass{
+			{Name: "bot", UARegex: "(?i)googlebot|bingbot"},
+			{Name: "small", ClientHintMobile: &mobile},
+		},
+	}
+	if err := devices.parse(); err != nil {
+		t.Fatal(err)
+	}
+
+	req := &http.Request{Header: http.Header{}}
+	req.Header.Set("User-Agent", "Mozilla/5.0 (compatible; Googlebot/2.1)")
+	if d := devices.Classify(req, int(uasurfer.DeviceComputer)); d != "bot" {
+		t.Errorf("Should be bot: %s", d)
+	}
+
+	req.Header.Set("User-Agent", "Mozilla/5.0")
+	req.Header.Set("Sec-CH-UA-Mobile", "?1")
+	if d := devices.Classify(req, int(uasurfer.DeviceComputer)); d != "small" {
+		t.Errorf("Should be small: %s", d)
+	}
+
+	req.Header.Set("Sec-CH-UA-Mobile", "?0")
+	if d := devices.Classify(req, int(uasurfer.DeviceComputer)); d != DeviceAll {
+		t.Errorf("Should be all: %s", d)
+	}
+
+	classes := devices.AllClasses()
+	if len(classes) != 3 || classes[0] != "bot" || classes[1] != "small" || classes[2] != DeviceAll {
+		t.Errorf("Invalid classes: %v", classes)
+	}
+
+	if err := (&Devices{Policy: "tiny"}).parse(); err != ErrInvalidDevicePolicy {
+		t.Errorf("Expected ErrInvalidDevicePolicy: %v", err)
+	}
+}
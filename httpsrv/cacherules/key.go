@@ -0,0 +1,192 @@
+package cacherules
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Parts that can be used in the cache key templates
+const (
+	KeyMethod = "method"
+	KeyScheme = "scheme"
+	KeyHost   = "host"
+	KeyPath   = "path"
+	KeyQuery  = "query"
+	KeyDevice = "device"
+
+	keyQueryPrefix  = "query:"
+	keyHeaderPrefix = "header:"
+	keyCookiePrefix = "cookie:"
+	keySeparator    = "|"
+
+	schemeHTTP  = "http"
+	schemeHTTPS = "https"
+)
+
+var (
+	// ErrInvalidKeyPart is returned when a part of the template is unknown
+	ErrInvalidKeyPart = errors.New("Invalid part in the cache key template")
+
+	defaultKeyTemplate = KeyTemplate{
+		{kind: KeyDevice},
+		{kind: KeyMethod},
+		{kind: KeyScheme},
+		{kind: KeyHost},
+		{kind: KeyPath},
+		{kind: KeyQuery},
+	}
+
+	// The separator is escaped in the values, so different requests
+	// can't build the same key
+	keyEscaper = strings.NewReplacer(`\`, `\\`, keySeparator, `\`+keySeparator)
+)
+
+type keyPart struct {
+	kind string
+	name string
+}
+
+// KeyTemplate define the elements of the request used to build the cache key
+type KeyTemplate []keyPart
+
+// ParseKeyTemplate read a list of parts like "method", "host",
+// "query:page", "header:X-Country" or "cookie:currency"
+func ParseKeyTemplate(parts []string) (KeyTemplate, error) {
+	if len(parts) == 0 {
+		return nil, nil
+	}
+
+	kt := make(KeyTemplate, 0, len(parts))
+	for _, p := range parts {
+		p = strings.TrimSpace(p)
+		switch {
+		case p == KeyMethod, p == KeyScheme, p == KeyHost, p == KeyPath, p == KeyQuery, p == KeyDevice:
+			kt = append(kt, keyPart{kind: p})
+		case strings.HasPrefix(p, keyQueryPrefix) && len(p) > len(keyQueryPrefix):
+			kt = append(kt, keyPart{kind: keyQueryPrefix, name: p[len(keyQueryPrefix):]})
+		case strings.HasPrefix(p, keyHeaderPrefix) && len(p) > len(keyHeaderPrefix):
+			kt = append(kt, keyPart{kind: keyHeaderPrefix, name: http.CanonicalHeaderKey(p[len(keyHeaderPrefix):])})
+		case strings.HasPrefix(p, keyCookiePrefix) && len(p) > len(keyCookiePrefix):
+			kt = append(kt, keyPart{kind: keyCookiePrefix, name: p[len(keyCookiePrefix):]})
+		default:
+			return nil, ErrInvalidKeyPart
+		}
+	}
+	return kt, nil
+}
+
+// Build return the key string of the request
+// IMPORTANT: This is the key of the cache engine, if this
+// do not generate the correct string will fuck the cache
+func (kt KeyTemplate) Build(r *http.Request, device string) string {
+	return kt.build(r, requestScheme(r), device)
+}
+
+func (kt KeyTemplate) build(r *http.Request, scheme, device string) string {
+	var b strings.Builder
+	for i, p := range kt {
+		if i > 0 {
+			b.WriteString(keySeparator)
+		}
+		var v string
+		switch p.kind {
+		case KeyMethod:
+			v = r.Method
+		case KeyScheme:
+			v = scheme
+		case KeyHost:
+			v = r.Host
+		case KeyPath:
+			v = r.URL.Path
+		case KeyQuery:
+			v = r.URL.RawQuery
+		case KeyDevice:
+			v = device
+		case keyQueryPrefix:
+			v = strings.Join(r.URL.Query()[p.name], ",")
+		case keyHeaderPrefix:
+			v = strings.Join(r.Header[p.name], ",")
+		case keyCookiePrefix:
+			if c, err := r.Cookie(p.name); err == nil {
+				v = c.Value
+			}
+		}
+		keyEscaper.WriteString(&b, v)
+	}
+	return b.String()
+}
+
+// requestScheme return the scheme used by the client, behind a TLS
+// terminator is the one of the X-Forwarded-Protocol header like in the
+// selection of the backends
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Protocol") == schemeHTTPS {
+		return schemeHTTPS
+	}
+	return schemeHTTP
+}
+
+// has return true if the template use the part
+func (kt KeyTemplate) has(kind string) bool {
+	for _, p := range kt {
+		if p.kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// keyTemplate return the template of the host, the global template if the
+// host don't have one or the default template
+func (rs *Rules) keyTemplate(host string) KeyTemplate {
+	if ir, ok := rs.domain(host); ok && ir.CacheKeyTemplate != nil {
+		return ir.CacheKeyTemplate
+	}
+	if rs.CacheKeyTemplate != nil {
+		return rs.CacheKeyTemplate
+	}
+	return defaultKeyTemplate
+}
+
+// CacheKey return the key string of the request using the template of the
+// rule that matched with the request or the template of the host, the extra
+// values (like the hash of the body) are added at the end
+func (rs *Rules) CacheKey(r *http.Request, rule *Rule, device string, extra ...string) string {
+	key := rs.ruleKeyTemplate(r.Host, rule).Build(r, device)
+	for _, v := range extra {
+		key += keySeparator + keyEscaper.Replace(v)
+	}
+	return key
+}
+
+// ruleKeyTemplate return the template of the rule or the template of the host
+func (rs *Rules) ruleKeyTemplate(host string, rule *Rule) KeyTemplate {
+	if rule != nil && rule.keyTemplate != nil {
+		return rule.keyTemplate
+	}
+	return rs.keyTemplate(host)
+}
+
+// PurgeKeys return the keys of all the copies of the request in the cache,
+// one for each scheme and class of device if they are part of the key. The
+// objects stored over http and https are removed with the same request.
+func (rs *Rules) PurgeKeys(r *http.Request, rule *Rule) []string {
+	kt := rs.ruleKeyTemplate(r.Host, rule)
+	schemes := []string{requestScheme(r)}
+	if kt.has(KeyScheme) {
+		schemes = []string{schemeHTTP, schemeHTTPS}
+	}
+	devices := []string{""}
+	if kt.has(KeyDevice) {
+		devices = rs.DeviceRules(r.Host).AllClasses()
+	}
+
+	keys := make([]string, 0, len(schemes)*len(devices))
+	for _, scheme := range schemes {
+		for _, d := range devices {
+			keys = append(keys, kt.build(r, scheme, d))
+		}
+	}
+	return keys
+}
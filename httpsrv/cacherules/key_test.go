@@ -0,0 +1,152 @@
+package cacherules
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestKeyTemplateDefault(t *testing.T) {
+	rules := &Rules{}
+	if err := rules.Parse(); err != nil {
+		t.Fatal(err)
+	}
+
+	req := &http.Request{Method: http.MethodGet, Host: "www.example.com", Header: http.Header{}}
+	req.URL, _ = url.Parse("http://www.example.com/feed/?page=2")
+
+	key := rules.CacheKey(req, nil, "computer")
+	if key != "computer|GET|http|www.example.com|/feed/|page=2" {
+		t.Errorf("Invalid default key: %s", key)
+	}
+
+	// The redirects to https and the absolute links depend on the scheme
+	req.Header.Set("X-Forwarded-Protocol", "https")
+	if key := rules.CacheKey(req, nil, "computer"); key != "computer|GET|https|www.example.com|/feed/|page=2" {
+		t.Errorf("Invalid default https key: %s", key)
+	}
+}
+
+func TestKeyTemplateDomain(t *testing.T) {
+	rules := &Rules{
+		InternalRules: InternalRules{
+			CacheKey: []string{"host", "path"},
+		},
+		Domain: map[string]InternalRules{
+			"shop.example.com": {
+				CacheKey: []string{"host", "path", "query:page", "header:x-country", "cookie:currency"},
+			},
+		},
+	}
+	if err := rules.Parse(); err != nil {
+		t.Fatal(err)
+	}
+
+	req := &http.Request{Method: http.MethodGet, Host: "shop.example.com", Header: http.Header{}}
+	req.URL, _ = url.Parse("http://shop.example.com/list?page=2&utm_source=x")
+	req.Header.Set("X-Country", "ES")
+	req.AddCookie(&http.Cookie{Name: "currency", Value: "EUR"})
+
+	if key := rules.CacheKey(req, nil, "computer"); key != "shop.example.com|/list|2|ES|EUR" {
+		t.Errorf("Invalid domain key: %s", key)
+	}
+
+	req.Host = "www.example.com"
+	if key := rules.CacheKey(req, nil, "computer"); key != "www.example.com|/list" {
+		t.Errorf("Invalid global key: %s", key)
+	}
+}
+
+func TestKeyTemplateScheme(t *testing.T) {
+	kt, err := ParseKeyTemplate([]string{"scheme", "host", "path"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := &http.Request{Method: http.MethodGet, Host: "www.example.com", Header: http.Header{}}
+	req.URL, _ = url.Parse("/feed/")
+	if key := kt.Build(req, ""); key != "http|www.example.com|/feed/" {
+		t.Errorf("Invalid http key: %s", key)
+	}
+
+	// Behind a TLS terminator
+	req.Header.Set("X-Forwarded-Protocol", "https")
+	if key := kt.Build(req, ""); key != "https|www.example.com|/feed/" {
+		t.Errorf("Invalid https key: %s", key)
+	}
+}
+
+func TestPurgeKeys(t *testing.T) {
+	rules := &Rules{
+		InternalRules: InternalRules{
+			CacheKey: []string{"scheme", "device", "path"},
+			Devices:  &Devices{Policy: DevicePolicyMobile},
+		},
+	}
+	if err := rules.Parse(); err != nil {
+		t.Fatal(err)
+	}
+
+	req := &http.Request{Method: http.MethodGet, Host: "www.example.com", Header: http.Header{}}
+	req.URL, _ = url.Parse("/a")
+	keys := strings.Join(rules.PurgeKeys(req, nil), " ")
+	if keys != "http|desktop|/a http|mobile|/a https|desktop|/a https|mobile|/a" {
+		t.Errorf("Invalid purge keys: %s", keys)
+	}
+
+	// The device is not part of the key
+	rules = &Rules{
+		InternalRules: InternalRules{
+			CacheKey: []string{"host", "path"},
+		},
+	}
+	if err := rules.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	if keys := rules.PurgeKeys(req, nil); len(keys) != 1 || keys[0] != "www.example.com|/a" {
+		t.Errorf("Only one key should be purged: %v", keys)
+	}
+}
+
+func TestKeyTemplateCollision(t *testing.T) {
+	kt, err := ParseKeyTemplate([]string{"path", "header:x-a", "header:x-b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	build := func(path, a, b string) string {
+		req := &http.Request{Method: http.MethodGet, Header: http.Header{}}
+		req.URL = &url.URL{Path: path}
+		req.Header.Set("X-A", a)
+		req.Header.Set("X-B", b)
+		return kt.Build(req, "")
+	}
+
+	keys := map[string]string{
+		"value with separator": build("/a", "a|b", ""),
+		"two values":           build("/a", "a", "b"),
+		"path with separator":  build("/a|a", "b", ""),
+		"escaped separator":    build("/a", `a\`, "b"),
+		"escape at the end":    build("/a", `a\|b`, ""),
+	}
+	seen := make(map[string]string)
+	for name, key := range keys {
+		if other, ok := seen[key]; ok {
+			t.Errorf("%s and %s build the same key: %s", name, other, key)
+		}
+		seen[key] = name
+	}
+	if key := build("/a", "a|b", ""); key != `/a|a\|b|` {
+		t.Errorf("Invalid escaped key: %s", key)
+	}
+}
+
+func TestKeyTemplateInvalid(t *testing.T) {
+	if _, err := ParseKeyTemplate([]string{"host", "body"}); err != ErrInvalidKeyPart {
+		t.Errorf("Expected ErrInvalidKeyPart: %v", err)
+	}
+	if _, err := ParseKeyTemplate([]string{"header:"}); err != ErrInvalidKeyPart {
+		t.Errorf("Expected ErrInvalidKeyPart: %v", err)
+	}
+}
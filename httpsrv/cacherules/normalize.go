@@ -0,0 +1,116 @@
+package cacherules
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+const (
+	encodedSlash = "%2f"
+)
+
+// Normalize define how the URL is canonicalised before build the cache key,
+// so the same resource don't be stored more than one time
+type Normalize struct {
+	Enabled bool
+	// Query params removed from the URL, support glob patterns like "utm_*"
+	StripParams []string
+	// The normalized URL is also used in the request to the backend
+	RewriteOrigin bool
+}
+
+// normalize return the normalization rules of the host, the domain rules
+// have preference over the global rules
+func (rs *Rules) normalize(host string) *Normalize {
+	if ir, ok := rs.domain(host); ok && ir.Normalize != nil {
+		return ir.Normalize
+	}
+	return rs.Normalize
+}
+
+// NormalizeRequest return a copy of the request with the host in lower case,
+// the path without duplicate slashes and canonical percent-encoding, and the
+// query sorted and without the stripped params. The second value is true if
+// the normalized URL should be sent to the backend.
+func (rs *Rules) NormalizeRequest(r *http.Request) (*http.Request, bool) {
+	n := rs.normalize(r.Host)
+	if n == nil || !n.Enabled {
+		return r, false
+	}
+
+	u := *r.URL
+	u.Path = cleanSlashes(u.Path)
+	if !strings.Contains(strings.ToLower(u.RawPath), encodedSlash) {
+		// The encoding is calculated again from the decoded path
+		u.RawPath = ""
+	} else {
+		u.RawPath = cleanSlashes(u.RawPath)
+	}
+	u.RawQuery = n.query(u.RawQuery)
+
+	nr := r.WithContext(r.Context())
+	nr.URL = &u
+	nr.Host = strings.ToLower(r.Host)
+	return nr, n.RewriteOrigin
+}
+
+// query return the query string sorted by key, with canonical
+// encoding and without the params that match with StripParams. The
+// malformed query is kept as it is, the params can't be removed from it.
+func (n *Normalize) query(rawQuery string) string {
+	if rawQuery == "" {
+		return ""
+	}
+	values, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return rawQuery
+	}
+	for k := range values {
+		if n.strip(k) {
+			delete(values, k)
+		}
+	}
+	return values.Encode()
+}
+
+func (n *Normalize) strip(param string) bool {
+	return matchGlob(n.StripParams, param)
+}
+
+// matchGlob return true if the name match with one of the glob patterns
+func matchGlob(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// parseGlobs return an error if a glob pattern is malformed
+func parseGlobs(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("%w: %s", err, pattern)
+		}
+	}
+	return nil
+}
+
+func cleanSlashes(p string) string {
+	if !strings.Contains(p, "//") {
+		return p
+	}
+	var b strings.Builder
+	b.Grow(len(p))
+	for i := 0; i < len(p); i++ {
+		if p[i] == '/' && i > 0 && p[i-1] == '/' {
+			continue
+		}
+		b.WriteByte(p[i])
+	}
+	return b.String()
+}
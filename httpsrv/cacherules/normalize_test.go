@@ -0,0 +1,115 @@
+package cacherules
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestNormalizeRequest(t *testing.T) {
+	rules := &Rules{
+		InternalRules: InternalRules{
+			Normalize: &Normalize{
+				Enabled:     true,
+				StripParams: []string{"utm_*", "fbclid"},
+			},
+		},
+	}
+
+	urls := []string{
+		"http://WWW.Example.com/a//b/%7Euser?b=2&a=1",
+		"http://www.example.com/a/b/~user?a=1&b=2&utm_source=x&utm_medium=y",
+		"http://www.example.com/a/b/%7euser?fbclid=123&a=1&b=2",
+	}
+
+	var first string
+	for _, u := range urls {
+		req := &http.Request{Method: http.MethodGet, Header: http.Header{}}
+		req.URL, _ = url.Parse(u)
+		req.Host = req.URL.Host
+
+		nr, rewrite := rules.NormalizeRequest(req)
+		if rewrite {
+			t.Errorf("RewriteOrigin is not enabled")
+		}
+		key := rules.CacheKey(nr, nil, "all")
+		if first == "" {
+			first = key
+			continue
+		}
+		if key != first {
+			t.Errorf("Different keys for the same resource: %s / %s", first, key)
+		}
+	}
+
+	if first != "all|GET|http|www.example.com|/a/b/~user|a=1&b=2" {
+		t.Errorf("Invalid normalized key: %s", first)
+	}
+}
+
+func TestNormalizeRequestDomainDisabled(t *testing.T) {
+	rules := &Rules{
+		InternalRules: InternalRules{
+			Normalize: &Normalize{Enabled: true},
+		},
+		Domain: map[string]InternalRules{
+			"raw.example.com": {
+				Normalize: &Normalize{Enabled: false},
+			},
+		},
+	}
+
+	req := &http.Request{Method: http.MethodGet, Host: "raw.example.com", Header: http.Header{}}
+	req.URL, _ = url.Parse("http://raw.example.com/a?b=2&a=1")
+
+	if nr, _ := rules.NormalizeRequest(req); nr.URL.RawQuery != "b=2&a=1" {
+		t.Errorf("The domain disable the normalization: %s", nr.URL.RawQuery)
+	}
+
+	req.Host = "www.example.com"
+	if nr, _ := rules.NormalizeRequest(req); nr.URL.RawQuery != "a=1&b=2" {
+		t.Errorf("The global rules should normalize: %s", nr.URL.RawQuery)
+	}
+}
+
+func TestNormalizeRequestMalformedQuery(t *testing.T) {
+	rules := &Rules{
+		InternalRules: InternalRules{
+			Normalize: &Normalize{Enabled: true, StripParams: []string{"utm_*"}},
+		},
+	}
+	if err := rules.Parse(); err != nil {
+		t.Fatal(err)
+	}
+
+	queries := []string{"a=%zz&utm_source=x", "a=%yy&utm_source=x"}
+	keys := make(map[string]bool)
+	for _, q := range queries {
+		req := &http.Request{Method: http.MethodGet, Host: "www.example.com", Header: http.Header{}}
+		req.URL = &url.URL{Scheme: "http", Host: "www.example.com", Path: "/a", RawQuery: q}
+		nr, _ := rules.NormalizeRequest(req)
+		if nr.URL.RawQuery != q {
+			t.Errorf("The malformed query should be kept: %s", nr.URL.RawQuery)
+		}
+		keys[rules.CacheKey(nr, nil, "all")] = true
+	}
+	if len(keys) != len(queries) {
+		t.Errorf("The malformed queries should use different keys")
+	}
+}
+
+func TestNormalizeInvalidGlob(t *testing.T) {
+	rules := &Rules{
+		InternalRules: InternalRules{
+			Normalize: &Normalize{Enabled: true, StripParams: []string{"utm_["}},
+		},
+	}
+	if err := rules.Parse(); err == nil {
+		t.Errorf("The invalid StripParams glob should be rejected")
+	}
+
+	rules = &Rules{Rule: []Rule{{Path: "/**", StripCookies: []string{"["}}}}
+	if err := rules.Parse(); err == nil {
+		t.Errorf("The invalid StripCookies glob should be rejected")
+	}
+}
@@ -31,5 +31,59 @@ func (ir *InternalRules) Parse() error {
 		}
 	}
 
+	ir.CacheKeyTemplate, err = ParseKeyTemplate(ir.CacheKey)
+	if err != nil {
+		log.Printf("D: Cache CacheKey: %v", ir.CacheKey)
+		return err
+	}
+
+	if err = parseSetCookie(ir.SetCookie); err != nil {
+		log.Printf("D: Cache SetCookie: %s", ir.SetCookie)
+		return err
+	}
+
+	if ir.BrowserTTL != "" {
+		ir.browserTTLDuration, err = time.ParseDuration(ir.BrowserTTL)
+		if err != nil {
+			log.Printf("D: Cache BrowserTTL: %s", ir.BrowserTTL)
+			return err
+		}
+	}
+
+	if ir.Normalize != nil {
+		if err = parseGlobs(ir.Normalize.StripParams); err != nil {
+			log.Printf("D: Cache Normalize StripParams: %v", ir.Normalize.StripParams)
+			return err
+		}
+	}
+
+	if err = parseGlobs(ir.StripReqCookies); err != nil {
+		log.Printf("D: Cache StripReqCookies: %v", ir.StripReqCookies)
+		return err
+	}
+
+	if ir.Devices != nil {
+		if err = ir.Devices.parse(); err != nil {
+			log.Printf("D: Cache Devices: %+v", ir.Devices)
+			return err
+		}
+	}
+
 	return nil
 }
+
+// Parse will read the global rules and the rules of each domain
+func (rs *Rules) Parse() error {
+	if err := rs.InternalRules.Parse(); err != nil {
+		return err
+	}
+	for host, ir := range rs.Domain {
+		if err := ir.Parse(); err != nil {
+			log.Printf("D: Cache Domain %s", host)
+			return err
+		}
+		rs.Domain[host] = ir
+	}
+	rs.parseWildcards()
+	return rs.parseRules()
+}
@@ -0,0 +1,106 @@
+package cacherules
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/cespare/xxhash"
+)
+
+const (
+	methodPOST             = "POST"
+	defaultMaxPostBodySize = 64 * 1024
+)
+
+// PostRule define the POST requests that can be cached, like GraphQL
+// or search APIs. The body of the request is part of the cache key.
+type PostRule struct {
+	// Empty Host match with all the hosts
+	Host        string
+	PathPrefix  string
+	MaxBodySize int64
+	// The JSON bodies are normalized before calculate the hash, so
+	// the order of the keys and the spaces are not relevant
+	NormalizeJSON bool
+}
+
+func (ir *InternalRules) postRule(req *http.Request) *PostRule {
+	host, _, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		host = req.Host
+	}
+	for i := range ir.CachePOST {
+		rule := &ir.CachePOST[i]
+		if rule.Host != "" && !strings.EqualFold(rule.Host, host) {
+			continue
+		}
+		if strings.HasPrefix(req.URL.Path, rule.PathPrefix) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// ForHost return the rules of the host or the global rules
+func (rs *Rules) ForHost(host string) *InternalRules {
+	if ir, ok := rs.domain(host); ok {
+		return &ir
+	}
+	return &rs.InternalRules
+}
+
+// PostBodyHash read the body of the POST request and return the hash used
+// in the cache key. The body is replaced by a copy that can be read again
+// and sent to the backend. Returns false if the request can't be cached.
+func (rs *Rules) PostBodyHash(req *http.Request) (string, bool) {
+	rule := rs.ForHost(req.Host).postRule(req)
+	if rule == nil {
+		rule = rs.postRule(req)
+	}
+	if rule == nil || req.Body == nil {
+		return "", false
+	}
+
+	max := rule.MaxBodySize
+	if max <= 0 {
+		max = defaultMaxPostBodySize
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, max+1))
+	if err != nil || int64(len(body)) > max {
+		// Send to the backend what was read and the rest of the body
+		req.Body = readCloser{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+		return "", false
+	}
+	req.Body.Close()
+
+	req.ContentLength = int64(len(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+	req.Body, _ = req.GetBody()
+
+	if rule.NormalizeJSON {
+		var v interface{}
+		d := json.NewDecoder(bytes.NewReader(body))
+		d.UseNumber()
+		if err := d.Decode(&v); err == nil {
+			if b, err := json.Marshal(v); err == nil {
+				body = b
+			}
+		}
+	}
+
+	return strconv.FormatUint(xxhash.Sum64(body), 16), true
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
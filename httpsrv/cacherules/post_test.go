@@ -0,0 +1,50 @@
+package cacherules
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPostBodyHash(t *testing.T) {
+	rules := &Rules{
+		InternalRules: InternalRules{
+			CachePOST: []PostRule{
+				{Host: "api.example.com", PathPrefix: "/graphql", NormalizeJSON: true},
+				{PathPrefix: "/search", MaxBodySize: 8},
+			},
+		},
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "http://api.example.com/graphql", strings.NewReader(`{"b": 2, "a": 1}`))
+	if ok, _ := rules.IsReqCachable(req); !ok {
+		t.Fatalf("POST to /graphql should be cachable")
+	}
+	h1, ok := rules.PostBodyHash(req)
+	if !ok {
+		t.Fatalf("POST to /graphql should be cachable")
+	}
+	if b, _ := ioutil.ReadAll(req.Body); string(b) != `{"b": 2, "a": 1}` {
+		t.Errorf("The body should be replayed: %s", b)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "http://api.example.com/graphql", strings.NewReader(`{"a":1,"b":2}`))
+	if h2, _ := rules.PostBodyHash(req); h1 != h2 {
+		t.Errorf("Normalized JSON should have the same hash: %s/%s", h1, h2)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "http://www.example.com/graphql", strings.NewReader(`{}`))
+	if ok, _ := rules.IsReqCachable(req); ok {
+		t.Errorf("POST to other host should not be cachable")
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "http://www.example.com/search", strings.NewReader(`q=elinproxy`))
+	if _, ok := rules.PostBodyHash(req); ok {
+		t.Errorf("Body bigger than MaxBodySize should not be cachable")
+	}
+	if b, _ := ioutil.ReadAll(req.Body); string(b) != "q=elinproxy" {
+		t.Errorf("The full body should be sent to the backend: %s", b)
+	}
+}
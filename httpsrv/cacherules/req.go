@@ -2,15 +2,24 @@ package cacherules
 
 import (
 	"net/http"
+	"regexp"
 	"strings"
 )
 
+const (
+	headerRegexPrefix = "~"
+)
+
+// IsReqCachable apply the deny lists to the request. The NoReqHeaders are
+// only applied by the rules, see Rules.Evaluate.
 func (ir *InternalRules) IsReqCachable(req *http.Request) (ok bool, refresh bool) {
 	ok = true
 
 	if req.Method != methodGET && req.Method != methodHEAD {
-		ok = false
-		return
+		if req.Method != methodPOST || ir.postRule(req) == nil {
+			ok = false
+			return
+		}
 	}
 
 	if ok = ir.isReqCachableExt(req); !ok {
@@ -84,3 +93,17 @@ func (ir *InternalRules) isReqCachableCookieContains(req *http.Request) bool {
 	}
 	return true
 }
+
+// headerRegexp return the regular expression of a NoReqHeaders value. An
+// empty value match with the presence of the header, a value starting
+// with "~" is a regular expression and any other value should be equal.
+func headerRegexp(v string) string {
+	switch {
+	case v == "":
+		return ""
+	case strings.HasPrefix(v, headerRegexPrefix):
+		return v[len(headerRegexPrefix):]
+	default:
+		return "^" + regexp.QuoteMeta(v) + "$"
+	}
+}
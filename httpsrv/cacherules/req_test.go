@@ -69,3 +69,75 @@ func TestNoReqAll(t *testing.T) {
 		}
 	}
 }
+
+func TestNoReqHeaders(t *testing.T) {
+	cr := InternalRules{
+		NoReqHeaders: map[string]string{
+			"X-Preview":  "",
+			"X-Debug":    "1",
+			"User-Agent": "~(?i)bot",
+		},
+	}
+
+	tests := []struct {
+		header   http.Header
+		cachable bool
+	}{
+		{http.Header{}, true},
+		{http.Header{"X-Preview": {"no"}}, false},
+		{http.Header{"X-Debug": {"1"}}, false},
+		{http.Header{"X-Debug": {"10"}}, true},
+		{http.Header{"User-Agent": {"Googlebot/2.1"}}, false},
+		{http.Header{"User-Agent": {"Mozilla/5.0"}}, true},
+	}
+
+	for _, v := range tests {
+		req := &http.Request{Method: http.MethodGet, Header: v.header}
+		req.URL, _ = url.Parse("http://www.example.com/")
+
+		rules := &Rules{InternalRules: cr}
+		if err := rules.Parse(); err != nil {
+			t.Fatal(err)
+		}
+		if d := rules.Evaluate(req); d.Cachable != v.cachable {
+			t.Errorf("%v should be cachable %v by the rules", v.header, v.cachable)
+		}
+	}
+}
+
+func TestNoReqHeadersInvalid(t *testing.T) {
+	rules := &Rules{InternalRules: InternalRules{
+		NoReqHeaders: map[string]string{"User-Agent": "~(bot"},
+	}}
+	if err := rules.Parse(); err == nil {
+		t.Errorf("The invalid pattern should be rejected")
+	}
+}
+
+func TestSharedResponse(t *testing.T) {
+	req := &http.Request{Method: http.MethodGet, Header: http.Header{}}
+	if !SharedResponse(req, http.Header{}) {
+		t.Errorf("Requests without Authorization are shared")
+	}
+
+	req.Header.Set("Authorization", "Bearer x")
+	tests := []struct {
+		cacheControl string
+		shared       bool
+	}{
+		{"", false},
+		{"max-age=60", false},
+		{"Public, max-age=60", true},
+		{"s-maxage=60", true},
+		{"private", false},
+	}
+	for _, v := range tests {
+		h := http.Header{}
+		if v.cacheControl != "" {
+			h.Set("Cache-Control", v.cacheControl)
+		}
+		if SharedResponse(req, h) != v.shared {
+			t.Errorf("Cache-Control %q should be shared %v", v.cacheControl, v.shared)
+		}
+	}
+}
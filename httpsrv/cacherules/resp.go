@@ -2,29 +2,48 @@ package cacherules
 
 import (
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
 
+const (
+	headerAuthorization = "Authorization"
+	headerCacheControl  = "Cache-Control"
+	directivePublic     = "public"
+	directiveSMaxAge    = "s-maxage"
+)
+
 func (ir *InternalRules) IsRespCachable(resp *http.Response) (ttl time.Duration, ok bool) {
+	ttl, ok, _ = ir.ExplainRespCachable(resp)
+	return
+}
+
+// ExplainRespCachable is like IsRespCachable but also return the name
+// of the check that made the decision
+func (ir *InternalRules) ExplainRespCachable(resp *http.Response) (ttl time.Duration, ok bool, reason string) {
 	ttl, ok, last := ir.getRespStatusCodeTTL(resp)
 	if !ok || last {
 		// If the response code is not cachable
+		reason = "RespStatusCodeTTL " + strconv.Itoa(resp.StatusCode)
 		return
 	}
 
 	// Rules base in the response
 	if ok = ir.isValidRespHeader(resp); !ok {
+		reason = "RespHeadersBlackList"
 		return
 	}
 
 	// Rules base in the response
 	if ttl, ok = ir.getRespContentTypeTTL(ttl, resp); ok {
+		reason = "RespContentTypeTTL"
 		return
 	}
 
 	// By default, we cache the results
 	ok = true
+	reason = "default"
 	return
 }
 
@@ -81,3 +100,21 @@ func (ir *InternalRules) getRespContentTypeTTL(ttl time.Duration, resp *http.Res
 	}
 	return ttl, false
 }
+
+// SharedResponse return false if the response of a request with Authorization
+// can't be stored or served from the shared cache. Only the responses with
+// "public" or "s-maxage" in the Cache-Control are shared, RFC 7234, 3.2
+func SharedResponse(req *http.Request, header http.Header) bool {
+	if req.Header.Get(headerAuthorization) == "" {
+		return true
+	}
+	for _, v := range header.Values(headerCacheControl) {
+		for _, d := range strings.Split(v, ",") {
+			d = strings.ToLower(strings.TrimSpace(d))
+			if d == directivePublic || strings.HasPrefix(d, directiveSMaxAge+"=") {
+				return true
+			}
+		}
+	}
+	return false
+}
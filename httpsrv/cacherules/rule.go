@@ -0,0 +1,440 @@
+package cacherules
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Actions of the rules
+const (
+	ActionCache   = "cache"
+	ActionBypass  = "bypass"
+	ActionRefresh = "refresh"
+
+	wildcardPrefix = "*."
+)
+
+var (
+	// ErrInvalidAction is returned when the action of the rule is unknown
+	ErrInvalidAction = errors.New("Invalid rule action")
+)
+
+// Rule is an element of the ordered list of rules, the first rule that
+// match with the request define what to do with it. All the matchers
+// defined in the rule should match.
+type Rule struct {
+	Name string
+
+	// Matchers
+	Host            string
+	Path            string
+	PathRegex       string
+	Methods         []string
+	Query           map[string]string
+	Headers         map[string]string
+	Cookies         map[string]string
+	CookieNameRegex string
+
+	// Actions
+	Action       string
+	TTL          string
+	Grace        string
+	CacheKey     []string
+	StripCookies []string
+	SetCookie    string
+	BrowserTTL   string
+
+	ttl         time.Duration
+	grace       time.Duration
+	browserTTL  time.Duration
+	keyTemplate KeyTemplate
+	pathRe      *regexp.Regexp
+	cookieRe    *regexp.Regexp
+	queryRe     map[string]*regexp.Regexp
+	headersRe   map[string]*regexp.Regexp
+	cookiesRe   map[string]*regexp.Regexp
+	// Domain of the deny lists translated to the rule, the rule only
+	// match with the hosts that use the rules of that domain
+	domain string
+	// The rule is translated from the deny lists
+	deny bool
+}
+
+// Decision is the result of apply the rules to the request
+type Decision struct {
+	Cachable bool
+	// The request is not cachable and the key should be removed from the cache
+	Refresh bool
+	// Rule that match with the request, nil if no rule match
+	Rule *Rule
+}
+
+// DenyList return true if the rule is translated from the deny lists
+func (rule *Rule) DenyList() bool {
+	return rule != nil && rule.deny
+}
+
+// GetTTL return the TTL defined by the rule, zero if the rule don't define it
+func (rule *Rule) GetTTL() time.Duration {
+	if rule == nil {
+		return 0
+	}
+	return rule.ttl
+}
+
+// GetGrace return the time that the stale object can be served while
+// the object is updated in the background
+func (rule *Rule) GetGrace() time.Duration {
+	if rule == nil {
+		return 0
+	}
+	return rule.grace
+}
+
+// String return the name of the rule and its host, empty if the rule is nil
+func (rule *Rule) String() string {
+	if rule == nil {
+		return ""
+	}
+	if rule.Host != "" {
+		return rule.Name + "@" + rule.Host
+	}
+	if rule.domain != "" {
+		return rule.Name + "@" + rule.domain
+	}
+	return rule.Name
+}
+
+// globToRegexp convert a glob pattern to a regular expression, "*" match
+// with everything except "/", "**" match with everything and "?" with
+// one character
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch glob[i] {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				b.WriteString(".*")
+				i++
+				continue
+			}
+			b.WriteString("[^/]*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(glob[i])))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+func compileMap(m map[string]string, canonical bool) (map[string]*regexp.Regexp, error) {
+	if len(m) == 0 {
+		return nil, nil
+	}
+	res := make(map[string]*regexp.Regexp, len(m))
+	for k, v := range m {
+		if canonical {
+			k = http.CanonicalHeaderKey(k)
+		}
+		if v == "" {
+			// Only the presence is checked
+			res[k] = nil
+			continue
+		}
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return nil, err
+		}
+		res[k] = re
+	}
+	return res, nil
+}
+
+func (rule *Rule) parse() (err error) {
+	switch rule.Action {
+	case "":
+		rule.Action = ActionCache
+	case ActionCache, ActionBypass, ActionRefresh:
+	default:
+		return ErrInvalidAction
+	}
+
+	// The hosts of the requests are compared in lower case
+	rule.Host = strings.ToLower(strings.TrimSpace(rule.Host))
+
+	pathRe := rule.PathRegex
+	if rule.Path != "" {
+		pathRe = globToRegexp(rule.Path)
+	}
+	if pathRe != "" {
+		if rule.pathRe, err = regexp.Compile(pathRe); err != nil {
+			return err
+		}
+	}
+	if rule.CookieNameRegex != "" {
+		if rule.cookieRe, err = regexp.Compile(rule.CookieNameRegex); err != nil {
+			return err
+		}
+	}
+	if rule.queryRe, err = compileMap(rule.Query, false); err != nil {
+		return err
+	}
+	if rule.headersRe, err = compileMap(rule.Headers, true); err != nil {
+		return err
+	}
+	if rule.cookiesRe, err = compileMap(rule.Cookies, false); err != nil {
+		return err
+	}
+
+	if rule.TTL != "" {
+		if rule.ttl, err = time.ParseDuration(rule.TTL); err != nil {
+			return err
+		}
+	}
+	if rule.Grace != "" {
+		if rule.grace, err = time.ParseDuration(rule.Grace); err != nil {
+			return err
+		}
+	}
+	if rule.BrowserTTL != "" {
+		if rule.browserTTL, err = time.ParseDuration(rule.BrowserTTL); err != nil {
+			return err
+		}
+	}
+	if err = parseSetCookie(rule.SetCookie); err != nil {
+		return err
+	}
+	if err = parseGlobs(rule.StripCookies); err != nil {
+		return err
+	}
+	rule.keyTemplate, err = ParseKeyTemplate(rule.CacheKey)
+	return err
+}
+
+// matchHost compare the host with the pattern, the pattern can start
+// with "*." to match with all the subdomains. Both are in lower case.
+func matchHost(pattern, host string) bool {
+	if strings.HasPrefix(pattern, wildcardPrefix) {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return pattern == host
+}
+
+func hostname(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	return strings.ToLower(host)
+}
+
+func matchValues(values []string, re *regexp.Regexp) bool {
+	if len(values) == 0 {
+		return false
+	}
+	if re == nil {
+		return true
+	}
+	for _, v := range values {
+		if re.MatchString(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// Match return true if all the matchers of the rule match with the request
+func (rule *Rule) Match(r *http.Request) bool {
+	if rule.Host != "" && !matchHost(rule.Host, hostname(r)) {
+		return false
+	}
+
+	if len(rule.Methods) > 0 {
+		found := false
+		for _, m := range rule.Methods {
+			if strings.EqualFold(m, r.Method) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if rule.pathRe != nil && !rule.pathRe.MatchString(r.URL.Path) {
+		return false
+	}
+
+	if len(rule.queryRe) > 0 {
+		query := r.URL.Query()
+		for k, re := range rule.queryRe {
+			if !matchValues(query[k], re) {
+				return false
+			}
+		}
+	}
+
+	for k, re := range rule.headersRe {
+		if !matchValues(r.Header[k], re) {
+			return false
+		}
+	}
+
+	if len(rule.cookiesRe) > 0 || rule.cookieRe != nil {
+		cookies := r.Cookies()
+		for k, re := range rule.cookiesRe {
+			var values []string
+			for _, c := range cookies {
+				if c.Name == k {
+					values = append(values, c.Value)
+				}
+			}
+			if !matchValues(values, re) {
+				return false
+			}
+		}
+		if rule.cookieRe != nil {
+			found := false
+			for _, c := range cookies {
+				if rule.cookieRe.MatchString(c.Name) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// legacyRules translate the deny lists of the rules (NoReqExt,
+// NoReqPathPrefix, NoReqHeaders, ...) in bypass rules. The rules of a
+// domain are only applied to the hosts that use that domain.
+func legacyRules(ir *InternalRules, domain string) []Rule {
+	rules := make([]Rule, 0)
+	for k, v := range ir.NoReqHeaders {
+		rules = append(rules, Rule{
+			Name:    "NoReqHeaders " + k,
+			Action:  ActionBypass,
+			Headers: map[string]string{k: headerRegexp(v)},
+			domain:  domain,
+			deny:    true,
+		})
+	}
+
+	add := func(name, action, pathRe, cookieRe string) {
+		rules = append(rules, Rule{
+			Name:            name,
+			Action:          action,
+			PathRegex:       pathRe,
+			CookieNameRegex: cookieRe,
+			domain:          domain,
+			deny:            true,
+		})
+	}
+
+	for _, v := range ir.NoReqExt {
+		add("NoReqExt "+v, ActionBypass, regexp.QuoteMeta(v)+"$", "")
+	}
+	for _, v := range ir.NoReqPathContains {
+		add("NoReqPathContains "+v, ActionBypass, regexp.QuoteMeta(v), "")
+	}
+	for _, v := range ir.NoReqPathPrefix {
+		add("NoReqPathPrefix "+v, ActionBypass, "^"+regexp.QuoteMeta(v), "")
+	}
+	for _, v := range ir.NoReqPathSuffix {
+		add("NoReqPathSuffix "+v, ActionBypass, regexp.QuoteMeta(v)+"$", "")
+	}
+	for _, v := range ir.NoReqCookieContains {
+		add("NoReqCookieContains "+v, ActionRefresh, "", regexp.QuoteMeta(v))
+	}
+	return rules
+}
+
+// parseRules build the ordered list of rules, first the rules translated
+// from the deny lists and after the rules defined in the config. The
+// rules of the config can't cache what the deny lists bypass.
+func (rs *Rules) parseRules() error {
+	legacy := legacyRules(&rs.InternalRules, "")
+	hosts := make([]string, 0, len(rs.Domain))
+	for host := range rs.Domain {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		ir := rs.Domain[host]
+		legacy = append(legacy, legacyRules(&ir, host)...)
+	}
+
+	rules := make([]*Rule, 0, len(legacy)+len(rs.Rule))
+	for i := range legacy {
+		rules = append(rules, &legacy[i])
+	}
+	for i := range rs.Rule {
+		rules = append(rules, &rs.Rule[i])
+	}
+
+	for _, rule := range rules {
+		if err := rule.parse(); err != nil {
+			return err
+		}
+	}
+	rs.rules = rules
+	return nil
+}
+
+// Match return the first rule that match with the request
+func (rs *Rules) Match(r *http.Request) *Rule {
+	domain, _ := rs.domainKey(r.Host)
+	for _, rule := range rs.rules {
+		if rule.domain != "" && rule.domain != domain {
+			continue
+		}
+		if rule.Match(r) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// Evaluate apply the ordered list of rules to the request
+func (rs *Rules) Evaluate(r *http.Request) Decision {
+	d := Decision{}
+
+	switch r.Method {
+	case methodGET, methodHEAD:
+	case methodPOST:
+		if rs.ForHost(r.Host).postRule(r) == nil && rs.postRule(r) == nil {
+			return d
+		}
+	default:
+		return d
+	}
+
+	d.Rule = rs.Match(r)
+	if d.Rule == nil {
+		d.Cachable = true
+		return d
+	}
+
+	switch d.Rule.Action {
+	case ActionBypass:
+	case ActionRefresh:
+		d.Refresh = true
+	default:
+		d.Cachable = true
+	}
+	return d
+}
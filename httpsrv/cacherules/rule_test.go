@@ -0,0 +1,200 @@
+package cacherules
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func newRuleRequest(method, u string, cookies ...*http.Cookie) *http.Request {
+	req := &http.Request{Method: method, Header: http.Header{}}
+	req.URL, _ = url.Parse(u)
+	req.Host = req.URL.Host
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	return req
+}
+
+func TestRulesFirstMatch(t *testing.T) {
+	rules := &Rules{
+		Rule: []Rule{
+			{Name: "admin", Host: "*.Example.com", Path: "/admin/**", Action: ActionBypass},
+			{Name: "images", Path: "/img/*.jpg", TTL: "24h", Grace: "1h"},
+			{Name: "api", PathRegex: "^/api/v[0-9]+/", Query: map[string]string{"debug": ""}, Action: ActionBypass},
+			{Name: "all", Host: "WWW.example.com", TTL: "1m"},
+		},
+	}
+	if err := rules.Parse(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		url  string
+		rule string
+	}{
+		{"http://www.example.com/admin/users/1", "admin"},
+		{"http://static.example.com/admin/", "admin"},
+		{"http://example.org/admin/users", ""},
+		{"http://example.org/img/a.jpg", "images"},
+		{"http://example.org/img/a/b.jpg", ""},
+		{"http://example.org/api/v1/items?debug", "api"},
+		{"http://www.example.com/api/v1/items", "all"},
+		{"http://WWW.Example.com/api/v1/items", "all"},
+		{"http://STATIC.example.com/admin/", "admin"},
+	}
+
+	for _, v := range tests {
+		rule := rules.Match(newRuleRequest(http.MethodGet, v.url))
+		name := ""
+		if rule != nil {
+			name = rule.Name
+		}
+		if name != v.rule {
+			t.Errorf("%s should match with %q: %q", v.url, v.rule, name)
+		}
+	}
+
+	rule := rules.Match(newRuleRequest(http.MethodGet, "http://example.org/img/a.jpg"))
+	if rule.GetTTL() != 24*time.Hour || rule.GetGrace() != time.Hour {
+		t.Errorf("Invalid TTL or grace: %s %s", rule.GetTTL(), rule.GetGrace())
+	}
+}
+
+func TestRulesLegacy(t *testing.T) {
+	rules := &Rules{
+		InternalRules: InternalRules{
+			NoReqExt:            []string{".php"},
+			NoReqPathPrefix:     []string{"/wp-admin"},
+			NoReqCookieContains: []string{"session"},
+		},
+		Domain: map[string]InternalRules{
+			"www.example.com": {NoReqPathContains: []string{"preview"}},
+		},
+	}
+	if err := rules.Parse(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		req      *http.Request
+		cachable bool
+		refresh  bool
+	}{
+		{newRuleRequest(http.MethodGet, "http://example.org/index.html"), true, false},
+		{newRuleRequest(http.MethodGet, "http://example.org/index.php"), false, false},
+		{newRuleRequest(http.MethodGet, "http://example.org/wp-admin/x"), false, false},
+		{newRuleRequest(http.MethodGet, "http://www.example.com/a/preview/1"), false, false},
+		{newRuleRequest(http.MethodGet, "http://example.org/a/preview/1"), true, false},
+		{newRuleRequest(http.MethodGet, "http://example.org/", &http.Cookie{Name: "my_session", Value: "1"}), false, true},
+		{newRuleRequest(http.MethodPost, "http://example.org/"), false, false},
+	}
+
+	for _, v := range tests {
+		d := rules.Evaluate(v.req)
+		if d.Cachable != v.cachable || d.Refresh != v.refresh {
+			t.Errorf("%s %s: %+v", v.req.Method, v.req.URL, d)
+		}
+	}
+}
+
+func TestRulesLegacyMostSpecificDomain(t *testing.T) {
+	rules := &Rules{
+		Domain: map[string]InternalRules{
+			"*.example.com":        {NoReqPathPrefix: []string{"/private"}},
+			"*.static.example.com": {NoReqExt: []string{".php"}},
+			"www.example.com":      {NoReqPathContains: []string{"preview"}},
+		},
+	}
+	if err := rules.Parse(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The deny lists of the domain used by the host, like the other
+	// rules of the domains
+	tests := []struct {
+		url      string
+		cachable bool
+	}{
+		{"http://shop.example.com/private/1", false},
+		{"http://img.static.example.com/private/1", true},
+		{"http://img.static.example.com/index.php", false},
+		{"http://IMG.Static.example.com:8080/index.php", false},
+		{"http://www.example.com/private/1", true},
+		{"http://www.example.com/a/preview", false},
+		{"http://shop.example.com/index.php", true},
+	}
+	for _, v := range tests {
+		if d := rules.Evaluate(newRuleRequest(http.MethodGet, v.url)); d.Cachable != v.cachable {
+			t.Errorf("%s should be cachable %v: %s", v.url, v.cachable, d.Rule)
+		}
+	}
+}
+
+func TestRulesLegacyBeforeRules(t *testing.T) {
+	rules := &Rules{
+		InternalRules: InternalRules{
+			NoReqPathPrefix:     []string{"/wp-admin"},
+			NoReqCookieContains: []string{"session"},
+		},
+		Rule: []Rule{{Name: "all", Path: "/**", Action: ActionCache, TTL: "1h"}},
+	}
+	if err := rules.Parse(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		req      *http.Request
+		cachable bool
+		refresh  bool
+	}{
+		{newRuleRequest(http.MethodGet, "http://example.org/index.html"), true, false},
+		{newRuleRequest(http.MethodGet, "http://example.org/wp-admin/x"), false, false},
+		{newRuleRequest(http.MethodGet, "http://example.org/", &http.Cookie{Name: "my_session", Value: "1"}), false, true},
+	}
+	for _, v := range tests {
+		d := rules.Evaluate(v.req)
+		if d.Cachable != v.cachable || d.Refresh != v.refresh {
+			t.Errorf("%s: the catch-all rule should not override the deny lists: %+v", v.req.URL, d)
+		}
+	}
+}
+
+func TestRuleKeyTemplateAndCookies(t *testing.T) {
+	rules := &Rules{
+		Rule: []Rule{
+			{Path: "/static/**", CacheKey: []string{KeyPath}, StripCookies: []string{"_ga*"}},
+		},
+	}
+	if err := rules.Parse(); err != nil {
+		t.Fatal(err)
+	}
+
+	req := newRuleRequest(http.MethodGet, "http://www.example.com/static/app.js?v=1",
+		&http.Cookie{Name: "_ga", Value: "1"},
+		&http.Cookie{Name: "_gat_x", Value: "2"},
+		&http.Cookie{Name: "lang", Value: "es"},
+	)
+	if key := rules.CacheKey(req, rules.Match(req), DeviceAll); key != "/static/app.js" {
+		t.Errorf("Invalid key: %s", key)
+	}
+
+	rules.Match(req).StripRequestCookies(req)
+	if c := req.Header.Get("Cookie"); c != "lang=es" {
+		t.Errorf("Invalid cookies: %s", c)
+	}
+}
+
+func TestRuleInvalid(t *testing.T) {
+	for _, rule := range []Rule{
+		{Action: "purge"},
+		{PathRegex: "("},
+		{TTL: "1x"},
+	} {
+		rules := &Rules{Rule: []Rule{rule}}
+		if err := rules.Parse(); err == nil {
+			t.Errorf("Rule should be invalid: %+v", rule)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package cacherules
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/avct/uasurfer"
+)
+
+// Simulation is the result of apply the rules to a request and
+// the response of the backend without the proxy
+type Simulation struct {
+	Cachable bool
+	Refresh  bool
+	TTL      time.Duration
+	Grace    time.Duration
+	Key      string
+	Rule     string
+	// Cache-Control sent to the browsers
+	CacheControl string
+	// Checks that made the decision
+	Trace []string
+}
+
+// Simulate apply the rules to the request and the response with the same
+// decisions than the handler. The response can be nil, then only the rules
+// of the request are applied. The override can be nil.
+func (rs *Rules) Simulate(r *http.Request, resp *http.Response, override Override) Simulation {
+	ua := &uasurfer.UserAgent{}
+	uasurfer.ParseUserAgent(r.UserAgent(), ua)
+
+	d := rs.DecideRequest(r, int(ua.DeviceType), override)
+	s := Simulation{
+		Cachable: d.Cachable,
+		Refresh:  d.Refresh,
+		Key:      d.Key,
+		Rule:     d.Rule.String(),
+		Trace:    d.Trace,
+	}
+	if !s.Cachable || resp == nil {
+		return s
+	}
+
+	rd := rs.DecideResponse(r, d.Rule, resp)
+	s.Trace = append(s.Trace, rd.Trace...)
+	s.Cachable = rd.Cachable
+	if !s.Cachable {
+		s.CacheControl = resp.Header.Get(headerCacheControl)
+		return s
+	}
+	s.TTL, s.Grace = rd.TTL, rd.Grace
+
+	// The stored object keep the Cache-Control of the backend
+	h := resp.Header.Clone()
+	rs.RewriteCacheControl(d.Rule, r.Host, h)
+	s.CacheControl = h.Get(headerCacheControl)
+	return s
+}
@@ -0,0 +1,58 @@
+package cacherules
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSimulate(t *testing.T) {
+	rules := &Rules{
+		InternalRules: InternalRules{
+			NoReqExt:                []string{".php"},
+			RespStatusCodeTTLString: map[string]string{"200": "1h", "404": "1m"},
+		},
+		Rule: []Rule{
+			{Name: "static", Path: "/static/**", TTL: "24h", BrowserTTL: "1m"},
+		},
+	}
+	if err := rules.Parse(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The routes can override the decision of the rules
+	override := func(r *http.Request, cachable bool) (bool, string) {
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			return false, "route:api"
+		}
+		return cachable, ""
+	}
+
+	tests := []struct {
+		url          string
+		status       int
+		cachable     bool
+		ttl          time.Duration
+		rule         string
+		cacheControl string
+	}{
+		{"http://www.example.com/", http.StatusOK, true, time.Hour, "", "max-age=10"},
+		{"http://www.example.com/missing", http.StatusNotFound, true, time.Minute, "", "max-age=10"},
+		{"http://www.example.com/error", http.StatusInternalServerError, false, 0, "", "max-age=10"},
+		{"http://www.example.com/index.php", http.StatusOK, false, 0, "NoReqExt .php", ""},
+		{"http://www.example.com/static/app.js", http.StatusOK, true, 24 * time.Hour, "static", "public, max-age=60"},
+		{"http://www.example.com/api/items", http.StatusOK, false, 0, "", ""},
+	}
+	for _, v := range tests {
+		req := newRuleRequest(http.MethodGet, v.url)
+		resp := &http.Response{StatusCode: v.status, Header: http.Header{"Cache-Control": {"max-age=10"}}}
+		s := rules.Simulate(req, resp, override)
+		if s.Cachable != v.cachable || s.TTL != v.ttl || s.Rule != v.rule || s.CacheControl != v.cacheControl {
+			t.Errorf("%s: %+v", v.url, s)
+		}
+		if s.Key == "" {
+			t.Errorf("%s without key", v.url)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package cluster
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gabrielperezs/elinproxy/httpsrv/backend"
+)
+
+const (
+	poolName             = "cluster"
+	defaultEtcdPrefix    = "/elinproxy/cluster/"
+	defaultLeaseTTL      = 10
+	defaultHotCacheTTL   = time.Minute
+	defaultEtcdEndpoints = "http://localhost:2379"
+
+	// TokenHeader is the header of the requests to the internal API
+	// with the Token of the cluster
+	TokenHeader = "X-Elinproxy-Peer-Token"
+)
+
+var (
+	// ErrEmptySelf is returned when the address of the node is not defined
+	ErrEmptySelf = errors.New("The cluster Self address is empty")
+	// ErrEmptyToken is returned when the token of the internal API is
+	// not defined
+	ErrEmptyToken = errors.New("The cluster Token is empty")
+)
+
+// Config of the cluster, the nodes share the cache and each key is
+// stored only by its owner in the consistent hash ring
+type Config struct {
+	// Address of the internal API of this node, used by the peers
+	Self string
+	// Address where the internal API listen, Self by default
+	Listen string
+	// Token of the internal API, required. The peers send it in the
+	// TokenHeader and the requests without it are rejected.
+	Token string
+	// Static list of peers, the addresses of their internal API
+	Peers []string
+	// Register the node and discover the peers in etcd
+	Etcd          bool
+	EtcdEndpoints []string
+	EtcdPrefix    string
+	// Health of the peers, the keys of the unhealthy peers are moved
+	// to the next node of the ring
+	HealthCheck *backend.HealthCheck
+	Outlier     *backend.Outlier
+	// Keep a local copy of the objects owned by the peers
+	HotCache    bool
+	HotCacheTTL string
+
+	hotCacheTTL time.Duration
+}
+
+// Cluster keep the ring of the peers updated
+type Cluster struct {
+	mu    sync.Mutex
+	cfg   *Config
+	self  string
+	peers []string
+	pool  atomic.Value
+	etcd  *etcdMembership
+}
+
+func (cfg *Config) parse() (err error) {
+	if cfg.Self == "" {
+		return ErrEmptySelf
+	}
+	if cfg.Token == "" {
+		return ErrEmptyToken
+	}
+	if cfg.Listen == "" {
+		cfg.Listen = cfg.Self
+	}
+	if cfg.EtcdPrefix == "" {
+		cfg.EtcdPrefix = defaultEtcdPrefix
+	}
+	if len(cfg.EtcdEndpoints) == 0 {
+		cfg.EtcdEndpoints = []string{defaultEtcdEndpoints}
+	}
+	cfg.hotCacheTTL = defaultHotCacheTTL
+	if cfg.HotCacheTTL != "" {
+		if cfg.hotCacheTTL, err = time.ParseDuration(cfg.HotCacheTTL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// New build the ring with the static peers and start the discovery
+// of the peers in etcd if it is enabled
+func New(cfg *Config) (*Cluster, error) {
+	if err := cfg.parse(); err != nil {
+		return nil, err
+	}
+
+	c := &Cluster{
+		cfg:  cfg,
+		self: cfg.Self,
+	}
+	if err := c.SetPeers(cfg.Peers); err != nil {
+		return nil, err
+	}
+
+	if cfg.Etcd {
+		etcd, err := newEtcdMembership(c)
+		if err != nil {
+			c.Stop()
+			return nil, err
+		}
+		c.etcd = etcd
+	}
+	return c, nil
+}
+
+// HotCache return the maximum TTL of the local copies of the objects
+// owned by the peers, zero if the local copies are disabled
+func (c *Cluster) HotCache() time.Duration {
+	if c == nil || !c.cfg.HotCache {
+		return 0
+	}
+	return c.cfg.hotCacheTTL
+}
+
+// Self return the address of this node
+func (c *Cluster) Self() string {
+	return c.self
+}
+
+// Peers return the members of the ring, this node included
+func (c *Cluster) Peers() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.peers...)
+}
+
+// SetPeers update the ring with the new members, only the keys of
+// the nodes added or removed change of owner
+func (c *Cluster) SetPeers(peers []string) error {
+	members := map[string]bool{c.self: true}
+	for _, p := range peers {
+		if p = strings.TrimSpace(p); p != "" {
+			members[p] = true
+		}
+	}
+	list := make([]string, 0, len(members))
+	for p := range members {
+		list = append(list, p)
+	}
+	sort.Strings(list)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if equal(list, c.peers) {
+		return nil
+	}
+
+	backends := make([]backend.Config, 0, len(list))
+	for _, p := range list {
+		host, port, err := net.SplitHostPort(p)
+		if err != nil {
+			return err
+		}
+		backends = append(backends, backend.Config{Host: host, Port: port})
+	}
+
+	// The peers that don't change keep their health and circuit breaker
+	if pool, ok := c.pool.Load().(*backend.Pool); ok {
+		if err := pool.SetBackends(backends, nil); err != nil {
+			return err
+		}
+	} else {
+		pool, err := backend.NewPool(poolName, &backend.PoolConfig{
+			Strategy:    backend.StrategyHash,
+			Backends:    backends,
+			HealthCheck: c.healthCheck(),
+			Outlier:     c.cfg.Outlier,
+		})
+		if err != nil {
+			return err
+		}
+		pool.Start()
+		c.pool.Store(pool)
+	}
+	c.peers = list
+	log.Printf("httpsrv/cluster peers: %v", list)
+	return nil
+}
+
+// healthCheck return the probes of the peers, with the token of the
+// internal API
+func (c *Cluster) healthCheck() *backend.HealthCheck {
+	if c.cfg.HealthCheck == nil {
+		return c.cfg.HealthCheck
+	}
+	hc := *c.cfg.HealthCheck
+	hc.Headers = map[string]string{TokenHeader: c.cfg.Token}
+	for k, v := range c.cfg.HealthCheck.Headers {
+		hc.Headers[k] = v
+	}
+	return &hc
+}
+
+// Authorized return true if the request to the internal API send the
+// token of the cluster, false without cluster
+func (c *Cluster) Authorized(r *http.Request) bool {
+	if c == nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get(TokenHeader)), []byte(c.cfg.Token)) == 1
+}
+
+// Token return the token of the internal API
+func (c *Cluster) Token() string {
+	if c == nil {
+		return ""
+	}
+	return c.cfg.Token
+}
+
+// Pool return the peers of the ring
+func (c *Cluster) Pool() *backend.Pool {
+	return c.pool.Load().(*backend.Pool)
+}
+
+// Owner return the node that store the key, self is true if the owner
+// is this node. Returns nil if all the peers are unhealthy.
+func (c *Cluster) Owner(key uint64) (owner *backend.Backend, self bool) {
+	if c == nil {
+		return nil, true
+	}
+	owner = c.Pool().Next(false, key)
+	if owner == nil {
+		return nil, true
+	}
+	return owner, owner.Address() == c.self
+}
+
+// Stop the discovery and the health checks of the peers
+func (c *Cluster) Stop() {
+	if c.etcd != nil {
+		c.etcd.stop()
+	}
+	if pool, ok := c.pool.Load().(*backend.Pool); ok {
+		pool.Stop()
+	}
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
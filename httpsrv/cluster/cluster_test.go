@@ -0,0 +1,133 @@
+package cluster
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gabrielperezs/elinproxy/httpsrv/backend"
+)
+
+func newTestCluster(t *testing.T, self string, peers ...string) *Cluster {
+	c, err := New(&Config{Self: self, Token: "secret", Peers: peers})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Stop)
+	return c
+}
+
+func owners(c *Cluster, n int) map[uint64]string {
+	res := make(map[uint64]string, n)
+	for i := 0; i < n; i++ {
+		key := uint64(i) * 0x9E3779B97F4A7C15
+		b, _ := c.Owner(key)
+		res[key] = b.Address()
+	}
+	return res
+}
+
+func TestClusterOwner(t *testing.T) {
+	peers := []string{"10.0.0.1:8081", "10.0.0.2:8081", "10.0.0.3:8081"}
+	a := newTestCluster(t, peers[0], peers...)
+	b := newTestCluster(t, peers[1], peers[0], peers[2])
+
+	if len(a.Peers()) != 3 || len(b.Peers()) != 3 {
+		t.Fatalf("Invalid peers: %v %v", a.Peers(), b.Peers())
+	}
+
+	// All the nodes agree in the owner of the keys
+	oa, ob := owners(a, 1000), owners(b, 1000)
+	count := make(map[string]int)
+	for k, v := range oa {
+		if ob[k] != v {
+			t.Fatalf("The nodes don't agree in the owner of %d: %s %s", k, v, ob[k])
+		}
+		count[v]++
+
+		owner, self := a.Owner(k)
+		if self != (owner.Address() == peers[0]) {
+			t.Errorf("Invalid self for %s", owner.Address())
+		}
+	}
+	for _, p := range peers {
+		if count[p] < 200 {
+			t.Errorf("Invalid distribution: %v", count)
+		}
+	}
+}
+
+func TestClusterRebalance(t *testing.T) {
+	peers := make([]string, 0)
+	for i := 1; i <= 4; i++ {
+		peers = append(peers, "10.0.0."+strconv.Itoa(i)+":8081")
+	}
+	c := newTestCluster(t, peers[0], peers...)
+	before := owners(c, 1000)
+
+	if err := c.SetPeers(append(peers, "10.0.0.5:8081")); err != nil {
+		t.Fatal(err)
+	}
+	after := owners(c, 1000)
+
+	// Only the keys of the new node change of owner
+	moved := 0
+	for k, v := range before {
+		if after[k] != v {
+			moved++
+			if after[k] != "10.0.0.5:8081" {
+				t.Errorf("The key %d moved to an old node: %s -> %s", k, v, after[k])
+			}
+		}
+	}
+	if moved == 0 || moved > 350 {
+		t.Errorf("Invalid number of keys moved: %d", moved)
+	}
+}
+
+func TestClusterSetPeersKeepState(t *testing.T) {
+	// Nothing listen in the peers, the health checks fail
+	c, err := New(&Config{
+		Self:        "127.0.0.2:1",
+		Token:       "secret",
+		Peers:       []string{"127.0.0.3:1"},
+		HealthCheck: &backend.HealthCheck{Interval: "10ms", Fall: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+
+	pool := c.Pool()
+	deadline := time.Now().Add(2 * time.Second)
+	for pool.Next(false, 0) != nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("The peers should be unhealthy")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if err := c.SetPeers([]string{"127.0.0.3:1", "127.0.0.4:1"}); err != nil {
+		t.Fatal(err)
+	}
+	if c.Pool() != pool {
+		t.Fatalf("The pool of the peers should be updated, not replaced")
+	}
+	for _, b := range pool.Backends() {
+		if b.Address() != "127.0.0.4:1" && b.Healthy() {
+			t.Errorf("The peer %s should keep its health", b.Address())
+		}
+	}
+}
+
+func TestClusterInvalid(t *testing.T) {
+	if _, err := New(&Config{}); err != ErrEmptySelf {
+		t.Errorf("The empty Self should be invalid: %v", err)
+	}
+	if _, err := New(&Config{Self: "10.0.0.1:8081"}); err != ErrEmptyToken {
+		t.Errorf("The empty Token should be invalid: %v", err)
+	}
+	if _, err := New(&Config{Self: "10.0.0.1", Token: "secret"}); err == nil {
+		t.Errorf("The Self without port should be invalid")
+	}
+}
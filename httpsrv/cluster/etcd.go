@@ -0,0 +1,143 @@
+package cluster
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"go.etcd.io/etcd/clientv3"
+)
+
+const (
+	etcdTimeout = 2 * time.Second
+	etcdRetry   = 5 * time.Second
+)
+
+// etcdMembership register the node in etcd with a lease, so the node
+// is removed if it dies, and watch the registered peers
+type etcdMembership struct {
+	c      *Cluster
+	cli    *clientv3.Client
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newEtcdMembership(c *Cluster) (*etcdMembership, error) {
+	cli, err := clientv3.New(clientv3.Config{
+		Endpoints:   c.cfg.EtcdEndpoints,
+		DialTimeout: etcdTimeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	m := &etcdMembership{
+		c:    c,
+		cli:  cli,
+		done: make(chan struct{}),
+	}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	go m.run()
+	return m, nil
+}
+
+func (m *etcdMembership) key() string {
+	return m.c.cfg.EtcdPrefix + m.c.self
+}
+
+// register the node with a lease that is renewed while the node is alive
+func (m *etcdMembership) register() (<-chan *clientv3.LeaseKeepAliveResponse, error) {
+	ctx, cancel := context.WithTimeout(m.ctx, etcdTimeout)
+	defer cancel()
+
+	lease, err := m.cli.Grant(ctx, defaultLeaseTTL)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := m.cli.Put(ctx, m.key(), m.c.self, clientv3.WithLease(lease.ID)); err != nil {
+		return nil, err
+	}
+	return m.cli.KeepAlive(m.ctx, lease.ID)
+}
+
+// load the registered peers and return the revision to watch the changes
+func (m *etcdMembership) load() (int64, error) {
+	ctx, cancel := context.WithTimeout(m.ctx, etcdTimeout)
+	defer cancel()
+
+	resp, err := m.cli.Get(ctx, m.c.cfg.EtcdPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return 0, err
+	}
+	peers := append([]string(nil), m.c.cfg.Peers...)
+	for _, kv := range resp.Kvs {
+		peers = append(peers, strings.TrimPrefix(string(kv.Key), m.c.cfg.EtcdPrefix))
+	}
+	if err := m.c.SetPeers(peers); err != nil {
+		log.Printf("httpsrv/cluster/etcd ERROR: %s", err)
+	}
+	return resp.Header.Revision, nil
+}
+
+func (m *etcdMembership) run() {
+	defer close(m.done)
+	for {
+		if err := m.session(); err != nil {
+			log.Printf("httpsrv/cluster/etcd ERROR: %s", err)
+		}
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-time.After(etcdRetry):
+		}
+	}
+}
+
+// session register the node and update the ring with the changes of
+// the peers until the lease or the watch fails
+func (m *etcdMembership) session() error {
+	keepAlive, err := m.register()
+	if err != nil {
+		return err
+	}
+	rev, err := m.load()
+	if err != nil {
+		return err
+	}
+
+	watch := m.cli.Watch(m.ctx, m.c.cfg.EtcdPrefix, clientv3.WithPrefix(), clientv3.WithRev(rev+1))
+	for {
+		select {
+		case <-m.ctx.Done():
+			return nil
+		case _, ok := <-keepAlive:
+			if !ok {
+				return nil
+			}
+		case resp, ok := <-watch:
+			if !ok {
+				return resp.Err()
+			}
+			if err := resp.Err(); err != nil {
+				return err
+			}
+			// The full list is loaded again, the events can be compacted
+			if _, err := m.load(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (m *etcdMembership) stop() {
+	m.cancel()
+	<-m.done
+
+	// The peers remove this node from the ring without wait the lease
+	ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+	m.cli.Delete(ctx, m.key())
+	cancel()
+	m.cli.Close()
+}
@@ -0,0 +1,47 @@
+package cluster
+
+import (
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/integration"
+)
+
+func waitPeers(t *testing.T, c *Cluster, n int) {
+	deadline := time.Now().Add(10 * time.Second)
+	for len(c.Peers()) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d peers: %v", n, c.Peers())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClusterEtcd(t *testing.T) {
+	clus := integration.NewClusterV3(t, &integration.ClusterConfig{Size: 1})
+	defer clus.Terminate(t)
+
+	newNode := func(self string) *Cluster {
+		c, err := New(&Config{
+			Self:          self,
+			Token:         "secret",
+			Etcd:          true,
+			EtcdEndpoints: []string{clus.Members[0].GRPCAddr()},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	a := newNode("10.0.0.1:8081")
+	defer a.Stop()
+	b := newNode("10.0.0.2:8081")
+
+	waitPeers(t, a, 2)
+	waitPeers(t, b, 2)
+
+	// The node is removed from the ring of the peers when it stops
+	b.Stop()
+	waitPeers(t, a, 1)
+}
@@ -0,0 +1,447 @@
+package handler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/cespare/xxhash"
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/gabrielperezs/elinproxy/lsm"
+)
+
+const (
+	encodingGzip         = "gzip"
+	encodingBrotli       = "br"
+	encodingZstd         = "zstd"
+	encodingIdentity     = "identity"
+	encodingAny          = "*"
+	defaultMaxEncodeSize = 4 * 1024 * 1024
+	headerAcceptEncoding = "Accept-Encoding"
+	encodedKeySeparator  = "|"
+	encodeQueueSize      = 64
+	metricEncodeDropped  = "encode_dropped"
+)
+
+var (
+	encodeDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "elinproxy",
+		Subsystem: "handler",
+		Name:      metricEncodeDropped,
+		Help:      "Compressions of cached objects skipped because all the workers were busy",
+	})
+
+	errUnknownEncoding = errors.New("Unknown content encoding")
+	compressibleTypes  = []string{
+		"text/",
+		"application/json",
+		"application/javascript",
+		"application/x-javascript",
+		"application/xml",
+		"application/rss+xml",
+		"application/atom+xml",
+		"image/svg+xml",
+	}
+)
+
+// encodedKey is the key of the item compressed with the encoding
+func encodedKey(key uint64, enc string) uint64 {
+	return xxhash.Sum64String(strconv.FormatUint(key, 10) + encodedKeySeparator + enc)
+}
+
+// acceptEncoding return all the Accept-Encoding lines of the request
+// as one list
+func acceptEncoding(h http.Header) string {
+	return strings.Join(h.Values(headerAcceptEncoding), ",")
+}
+
+// contentEncoding return the Content-Encoding of the headers in lower
+// case, like the encodings of the Accept-Encoding are compared
+func contentEncoding(h http.Header) string {
+	return strings.ToLower(strings.TrimSpace(h.Get("Content-Encoding")))
+}
+
+// acceptsEncoding read the Accept-Encoding of the request and return
+// true if the client accept the encoding
+func acceptsEncoding(acceptEncoding, enc string) bool {
+	return encodingQ(acceptEncoding, enc) > 0
+}
+
+// encodingQ return the preference of the client for the encoding,
+// zero if the client don't accept it
+func encodingQ(acceptEncoding, enc string) float64 {
+	if enc == "" || enc == encodingIdentity {
+		return 1
+	}
+
+	any := 0.0
+	for _, v := range strings.Split(acceptEncoding, ",") {
+		name, q := v, 1.0
+		if i := strings.Index(v, ";"); i >= 0 {
+			name = v[:i]
+			param := strings.TrimSpace(v[i+1:])
+			if strings.HasPrefix(param, "q=") {
+				if f, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = f
+				}
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case enc:
+			return q
+		case encodingAny:
+			any = q
+		}
+	}
+	return any
+}
+
+// preferredEncodings return the encodings accepted by the client,
+// sorted by the q-value of the Accept-Encoding
+func preferredEncodings(acceptEncoding string, encodings []string) []string {
+	type pref struct {
+		enc string
+		q   float64
+	}
+	prefs := make([]pref, 0, len(encodings))
+	for _, enc := range encodings {
+		if q := encodingQ(acceptEncoding, enc); q > 0 {
+			prefs = append(prefs, pref{enc, q})
+		}
+	}
+	sort.SliceStable(prefs, func(i, j int) bool { return prefs[i].q > prefs[j].q })
+
+	list := make([]string, len(prefs))
+	for i, p := range prefs {
+		list[i] = p.enc
+	}
+	return list
+}
+
+// parseEncodings remove the encodings that can't be produced
+func parseEncodings(encodings []string) []string {
+	valid := make([]string, 0, len(encodings))
+	for _, enc := range encodings {
+		enc = strings.ToLower(strings.TrimSpace(enc))
+		switch enc {
+		case encodingGzip, encodingBrotli, encodingZstd:
+			valid = append(valid, enc)
+		default:
+			log.Printf("httpsrv/handler/encoding ERROR %q: %s", enc, errUnknownEncoding)
+		}
+	}
+	return valid
+}
+
+func isCompressible(contentType string) bool {
+	for _, v := range compressibleTypes {
+		if strings.HasPrefix(contentType, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeReader(enc string, r io.Reader) (io.ReadCloser, error) {
+	switch enc {
+	case "", encodingIdentity:
+		return ioutil.NopCloser(r), nil
+	case encodingGzip:
+		return gzip.NewReader(r)
+	case encodingBrotli:
+		return ioutil.NopCloser(brotli.NewReader(r)), nil
+	case encodingZstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	}
+	return nil, errUnknownEncoding
+}
+
+func encodeBody(enc string, body []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, len(body)/2))
+	var w io.WriteCloser
+	var err error
+	switch enc {
+	case encodingGzip:
+		w = gzip.NewWriter(buf)
+	case encodingBrotli:
+		w = brotli.NewWriterLevel(buf, brotli.DefaultCompression)
+	case encodingZstd:
+		w, err = zstd.NewWriter(buf)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errUnknownEncoding
+	}
+
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// etagEncoding return the ETag of the representation with the encoding
+func etagEncoding(etag, enc string) string {
+	if etag == "" || !strings.HasSuffix(etag, `"`) {
+		return etag
+	}
+	return etag[:len(etag)-1] + "-" + enc + `"`
+}
+
+// setEncodingHeaders fix the headers of the representation with the encoding
+func setEncodingHeaders(h http.Header, enc string) {
+	if enc == encodingIdentity {
+		h.Del("Content-Encoding")
+	} else {
+		h.Set("Content-Encoding", enc)
+	}
+	h.Del("Content-Length")
+	if etag := h.Get("ETag"); etag != "" {
+		h.Set("ETag", etagEncoding(etag, enc))
+	}
+	addVaryEncoding(h)
+}
+
+// addVaryEncoding add Accept-Encoding to the Vary of the headers, the
+// caches after the proxy don't serve the body to other clients
+func addVaryEncoding(h http.Header) {
+	for _, v := range h["Vary"] {
+		for _, hv := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(hv), headerAcceptEncoding) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", headerAcceptEncoding)
+}
+
+// encodeJob is the compression of one cached object
+type encodeJob struct {
+	base, key uint64
+	enc       string
+	encodings []string
+	body      []byte
+	header    http.Header
+	check     uint64
+	staleAt   int64
+	fetchedAt int64
+	ttl       time.Duration
+}
+
+// startEncoders start the workers of the compressions, the number of
+// compressions at the same time is limited to the workers
+func (handler *Handler) startEncoders() {
+	n := runtime.NumCPU() / 2
+	if n < 1 {
+		n = 1
+	}
+	handler.encodeJobs = make(chan *encodeJob, encodeQueueSize)
+	for i := 0; i < n; i++ {
+		go func() {
+			for job := range handler.encodeJobs {
+				handler.encode(job)
+			}
+		}()
+	}
+}
+
+// storeEncodings compress the body of the item with the encodings defined
+// in the config and store them in the cache, linked to the base key. The
+// compression is skipped if all the workers are busy. The compressed
+// copies of the previous object are removed first, they are never
+// served after the new object is stored.
+func (handler *Handler) storeEncodings(base, key uint64, item *lsm.ItemMem, ttl time.Duration) {
+	encodings := handler.encodings()
+	for _, e := range encodings {
+		handler.cache.Delete(encodedKey(key, e))
+	}
+	if len(encodings) == 0 || item.StatusCode != http.StatusOK {
+		return
+	}
+
+	enc := contentEncoding(item.Header)
+	if (enc != "" && enc != encodingGzip) || !isCompressible(item.Header.Get("Content-Type")) {
+		return
+	}
+
+	if item.Len() > defaultMaxEncodeSize {
+		return
+	}
+
+	// Copy of the body and headers, the item can be evicted
+	// before the end of the compression
+	job := &encodeJob{
+		base:      base,
+		key:       key,
+		enc:       enc,
+		encodings: encodings,
+		body:      append([]byte(nil), item.Bytes()...),
+		header:    item.Header.Clone(),
+		check:     item.Check,
+		staleAt:   item.StaleAt,
+		fetchedAt: item.FetchedAt,
+		ttl:       ttl,
+	}
+
+	select {
+	case handler.encodeJobs <- job:
+	default:
+		encodeDropped.Inc()
+	}
+}
+
+// current return true if the object of the job is still in the cache,
+// the queued jobs of the replaced objects are skipped
+func (handler *Handler) current(job *encodeJob) bool {
+	item, _, err := handler.cache.Peek(job.key, job.check)
+	if err != nil {
+		return false
+	}
+	defer item.Done()
+	return item.GetFetchedAt().UnixNano() == job.fetchedAt
+}
+
+func (handler *Handler) encode(job *encodeJob) {
+	if !handler.current(job) {
+		return
+	}
+	r, err := decodeReader(job.enc, bytes.NewReader(job.body))
+	if err != nil {
+		log.Printf("httpsrv/handler/storeEncodings decode %s: %s", job.enc, err)
+		return
+	}
+	plain, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		log.Printf("httpsrv/handler/storeEncodings decode %s: %s", job.enc, err)
+		return
+	}
+
+	for _, e := range job.encodings {
+		if e == job.enc {
+			continue
+		}
+		b, err := encodeBody(e, plain)
+		if err != nil {
+			log.Printf("httpsrv/handler/storeEncodings encode %s: %s", e, err)
+			continue
+		}
+
+		itm := handler.cache.NewItem(len(b))
+		itm.Key = encodedKey(job.key, e)
+		itm.Check = job.check
+		itm.StatusCode = http.StatusOK
+		itm.StaleAt = job.staleAt
+		itm.FetchedAt = job.fetchedAt
+		for k, v := range job.header {
+			itm.Header[k] = append(itm.Header[k], v...)
+		}
+		setEncodingHeaders(itm.Header, e)
+		itm.Write(b)
+
+		handler.cache.Set(itm.Key, itm, job.ttl)
+		handler.cache.Link(job.base, itm.Key, job.ttl)
+	}
+}
+
+// negotiated return true if the body of the response depends on the
+// Accept-Encoding of the client: it is decoded for the clients that
+// don't accept its encoding or it can be served compressed
+func (handler *Handler) negotiated(h http.Header) bool {
+	if enc := contentEncoding(h); enc != "" && enc != encodingIdentity {
+		return true
+	}
+	return len(handler.encodings()) > 0 && isCompressible(h.Get("Content-Type"))
+}
+
+func (handler *Handler) encodings() []string {
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	return handler.cfg.Encodings
+}
+
+// cachedItem return the item with the encoding preferred by the client.
+// The hits are counted in the object, not in its compressed copies.
+func (handler *Handler) cachedItem(key, check uint64, r *http.Request) (lsm.Item, bool, error) {
+	item, ok, err := handler.cache.Get(key, check)
+	if err != nil {
+		return item, ok, err
+	}
+	for _, enc := range preferredEncodings(acceptEncoding(r.Header), handler.encodings()) {
+		if encItem, encOk, err := handler.cache.Peek(encodedKey(key, enc), check); err == nil {
+			item.Done()
+			return encItem, encOk, nil
+		}
+	}
+	return item, ok, nil
+}
+
+// writeDecoded write the body of the item without the content encoding
+// for the clients that don't accept it
+func writeDecoded(w io.Writer, item lsm.Item, enc string) error {
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := item.WriteTo(pw)
+		pw.CloseWithError(err)
+	}()
+
+	// The item should not be used after the return
+	defer func() {
+		pr.Close()
+		<-done
+	}()
+
+	r, err := decodeReader(enc, pr)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = io.Copy(w, r)
+	return err
+}
+
+type decodedBody struct {
+	io.Reader
+	dec  io.Closer
+	body io.Closer
+}
+
+func (d decodedBody) Close() error {
+	d.dec.Close()
+	return d.body.Close()
+}
+
+// decodeResponse remove the content encoding of the response from the
+// backend for the clients that don't accept it
+func decodeResponse(resp *http.Response, enc string) error {
+	r, err := decodeReader(enc, resp.Body)
+	if err != nil {
+		return err
+	}
+	resp.Body = decodedBody{Reader: r, dec: r, body: resp.Body}
+	resp.ContentLength = -1
+	setEncodingHeaders(resp.Header, encodingIdentity)
+	return nil
+}
@@ -0,0 +1,247 @@
+package handler
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAcceptsEncoding(t *testing.T) {
+	tests := []struct {
+		header string
+		enc    string
+		ok     bool
+	}{
+		{"gzip, deflate, br", "br", true},
+		{"gzip, deflate", "br", false},
+		{"", "gzip", false},
+		{"", "", true},
+		{"gzip;q=0", "gzip", false},
+		{"gzip;q=0.5", "gzip", true},
+		{"*", "zstd", true},
+		{"*;q=0, gzip", "br", false},
+		{"GZIP", "gzip", true},
+	}
+
+	for _, v := range tests {
+		if ok := acceptsEncoding(v.header, v.enc); ok != v.ok {
+			t.Errorf("Accept-Encoding %q with %q should be %v", v.header, v.enc, v.ok)
+		}
+	}
+}
+
+func TestAcceptEncodingLines(t *testing.T) {
+	h := http.Header{}
+	h.Add(headerAcceptEncoding, "gzip")
+	h.Add(headerAcceptEncoding, "br;q=0.5")
+	if !acceptsEncoding(acceptEncoding(h), encodingBrotli) {
+		t.Errorf("The encodings of all the lines should be accepted: %q", acceptEncoding(h))
+	}
+	if list := strings.Join(preferredEncodings(acceptEncoding(h), []string{encodingBrotli, encodingGzip}), " "); list != "gzip br" {
+		t.Errorf("Invalid preferred encodings: %q", list)
+	}
+}
+
+func TestPreferredEncodings(t *testing.T) {
+	encodings := []string{encodingZstd, encodingBrotli, encodingGzip}
+	tests := []struct {
+		header   string
+		expected string
+	}{
+		{"gzip, br, zstd", "zstd br gzip"},
+		{"gzip, br;q=0.8, zstd;q=0.5", "gzip br zstd"},
+		{"br;q=0.9, *;q=0.1", "br zstd gzip"},
+		{"zstd;q=0, gzip", "gzip"},
+		{"", ""},
+	}
+
+	for _, v := range tests {
+		if list := strings.Join(preferredEncodings(v.header, encodings), " "); list != v.expected {
+			t.Errorf("Accept-Encoding %q should prefer %q: %q", v.header, v.expected, list)
+		}
+	}
+}
+
+func TestParseEncodings(t *testing.T) {
+	list := parseEncodings([]string{"br", " GZIP", "deflate", "zstd"})
+	if strings.Join(list, " ") != "br gzip zstd" {
+		t.Errorf("The unknown encodings should be removed: %v", list)
+	}
+}
+
+func TestEncodeDecodeBody(t *testing.T) {
+	body := bytes.Repeat([]byte("elinproxy "), 1024)
+	for _, enc := range []string{encodingGzip, encodingBrotli, encodingZstd} {
+		b, err := encodeBody(enc, body)
+		if err != nil {
+			t.Fatalf("Encode %s: %s", enc, err)
+		}
+		if len(b) >= len(body) {
+			t.Errorf("Encode %s should compress: %d/%d", enc, len(b), len(body))
+		}
+
+		r, err := decodeReader(enc, bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("Decode %s: %s", enc, err)
+		}
+		plain, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("Decode %s: %s", enc, err)
+		}
+		if !bytes.Equal(plain, body) {
+			t.Errorf("Decode %s don't match with the original body", enc)
+		}
+	}
+}
+
+func TestSetEncodingHeaders(t *testing.T) {
+	h := http.Header{}
+	h.Set("Content-Encoding", "gzip")
+	h.Set("Content-Length", "100")
+	h.Set("ETag", `W/"abc"`)
+	h.Set("Vary", "Cookie")
+
+	setEncodingHeaders(h, encodingBrotli)
+	if h.Get("Content-Encoding") != encodingBrotli {
+		t.Errorf("Invalid Content-Encoding: %s", h.Get("Content-Encoding"))
+	}
+	if h.Get("Content-Length") != "" {
+		t.Errorf("Content-Length should be removed")
+	}
+	if h.Get("ETag") != `W/"abc-br"` {
+		t.Errorf("Invalid ETag: %s", h.Get("ETag"))
+	}
+	if len(h["Vary"]) != 2 || h["Vary"][1] != headerAcceptEncoding {
+		t.Errorf("Invalid Vary: %v", h["Vary"])
+	}
+
+	setEncodingHeaders(h, encodingIdentity)
+	if h.Get("Content-Encoding") != "" {
+		t.Errorf("Content-Encoding should be removed")
+	}
+	if len(h["Vary"]) != 2 {
+		t.Errorf("Vary should not be duplicated: %v", h["Vary"])
+	}
+}
+
+func TestStoreEncodingsReplaced(t *testing.T) {
+	origin, _ := newTestOrigin("origin")
+	defer origin.Close()
+
+	h := newTestHandler(t, origin, nil)
+	h.cfg.Encodings = []string{"br"}
+	h.Reload(h.cfg)
+
+	const key = 1
+	store := func(body string) {
+		item := h.cache.NewItem(len(body))
+		item.Key = key
+		item.StatusCode = http.StatusOK
+		item.FetchedAt = time.Now().UnixNano()
+		item.Header.Set("Content-Type", "text/plain")
+		item.Write([]byte(body))
+		h.cache.Set(key, item, time.Hour)
+		h.storeEncodings(key, key, item, time.Hour)
+	}
+	encoding := func() string {
+		req := httptest.NewRequest(http.MethodGet, "http://www.example.com/", nil)
+		req.Header.Set(headerAcceptEncoding, "br")
+		item, _, err := h.cachedItem(key, 0, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer item.Done()
+		return item.GetHeader().Get("Content-Encoding")
+	}
+
+	store(strings.Repeat("old ", 100))
+	deadline := time.Now().Add(5 * time.Second)
+	for encoding() != "br" {
+		if time.Now().After(deadline) {
+			t.Fatalf("The object should be compressed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// The compressed copies and the queued jobs don't count hits
+	item, _, err := h.cache.Peek(key, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	item.Done()
+	if item.GetHIT() == 0 {
+		t.Errorf("The hits of the requests should be counted in the object")
+	}
+	before := item.GetHIT()
+	encoding()
+	if hits := item.GetHIT(); hits != before+1 {
+		t.Errorf("One request should count one hit: %d", hits-before)
+	}
+
+	// The workers are busy, the new object is not compressed
+	h.encodeJobs = make(chan *encodeJob)
+	store(strings.Repeat("new ", 100))
+	if enc := encoding(); enc != "" {
+		t.Errorf("The compressed copy of the old object should be removed: %q", enc)
+	}
+}
+
+func TestHandlerVaryEncoding(t *testing.T) {
+	body := strings.Repeat("gzip ", 100)
+	gz, err := encodeBody(encodingGzip, []byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		if r.URL.Path == "/plain" {
+			w.Write([]byte(body))
+			return
+		}
+		w.Header().Set("Content-Encoding", "GZIP")
+		w.Write(gz)
+	}))
+	defer origin.Close()
+
+	h := newTestHandler(t, origin, nil)
+	request := func(path, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://www.example.com"+path, nil)
+		if accept != "" {
+			req.Header.Set(headerAcceptEncoding, accept)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	// The stored object is served compressed or decoded on MISS and HIT
+	tests := []struct {
+		accept string
+		xcache string
+		enc    string
+		body   string
+	}{
+		{"gzip", xCacheMISS, "GZIP", string(gz)},
+		{"gzip", xCacheHIT, "GZIP", string(gz)},
+		{"", xCacheHIT, "", body},
+	}
+	for _, v := range tests {
+		w := request("/gzip", v.accept)
+		if w.Header().Get(headerXCache) != v.xcache || w.Header().Get("Content-Encoding") != v.enc || w.Body.String() != v.body {
+			t.Errorf("%q %s: invalid response %v", v.accept, v.xcache, w.Header())
+		}
+		if !strings.Contains(w.Header().Get("Vary"), headerAcceptEncoding) {
+			t.Errorf("%q %s: the response should vary by %s: %v", v.accept, v.xcache, headerAcceptEncoding, w.Header())
+		}
+	}
+
+	// Without encodings the plain objects don't depend on the client
+	if w := request("/plain", "gzip"); w.Header().Get("Vary") != "" {
+		t.Errorf("The plain object should not vary: %v", w.Header())
+	}
+}
@@ -0,0 +1,243 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gabrielperezs/elinproxy/httpsrv/cacherules"
+	"github.com/gabrielperezs/elinproxy/lsm"
+)
+
+// Values of the header X-Elinproxy-Cache
+const (
+	explainHIT    = "HIT"
+	explainMISS   = "MISS"
+	explainSTALE  = "STALE"
+	explainBYPASS = "BYPASS"
+
+	explainStorageMem  = "mem"
+	explainStorageDisk = "disk"
+
+	headerExplainCache   = "X-Elinproxy-Cache"
+	headerExplainKey     = "X-Elinproxy-Key"
+	headerExplainRule    = "X-Elinproxy-Rule"
+	headerExplainTTL     = "X-Elinproxy-TTL"
+	headerExplainStorage = "X-Elinproxy-Storage"
+	headerExplainTrace   = "X-Elinproxy-Trace"
+)
+
+type explainCtxKey struct{}
+
+// Explain define which requests get the debug headers with the
+// decisions of the cache
+type Explain struct {
+	// The requests with this header and the secret as value
+	Header string
+	Secret string
+	// IPs or CIDRs of the clients that always get the debug headers
+	AllowIPs []string
+
+	nets []*net.IPNet
+}
+
+func (e *Explain) parse() {
+	e.nets = e.nets[:0]
+	for _, v := range e.AllowIPs {
+		if !strings.Contains(v, "/") {
+			if strings.Contains(v, ":") {
+				v += "/128"
+			} else {
+				v += "/32"
+			}
+		}
+		if _, n, err := net.ParseCIDR(v); err == nil {
+			e.nets = append(e.nets, n)
+		}
+	}
+}
+
+// enabled return true if the request should get the debug headers, the
+// secret header is removed from the request
+func (e *Explain) enabled(r *http.Request) bool {
+	if e == nil {
+		return false
+	}
+
+	ok := false
+	if e.Header != "" && e.Secret != "" {
+		v := r.Header.Get(e.Header)
+		if v != "" {
+			r.Header.Del(e.Header)
+			ok = subtle.ConstantTimeCompare([]byte(v), []byte(e.Secret)) == 1
+		}
+	}
+	if ok || len(e.nets) == 0 {
+		return ok
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range e.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// explain collect the decisions of the cache for one request, all
+// the methods can be called with a nil explain
+type explain struct {
+	status  string
+	key     string
+	rule    string
+	ttl     time.Duration
+	storage string
+	trace   []string
+}
+
+func explainFrom(r *http.Request) *explain {
+	ex, _ := r.Context().Value(explainCtxKey{}).(*explain)
+	return ex
+}
+
+func (ex *explain) setStatus(status string) {
+	if ex != nil {
+		ex.status = status
+	}
+}
+
+func (ex *explain) setKey(key string) {
+	if ex != nil {
+		ex.key = key
+	}
+}
+
+func (ex *explain) setTTL(ttl time.Duration) {
+	if ex != nil {
+		ex.ttl = ttl
+	}
+}
+
+func (ex *explain) setRule(rule *cacherules.Rule) {
+	if ex == nil {
+		return
+	}
+	ex.rule = "default"
+	if rule != nil {
+		ex.rule = rule.String()
+	}
+}
+
+func (ex *explain) setItem(item lsm.Item) {
+	if ex == nil {
+		return
+	}
+	switch item.(type) {
+	case *lsm.ItemDisk:
+		ex.storage = explainStorageDisk
+	default:
+		ex.storage = explainStorageMem
+	}
+}
+
+func (ex *explain) addTrace(steps ...string) {
+	if ex != nil {
+		ex.trace = append(ex.trace, steps...)
+	}
+}
+
+func (ex *explain) writeHeaders(h http.Header) {
+	if ex.status != "" {
+		h.Set(headerExplainCache, ex.status)
+	}
+	if ex.key != "" {
+		h.Set(headerExplainKey, ex.key)
+	}
+	if ex.rule != "" {
+		h.Set(headerExplainRule, ex.rule)
+	}
+	if ex.ttl > 0 {
+		h.Set(headerExplainTTL, ex.ttl.String())
+	}
+	if ex.storage != "" {
+		h.Set(headerExplainStorage, ex.storage)
+	}
+	if len(ex.trace) > 0 {
+		h.Set(headerExplainTrace, strings.Join(ex.trace, ", "))
+	}
+}
+
+// explainWriter add the debug headers before write the response
+type explainWriter struct {
+	http.ResponseWriter
+	ex          *explain
+	wroteHeader bool
+}
+
+func (w *explainWriter) WriteHeader(statusCode int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.ex.writeHeaders(w.Header())
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *explainWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush send the buffered data to the client, the streaming responses of
+// the backends need it
+func (w *explainWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// CloseNotify return the notifications of the wrapped writer, the channel
+// is never closed if it don't support them
+func (w *explainWriter) CloseNotify() <-chan bool {
+	if cn, ok := w.ResponseWriter.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return make(chan bool)
+}
+
+// Hijack return the connection of the wrapped writer, the upgrades like
+// WebSocket need it
+func (w *explainWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hj, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return hj.Hijack()
+	}
+	return nil, nil, errors.New("httpsrv/handler/explain: the writer don't support hijack")
+}
+
+// explain return the request and the writer with the explain mode
+// enabled if the request should get the debug headers
+func (handler *Handler) explain(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request) {
+	if !handler.cfg.Explain.enabled(r) {
+		return w, r
+	}
+	ex := &explain{}
+	r = r.WithContext(context.WithValue(r.Context(), explainCtxKey{}, ex))
+	return &explainWriter{ResponseWriter: w, ex: ex}, r
+}
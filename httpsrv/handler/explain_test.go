@@ -0,0 +1,160 @@
+package handler
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gabrielperezs/elinproxy/httpsrv/cacherules"
+)
+
+func TestExplainEnabled(t *testing.T) {
+	e := &Explain{
+		Header:   "X-Debug",
+		Secret:   "s3cr3t",
+		AllowIPs: []string{"10.0.0.0/8", "192.168.1.1"},
+	}
+	e.parse()
+
+	tests := []struct {
+		remoteAddr string
+		secret     string
+		enabled    bool
+	}{
+		{"1.2.3.4:1234", "", false},
+		{"1.2.3.4:1234", "s3cr3t", true},
+		{"1.2.3.4:1234", "wrong", false},
+		{"10.1.2.3:1234", "", true},
+		{"192.168.1.1:1234", "", true},
+		{"192.168.1.2:1234", "", false},
+	}
+	for _, v := range tests {
+		r := httptest.NewRequest(http.MethodGet, "http://www.example.com/", nil)
+		r.RemoteAddr = v.remoteAddr
+		if v.secret != "" {
+			r.Header.Set("X-Debug", v.secret)
+		}
+		if e.enabled(r) != v.enabled {
+			t.Errorf("%s %q should be %v", v.remoteAddr, v.secret, v.enabled)
+		}
+		if r.Header.Get("X-Debug") != "" {
+			t.Errorf("The secret header should be removed")
+		}
+	}
+
+	var disabled *Explain
+	if disabled.enabled(httptest.NewRequest(http.MethodGet, "http://www.example.com/", nil)) {
+		t.Errorf("The explain mode should be disabled by default")
+	}
+}
+
+func TestHandlerExplain(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Debug") != "" {
+			t.Errorf("The secret header was sent to the backend")
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("hello"))
+	}))
+	defer origin.Close()
+
+	h := newTestHandler(t, origin, &cacherules.Rules{
+		InternalRules: cacherules.InternalRules{NoReqExt: []string{".php"}},
+	})
+	h.cfg.Explain = &Explain{Header: "X-Debug", Secret: "s3cr3t"}
+
+	get := func(path string) http.Header {
+		req := httptest.NewRequest(http.MethodGet, "http://www.example.com"+path, nil)
+		req.Header.Set("X-Debug", "s3cr3t")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Header()
+	}
+
+	hdr := get("/explain")
+	if hdr.Get(headerExplainCache) != explainMISS || hdr.Get(headerExplainRule) != "default" {
+		t.Errorf("Invalid explain headers: %v", hdr)
+	}
+	if !strings.HasSuffix(hdr.Get(headerExplainKey), "|/explain|") || hdr.Get(headerExplainTTL) != "1h0m0s" {
+		t.Errorf("Invalid key or TTL: %v", hdr)
+	}
+
+	hdr = get("/explain")
+	if hdr.Get(headerExplainCache) != explainHIT || hdr.Get(headerExplainStorage) != explainStorageMem {
+		t.Errorf("Invalid explain headers: %v", hdr)
+	}
+	// The HITs report the remaining TTL
+	if ttl, err := time.ParseDuration(hdr.Get(headerExplainTTL)); err != nil || ttl < 59*time.Minute || ttl > time.Hour {
+		t.Errorf("Invalid remaining TTL: %v", hdr)
+	}
+
+	hdr = get("/index.php")
+	if hdr.Get(headerExplainCache) != explainBYPASS || hdr.Get(headerExplainRule) != "NoReqExt .php" {
+		t.Errorf("Invalid explain headers: %v", hdr)
+	}
+
+	w := doTestRequest(h, http.MethodGet, "http://www.example.com/explain")
+	if w.Header().Get(headerExplainCache) != "" {
+		t.Errorf("The explain headers should not be added without the secret")
+	}
+}
+
+func TestExplainWriter(t *testing.T) {
+	h := &Handler{cfg: &Config{Explain: &Explain{Header: "X-Debug", Secret: "s3cr3t"}}}
+	req := httptest.NewRequest(http.MethodGet, "http://www.example.com/", nil)
+	req.Header.Set("X-Debug", "s3cr3t")
+	rec := httptest.NewRecorder()
+
+	w, r := h.explain(rec, req)
+	explainFrom(r).setStatus(explainMISS)
+
+	// The streaming responses need the flush and the close notifications
+	f, ok := w.(http.Flusher)
+	if !ok {
+		t.Fatalf("The explain writer should be a http.Flusher")
+	}
+	if _, ok := w.(http.CloseNotifier); !ok {
+		t.Fatalf("The explain writer should be a http.CloseNotifier")
+	}
+	f.Flush()
+	if !rec.Flushed || rec.Header().Get(headerExplainCache) != explainMISS {
+		t.Errorf("The flush should write the explain headers: %v", rec.Header())
+	}
+}
+
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+	hijacked bool
+}
+
+func (w *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.hijacked = true
+	return nil, nil, nil
+}
+
+func TestExplainWriterHijack(t *testing.T) {
+	h := &Handler{cfg: &Config{Explain: &Explain{Header: "X-Debug", Secret: "s3cr3t"}}}
+	req := httptest.NewRequest(http.MethodGet, "http://www.example.com/", nil)
+	req.Header.Set("X-Debug", "s3cr3t")
+	rec := &hijackRecorder{ResponseRecorder: httptest.NewRecorder()}
+
+	// The upgrades like WebSocket hijack the connection
+	w, _ := h.explain(rec, req)
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		t.Fatalf("The explain writer should be a http.Hijacker")
+	}
+	if _, _, err := hj.Hijack(); err != nil || !rec.hijacked {
+		t.Errorf("The hijack should use the wrapped writer: %v", err)
+	}
+
+	req.Header.Set("X-Debug", "s3cr3t")
+	w, _ = h.explain(httptest.NewRecorder(), req)
+	if _, _, err := w.(http.Hijacker).Hijack(); err == nil {
+		t.Errorf("The hijack should fail if the wrapped writer don't support it")
+	}
+}
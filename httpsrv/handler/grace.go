@@ -0,0 +1,49 @@
+package handler
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gabrielperezs/elinproxy/httpsrv/cacherules"
+)
+
+const (
+	revalidatePrefix = "revalidate:"
+)
+
+// revalidate request to the backend in background a fresh copy of a stale
+// object. Only one request for each key is sent at the same time.
+func (handler *Handler) revalidate(key cacheKey, rule *cacherules.Rule, r *http.Request) {
+	req := r.Clone(context.Background())
+	// HEAD requests are served from the GET entries
+	req.Method = http.MethodGet
+	if r.GetBody != nil {
+		req.Body, _ = r.GetBody()
+	}
+
+	go handler.infligth.Do(revalidatePrefix+strconv.FormatUint(key.hash, 10), func() (interface{}, error) {
+		err := handler.reverseProxy(true, key, rule, req, &discardWriter{header: make(http.Header)})
+		if err != nil && handler.cfg.Debug {
+			log.Printf("httpsrv/handler/revalidate: %s://%s%s - %s", req.URL.Scheme, req.Host, req.URL.Path, err)
+		}
+		return nil, err
+	})
+}
+
+// discardWriter is the http.ResponseWriter of the background requests,
+// the response is stored in the cache but is not sent to any client
+type discardWriter struct {
+	header http.Header
+}
+
+func (w *discardWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (w *discardWriter) WriteHeader(int) {}
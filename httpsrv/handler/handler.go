@@ -18,18 +18,18 @@ import (
 	"sync/atomic"
 	"time"
 
-	"github.com/avct/uasurfer"
-
 	"golang.org/x/sync/singleflight"
 
 	"github.com/cespare/xxhash"
 
-	"github.com/didip/tollbooth"
 	"github.com/didip/tollbooth/limiter"
 	"github.com/gabrielperezs/elinproxy/lsm"
 
+	"github.com/gabrielperezs/elinproxy/httpsrv/backend"
 	"github.com/gabrielperezs/elinproxy/httpsrv/cacherules"
+	"github.com/gabrielperezs/elinproxy/httpsrv/cluster"
 	"github.com/gabrielperezs/elinproxy/httpsrv/httplog"
+	"github.com/gabrielperezs/elinproxy/httpsrv/purge"
 )
 
 const (
@@ -44,17 +44,9 @@ const (
 var (
 	errNotFoundInCache = errors.New("The requests wasn't save in the cache")
 	privateHeaders     = []string{
-		"Set-Cache",
 		"Proxy-Authenticate",
 		"WWW-Authenticate",
 	}
-	uaDeviceCleaner = []uasurfer.DeviceType{
-		uasurfer.DeviceUnknown,
-		uasurfer.DeviceComputer,
-		uasurfer.DeviceTablet,
-		uasurfer.DevicePhone,
-		uasurfer.DeviceConsole,
-	}
 )
 
 type Config struct {
@@ -65,6 +57,23 @@ type Config struct {
 	BackendOnce    bool
 	DomainSuffix   string
 
+	// Pool of backends, replace the BackendHost and BackendTLSHost
+	Pool *backend.PoolConfig
+	// Pools of backends for each host
+	Pools map[string]*backend.PoolConfig
+	// Origins of each host, the hosts can be wildcards like "*.example.com"
+	VHosts map[string]*VHost
+	// Routes by path of the hosts without vhost
+	Routes []Route
+	// Retries of the failed requests to other backend
+	Retry *Retry
+	// Parent caches requested before the origins on the misses
+	Parent *Parent
+	// Nodes that share the cache, each key is stored by one node
+	Cluster *cluster.Config
+	// Propagation of the purges, bans and tags to all the nodes
+	Purge *purge.Config
+
 	RateLimit int
 
 	ReqRemoveHeaders  []string
@@ -72,8 +81,15 @@ type Config struct {
 
 	CustomTags []string
 
+	// Encodings produced from the cached objects for the clients
+	// that accept them, like "br" or "zstd"
+	Encodings []string
+
 	CacheRules *cacherules.Rules
 
+	// Debug headers with the decisions of the cache
+	Explain *Explain
+
 	Cache *lsm.Config
 
 	Debug bool
@@ -88,6 +104,26 @@ type Handler struct {
 	limiter      *limiter.Limiter
 	cache        *lsm.LSM
 	infligth     *singleflight.Group
+	vhosts       atomic.Value
+	encodeJobs   chan *encodeJob
+
+	invalidations invalidations
+	purger        *purge.Purger
+	purgeCfg      purge.Config
+}
+
+// cacheKey is the hash used to store the items in the cache and a
+// second hash to detect the collisions of the first one
+type cacheKey struct {
+	hash  uint64
+	check uint64
+}
+
+func newCacheKey(keyStr string) cacheKey {
+	return cacheKey{
+		hash:  xxhash.Sum64String(keyStr),
+		check: lsm.KeyCheck(keyStr),
+	}
 }
 
 func New(cfg *Config) *Handler {
@@ -117,23 +153,41 @@ func New(cfg *Config) *Handler {
 	if handler.cfg.RateLimit == 0 {
 		handler.cfg.RateLimit = defaultRateLimit
 	}
-	handler.limiter = tollbooth.NewLimiter(float64(handler.cfg.RateLimit), &limiter.ExpirableOptions{
-		DefaultExpirationTTL: time.Hour,
-	})
-	handler.limiter.SetIPLookups([]string{"RemoteAddr"})
+	handler.limiter = newLimiter(handler.cfg.RateLimit)
 
 	*handler.rules = *cfg.CacheRules
 
 	handler.cache = lsm.New(cfg.Cache)
+	handler.setVHosts(cfg)
+	handler.setPurger(cfg)
+
+	if cfg.Explain != nil {
+		cfg.Explain.parse()
+	}
+	cfg.Encodings = parseEncodings(cfg.Encodings)
+	handler.startEncoders()
 
 	return handler
 }
 
 func (handler *Handler) Reload(cfg *Config) {
+	if cfg.Explain != nil {
+		cfg.Explain.parse()
+	}
+	cfg.Encodings = parseEncodings(cfg.Encodings)
+
+	// The config is applied only if its routing table is valid
+	if err := handler.setVHosts(cfg); err != nil {
+		log.Printf("httpsrv/handler/Reload ERROR the config is not applied: %s", err)
+		return
+	}
+
 	handler.mu.Lock()
 	*handler.cfg = *cfg
 	handler.mu.Unlock()
 
+	handler.setPurger(cfg)
+
 	handler.cache.Reload(handler.cfg.Cache)
 }
 
@@ -151,42 +205,57 @@ func (handler *Handler) customTags(w http.ResponseWriter) []string {
 }
 
 func (handler *Handler) ServeHTTP(orgW http.ResponseWriter, r *http.Request) {
+	orgW, r = handler.explain(orgW, r)
+	ex := explainFrom(r)
+	handler.parent().trustHops(r)
+
 	hlog := httplog.New(r, orgW, handler.customTags)
 	defer hlog.Done()
 
-	keyStr := hlog.GetKeyStr()
-	key := xxhash.Sum64String(keyStr)
-	isCachable, isRefreshable := handler.rules.IsReqCachable(r)
+	// The rules and the route of the path decide what to do with the
+	// request, the simulation of the rules use the same decision
+	decision := handler.rules.DecideRequest(r, hlog.Device, handler.vhosts.Load().(*vhosts).override)
+	keyReq, rule := decision.KeyReq, decision.Rule
+	isCachable, isRefreshable := decision.Cachable, decision.Refresh
+	ex.setRule(rule)
+	ex.addTrace(decision.Trace...)
 
-	if isCachable && handler.rules.Domain != nil {
-		// Use the rules for domains/hosts
-		if hostRule, ok := handler.rules.Domain[r.Host]; ok {
-			isCachable, isRefreshable = hostRule.IsReqCachable(r)
-		}
-	}
+	keyStr := decision.Key
+	key := newCacheKey(keyStr)
+	ex.setKey(keyStr)
 
 	if !isCachable {
+		ex.setStatus(explainBYPASS)
 		if isRefreshable {
-			for i := range uaDeviceCleaner {
-				handler.cache.Delete(xxhash.Sum64String(hlog.GetKeyStrDevice(i)))
-			}
+			ex.addTrace("refresh")
+			handler.purge(keyReq)
 		}
 
-		if err := handler.reverseProxy(isCachable, key, r, hlog); err != nil {
+		if err := handler.reverseProxy(isCachable, key, rule, r, hlog); err != nil {
 			hlog.RateLimit = true
 		}
 		return
 	}
 
 	// Find in the cache an wirte the respond
-	if handler.respondFromCache(key, hlog, r) {
+	ex.setStatus(explainMISS)
+	if handler.respondFromCache(key, rule, hlog, r) {
 		hlog.HIT = true
 		return
 	}
 
+	// The responses of the backend to HEAD requests don't have
+	// body, they are never stored in the cache
+	if r.Method == http.MethodHead {
+		if err := handler.reverseProxy(false, key, rule, r, hlog); err != nil {
+			hlog.RateLimit = true
+		}
+		return
+	}
+
 	// Go to the backend if the BackendOnce is false.
 	if !handler.cfg.BackendOnce {
-		if err := handler.reverseProxy(isCachable, key, r, hlog); err != nil {
+		if err := handler.reverseProxy(isCachable, key, rule, r, hlog); err != nil {
 			hlog.RateLimit = true
 		}
 		return
@@ -198,7 +267,7 @@ func (handler *Handler) ServeHTTP(orgW http.ResponseWriter, r *http.Request) {
 	var firstCall uint32
 	result := handler.infligth.DoChan(keyStr, func() (interface{}, error) {
 		atomic.AddUint32(&firstCall, 1)
-		if err := handler.reverseProxy(isCachable, key, r, hlog); err != nil {
+		if err := handler.reverseProxy(isCachable, key, rule, r, hlog); err != nil {
 			hlog.RateLimit = true
 			return nil, err
 		}
@@ -224,14 +293,14 @@ func (handler *Handler) ServeHTTP(orgW http.ResponseWriter, r *http.Request) {
 			return
 		}
 		// We try to response from the cache
-		if handler.respondFromCache(key, hlog, r) {
+		if handler.respondFromCache(key, rule, hlog, r) {
 			hlog.HIT = true
 			return
 		}
 		// the response from the infligth wasn't not store in the cache
 		// could be that is not cachable response so we send the current
 		// request to the backend
-		if err := handler.reverseProxy(isCachable, key, r, hlog); err != nil {
+		if err := handler.reverseProxy(isCachable, key, rule, r, hlog); err != nil {
 			hlog.RateLimit = true
 			return
 		}
@@ -267,12 +336,74 @@ func (handler *Handler) badGateway(code int, msg string, r *http.Request, w http
 	w.Write([]byte(msg))
 }
 
-func (handler *Handler) reverseProxy(isCachable bool, key uint64, r *http.Request, w http.ResponseWriter) error {
-	// Rate limit control to protect the backend
-	err := tollbooth.LimitByRequest(handler.limiter, w, r)
-	if err != nil {
-		handler.badGateway(err.StatusCode, err.Message, r, w)
-		return err
+func (handler *Handler) reverseProxy(isCachable bool, key cacheKey, rule *cacherules.Rule, r *http.Request, w http.ResponseWriter) error {
+	vh := handler.vhost(r)
+	rt := vh.route(r)
+	pool, transport := vh.upstream(rt)
+
+	// Rate limit control to protect the backend, the children and the
+	// peers send the requests of many clients
+	if !fromChild(r) {
+		if err := vh.limit(w, r); err != nil {
+			handler.badGateway(err.StatusCode, err.Message, r, w)
+			return err
+		}
+	}
+
+	// The misses go to the owner of the key in the cluster, or to
+	// the parent caches if they are healthy
+	var b *backend.Backend
+	var hop string
+	viaPeer := false
+	if isCachable {
+		if b = handler.owner(r, key); b != nil {
+			c := handler.cluster()
+			pool, transport, hop, viaPeer = c.Pool(), handler.roundTripper, c.Self(), true
+		} else if parent := handler.parent(); parent != nil {
+			if b = parent.next(r, key); b != nil {
+				pool, transport, hop = parent.pool, handler.roundTripper, parent.ID
+			}
+		}
+	}
+	viaCache := b != nil
+	if b == nil {
+		b = nextBackend(pool, r, key)
+	}
+	if b == nil {
+		// All the backends are down, the stale objects are better than an
+		// error. Only for the cachable requests, the others never use the cache.
+		if isCachable && handler.respondFromCache(key, rule, w, r) {
+			return nil
+		}
+		handler.badGateway(http.StatusBadGateway, "Backend error response", r, w)
+		return nil
+	}
+	b.Acquire()
+	defer b.Release()
+
+	// The retries can use other backends of the pool
+	var roundTripper http.RoundTripper = transport
+	last := func() *backend.Backend { return b }
+	if vh.retry != nil {
+		tries := newRetryTransport(vh.retry, transport, pool, b, key, r, handler.cfg.Debug)
+		defer tries.release()
+		roundTripper, last = tries, tries.last
+	}
+	// The log show the backend of the last try
+	logBackend := func() {
+		if hl, ok := w.(*httplog.HTTPLog); ok {
+			hl.BackendIP = last().Host
+		}
+	}
+	start := time.Now()
+	// The result of the last try is reported once, the ErrorHandler is
+	// called after the ModifyResponse if it fails
+	reported := false
+	report := func(ok bool) {
+		if !reported {
+			reported = true
+			last().Report(ok, time.Since(start))
+		}
 	}
 
 	// Do the request in the backend
@@ -282,6 +413,12 @@ func (handler *Handler) reverseProxy(isCachable bool, key uint64, r *http.Reques
 	revproxy := httputil.ReverseProxy{
 		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
 			req.Close = true
+			logBackend()
+			// The errors of the client are not errors of the backend,
+			// the timeouts of the tries are
+			if req.Context().Err() == nil {
+				report(false)
+			}
 
 			if handler.cfg.Debug {
 				if req == nil {
@@ -301,6 +438,12 @@ func (handler *Handler) reverseProxy(isCachable bool, key uint64, r *http.Reques
 				}
 			}
 
+			// The stale objects are better than an error, only for the
+			// cachable requests
+			if w != nil && isCachable && handler.respondFromCache(key, rule, w, r) {
+				return
+			}
+
 			if w != nil {
 				w.WriteHeader(http.StatusBadGateway)
 				w.Write([]byte("Backend error response"))
@@ -311,30 +454,90 @@ func (handler *Handler) reverseProxy(isCachable bool, key uint64, r *http.Reques
 			}
 		},
 		Director: func(req *http.Request) {
-			handler.buildBackendURL(req)
+			// The token of the cluster is only sent to the peers
+			req.Header.Del(cluster.TokenHeader)
+			if viaPeer {
+				req.Header.Set(cluster.TokenHeader, handler.cluster().Token())
+			}
+			if viaCache {
+				forwardRequest(req, b, hop)
+			} else {
+				req.Header.Del(headerHops)
+				if rt != nil {
+					rt.rewrite(req)
+				}
+				handler.buildBackendURL(req, b, vh.Scheme)
+				vh.modifyRequest(req)
+			}
 			if !isCachable {
 				return
 			}
 			handler.modifyRequest(key, req, r)
 		},
 		ModifyResponse: func(resp *http.Response) error {
-			if handler.cfg.Cache == nil || !isCachable {
+			report(resp.StatusCode < http.StatusInternalServerError)
+			logBackend()
+			vh.modifyResponse(resp)
+
+			// Added after store the response in the cache
+			defer func() {
+				// The TTL headers are only sent to the children
+				if !fromChild(r) {
+					delTTLHeaders(resp.Header)
+				}
+				addProxyHeaders(resp.Header, xCacheMISS)
+			}()
+			if !viaCache {
+				delTTLHeaders(resp.Header)
+			}
+
+			if !isCachable {
+				handler.invalidateUnsafe(r, resp)
 				return nil
 			}
-			ttl, ok := handler.rules.IsRespCachable(resp)
-			if !ok {
+			if handler.cfg.Cache == nil {
 				return nil
 			}
-			return handler.modifyResponse(key, resp, ttl)
+			ex := explainFrom(r)
+			rd := handler.rules.DecideResponse(r, rule, resp)
+			ex.addTrace(rd.Trace...)
+			ttl, grace, ok := rd.TTL, rd.Grace, rd.Cachable
+			// The object is stored only the remaining time in the parent
+			if pTTL, pGrace, found := parentTTL(resp.Header, time.Now()); ok && viaCache && found {
+				ttl, grace, ok = pTTL, pGrace, pTTL+pGrace > 0
+				ex.addTrace("parent TTL")
+			}
+			// The objects of the peers are only stored as hot copies
+			if hot := handler.cluster().HotCache(); ok && viaPeer {
+				ok = hot > 0
+				ttl, grace = minDuration(ttl, hot), minDuration(grace, hot)
+				ex.addTrace("peer")
+			}
+			// The response and the stored object are negotiated
+			if handler.negotiated(resp.Header) {
+				addVaryEncoding(resp.Header)
+			}
+			if ok {
+				ex.setTTL(ttl)
+				if err := handler.modifyResponse(key, r, resp, ttl, grace); err != nil {
+					return err
+				}
+				handler.rules.RewriteCacheControl(rule, r.Host, resp.Header)
+			}
+			// The request to the backend always accept gzip
+			if enc := contentEncoding(resp.Header); !acceptsEncoding(acceptEncoding(r.Header), enc) {
+				return decodeResponse(resp, enc)
+			}
+			return nil
 		},
-		Transport:  handler.roundTripper,
+		Transport:  roundTripper,
 		BufferPool: handler.bytesPool,
 	}
 	revproxy.ServeHTTP(w, outReq)
 	return nil
 }
 
-func (handler *Handler) modifyRequest(key uint64, req, origReq *http.Request) {
+func (handler *Handler) modifyRequest(key cacheKey, req, origReq *http.Request) {
 	for _, v := range handler.cfg.ReqRemoveHeaders {
 		req.Header.Del(v)
 	}
@@ -342,7 +545,40 @@ func (handler *Handler) modifyRequest(key uint64, req, origReq *http.Request) {
 	req.Header.Del("Range")
 }
 
-func (handler *Handler) modifyResponse(key uint64, resp *http.Response, ttl time.Duration) error {
+func (handler *Handler) modifyResponse(key cacheKey, origReq *http.Request, resp *http.Response, ttl, grace time.Duration) error {
+	// The children of the parent tier store the object the same time
+	setTTLHeaders(resp.Header, time.Now(), ttl, grace)
+
+	// The object is stored during the grace period after the TTL,
+	// but it will be served as stale
+	var staleAt int64
+	if grace > 0 {
+		staleAt = time.Now().Add(ttl).UnixNano()
+		ttl += grace
+	}
+	// The expired bans and tags can't remove the object
+	if max := handler.maxTTL(); max > 0 && ttl > max {
+		ttl = max
+	}
+
+	// The responses with Vary are stored in a different key for each
+	// combination of values of the request headers
+	vary, err := lsm.ParseVary(resp.Header["Vary"])
+	if err != nil {
+		return nil
+	}
+	// The content encoding is negotiated by the proxy with each client
+	vary = removeHeader(vary, headerAcceptEncoding)
+
+	base := key.hash
+	hash, err := handler.cache.SetVariant(base, vary, origReq.Header, ttl)
+	if err != nil {
+		if handler.cfg.Debug {
+			log.Printf("httpsrv/handler/modifyResponse SetVariant: %s - %s", origReq.RequestURI, err)
+		}
+		return nil
+	}
+
 	for _, v := range privateHeaders {
 		resp.Header.Del(v)
 	}
@@ -369,11 +605,16 @@ func (handler *Handler) modifyResponse(key uint64, resp *http.Response, ttl time
 	}
 
 	item := handler.cache.NewItem(length)
-	item.Key = key
+	item.Key = hash
+	item.Check = key.check
 	item.StatusCode = resp.StatusCode
+	item.StaleAt = staleAt
+	item.FetchedAt = time.Now().UnixNano()
 	for k, v := range resp.Header {
 		item.Header[k] = append(item.Header[k], v...)
 	}
+	// The cookies are sent to the client but never stored
+	item.Header.Del("Set-Cookie")
 
 	if err := DumpResponse(resp, true, item); err != nil {
 		if handler.cfg.Debug {
@@ -382,17 +623,25 @@ func (handler *Handler) modifyResponse(key uint64, resp *http.Response, ttl time
 		return err
 	}
 
-	handler.cache.Set(key, item, ttl)
+	handler.cache.Set(hash, item, ttl)
+	handler.storeEncodings(base, hash, item, ttl)
 	return nil
 }
 
-func (handler *Handler) buildBackendURL(req *http.Request) {
-	var uri string
-	if (req.TLS != nil || req.Header.Get("X-Forwarded-Protocol") == "https") && handler.cfg.BackendTLSHost != "" {
-		uri = fmt.Sprintf("https://%s:%s%s", handler.cfg.BackendTLSHost, handler.cfg.BackendTLSPort, req.URL.Path)
-	} else {
-		uri = fmt.Sprintf("http://%s:%s%s", handler.cfg.BackendHost, handler.cfg.BackendPort, req.URL.Path)
+func removeHeader(headers []string, name string) []string {
+	for i, h := range headers {
+		if h == name {
+			return append(headers[:i:i], headers[i+1:]...)
+		}
+	}
+	return headers
+}
+
+func (handler *Handler) buildBackendURL(req *http.Request, b *backend.Backend, scheme string) {
+	if scheme == "" {
+		scheme = b.Scheme
 	}
+	uri := fmt.Sprintf("%s://%s%s", scheme, b.Address(), req.URL.Path)
 
 	if req.URL.RawQuery != "" {
 		uri += "?" + req.URL.RawQuery
@@ -409,8 +658,8 @@ func (handler *Handler) buildBackendURL(req *http.Request) {
 	}
 }
 
-func (handler *Handler) respondFromCache(key uint64, w http.ResponseWriter, r *http.Request) bool {
-	item, ok, err := handler.cache.Get(key)
+func (handler *Handler) respondFromCache(key cacheKey, rule *cacherules.Rule, w http.ResponseWriter, r *http.Request) bool {
+	item, ok, err := handler.cachedItem(handler.cache.VariantKey(key.hash, r.Header), key.check, r)
 	if err != nil {
 		return false
 	}
@@ -422,6 +671,31 @@ func (handler *Handler) respondFromCache(key uint64, w http.ResponseWriter, r *h
 		return false
 	}
 
+	// The private responses are never served to requests with Authorization
+	if !cacherules.SharedResponse(r, headers) {
+		return false
+	}
+
+	// The bans and the tags are applied when the objects are requested
+	if handler.invalidated(r, headers, item.GetFetchedAt()) {
+		handler.cache.Delete(key.hash)
+		return false
+	}
+
+	ex := explainFrom(r)
+	ex.setStatus(explainHIT)
+	ex.setItem(item)
+	if ttl, _, found := parentTTL(headers, time.Now()); found {
+		ex.setTTL(ttl.Round(time.Second))
+	}
+
+	// The stale object is served while a fresh copy is
+	// requested to the backend
+	if item.Stale() {
+		ex.setStatus(explainSTALE)
+		handler.revalidate(key, rule, r)
+	}
+
 	// Prevent CLOSE_WAIT leak, origin close connection
 	cancel := handler.closeNotify(w, r)
 	defer cancel()
@@ -434,8 +708,36 @@ func (handler *Handler) respondFromCache(key uint64, w http.ResponseWriter, r *h
 		w.Header().Set(k, strings.Join(v, ", "))
 	}
 	w.Header().Set("Accept-Ranges", "none")
-	w.Header().Set("Server", "elinproxy")
-	w.Header().Set("Age", strconv.FormatUint(item.GetHIT(), 10))
+	if !fromChild(r) {
+		delTTLHeaders(w.Header())
+	}
+	setAgeHeaders(w.Header(), item)
+	handler.rules.RewriteCacheControl(rule, r.Host, w.Header())
+	addProxyHeaders(w.Header(), xCacheHIT)
+
+	// The client don't accept the encoding of the cached object
+	enc := contentEncoding(headers)
+	decode := !acceptsEncoding(acceptEncoding(r.Header), enc)
+	if decode {
+		setEncodingHeaders(w.Header(), encodingIdentity)
+	}
+
+	// HEAD only needs the headers, the body is not read
+	if r.Method == http.MethodHead {
+		if !decode {
+			w.Header().Set("Content-Length", strconv.Itoa(item.Len()))
+		}
+		w.WriteHeader(item.GetStatusCode())
+		return true
+	}
+
+	if decode {
+		w.WriteHeader(item.GetStatusCode())
+		if err := writeDecoded(w, item, enc); err != nil && handler.cfg.Debug {
+			log.Printf("httpsrv/handler/respondFromCache decode %s: %s", enc, err)
+		}
+		return true
+	}
 
 	var httpRange []httpRange
 	rangeHeader := r.Header.Get("Range")
@@ -497,5 +799,13 @@ func (handler *Handler) closeNotify(w http.ResponseWriter, r *http.Request) cont
 	}
 	r.Body.Close()
 
+	// The body of the cachable POST requests is kept in memory, it
+	// could be sent later to the backend
+	if r.GetBody != nil {
+		if body, err := r.GetBody(); err == nil {
+			r.Body = body
+		}
+	}
+
 	return cancel
 }
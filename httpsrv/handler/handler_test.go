@@ -0,0 +1,365 @@
+package handler
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gabrielperezs/elinproxy/httpsrv/cacherules"
+	"github.com/gabrielperezs/elinproxy/lsm"
+)
+
+func newTestHandler(t *testing.T, origin *httptest.Server, rules *cacherules.Rules) *Handler {
+	u, _ := url.Parse(origin.URL)
+	host, port, _ := net.SplitHostPort(u.Host)
+
+	dir, err := ioutil.TempDir("", "elinproxy-handler-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	if rules == nil {
+		rules = &cacherules.Rules{}
+	}
+	if err := rules.Parse(); err != nil {
+		t.Fatal(err)
+	}
+
+	return New(&Config{
+		BackendHost: host,
+		BackendPort: port,
+		RateLimit:   1000,
+		CacheRules:  rules,
+		Cache: &lsm.Config{
+			Dir:       dir,
+			MinLSMTTL: 24 * time.Hour,
+		},
+	})
+}
+
+func doTestRequest(h http.Handler, method, target string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestHandlerHeadFromCachedGet(t *testing.T) {
+	var gets, heads int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			atomic.AddInt32(&heads, 1)
+		} else {
+			atomic.AddInt32(&gets, 1)
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("hello world"))
+	}))
+	defer origin.Close()
+
+	h := newTestHandler(t, origin, nil)
+
+	// HEAD miss goes to the backend and is not stored
+	w := doTestRequest(h, http.MethodHead, "http://www.example.com/head")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Invalid status: %d", w.Code)
+	}
+	w = doTestRequest(h, http.MethodGet, "http://www.example.com/head")
+	if w.Body.String() != "hello world" {
+		t.Fatalf("The GET should not be filled from the HEAD: %q", w.Body.String())
+	}
+	if atomic.LoadInt32(&heads) != 1 || atomic.LoadInt32(&gets) != 1 {
+		t.Errorf("Invalid backend requests: HEAD %d GET %d", heads, gets)
+	}
+
+	// HEAD hit is served from the GET entry
+	w = doTestRequest(h, http.MethodHead, "http://www.example.com/head")
+	if w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Errorf("Invalid HEAD response: %d %q", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Content-Length") != "11" {
+		t.Errorf("Invalid Content-Length: %s", w.Header().Get("Content-Length"))
+	}
+	if atomic.LoadInt32(&heads) != 1 {
+		t.Errorf("The HEAD should be served from the cache: %d", heads)
+	}
+}
+
+func TestHandlerCachePost(t *testing.T) {
+	var calls int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		b, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	}))
+	defer origin.Close()
+
+	h := newTestHandler(t, origin, &cacherules.Rules{
+		InternalRules: cacherules.InternalRules{
+			CachePOST: []cacherules.PostRule{{PathPrefix: "/graphql"}},
+		},
+	})
+
+	post := func(body string) string {
+		req := httptest.NewRequest(http.MethodPost, "http://www.example.com/graphql", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Body.String()
+	}
+
+	for i := 0; i < 2; i++ {
+		if b := post(`{"query":"a"}`); b != `{"query":"a"}` {
+			t.Errorf("Invalid response: %s", b)
+		}
+	}
+	if b := post(`{"query":"b"}`); b != `{"query":"b"}` {
+		t.Errorf("Invalid response: %s", b)
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("Expected 2 requests to the backend: %d", n)
+	}
+}
+
+func TestHandlerInvalidateOnUnsafe(t *testing.T) {
+	var calls int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if r.Method == http.MethodPost {
+			w.Header().Set("Location", "/items/2")
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer origin.Close()
+
+	h := newTestHandler(t, origin, nil)
+
+	for _, u := range []string{"/items/1", "/items/2", "/items/1", "/items/2"} {
+		doTestRequest(h, http.MethodGet, "http://www.example.com"+u)
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Fatalf("Expected 2 requests to the backend: %d", n)
+	}
+
+	w := doTestRequest(h, http.MethodPost, "http://www.example.com/items/1")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Invalid status: %d", w.Code)
+	}
+
+	for _, u := range []string{"/items/1", "/items/2"} {
+		doTestRequest(h, http.MethodGet, "http://www.example.com"+u)
+	}
+	if n := atomic.LoadInt32(&calls); n != 5 {
+		t.Errorf("The URL and the Location should be invalidated: %d", n)
+	}
+}
+
+func TestHandlerInvalidateOnUnsafeSchemes(t *testing.T) {
+	var calls int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer origin.Close()
+
+	h := newTestHandler(t, origin, &cacherules.Rules{
+		InternalRules: cacherules.InternalRules{
+			CacheKey: []string{"scheme", "host", "path"},
+		},
+	})
+
+	doTestRequest(h, http.MethodGet, "https://www.example.com/items/1")
+	doTestRequest(h, http.MethodGet, "https://www.example.com/items/1")
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("Expected 1 request to the backend: %d", n)
+	}
+
+	// The POST over http invalidate the copy stored over https
+	doTestRequest(h, http.MethodPost, "http://www.example.com/items/1")
+	doTestRequest(h, http.MethodGet, "https://www.example.com/items/1")
+	if n := atomic.LoadInt32(&calls); n != 3 {
+		t.Errorf("The https copy should be invalidated: %d", n)
+	}
+}
+
+func TestHandlerGrace(t *testing.T) {
+	var calls int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("v" + strconv.Itoa(int(n))))
+	}))
+	defer origin.Close()
+
+	h := newTestHandler(t, origin, &cacherules.Rules{
+		Rule: []cacherules.Rule{{Path: "/grace", TTL: "1s", Grace: "1m"}},
+	})
+
+	if b := doTestRequest(h, http.MethodGet, "http://www.example.com/grace").Body.String(); b != "v1" {
+		t.Fatalf("Invalid response: %s", b)
+	}
+	time.Sleep(1100 * time.Millisecond)
+
+	// The stale object is served and updated in background
+	if b := doTestRequest(h, http.MethodGet, "http://www.example.com/grace").Body.String(); b != "v1" {
+		t.Fatalf("The stale object should be served: %s", b)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		b := doTestRequest(h, http.MethodGet, "http://www.example.com/grace").Body.String()
+		if b == "v2" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("The object was not updated: %s", b)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("Expected 2 requests to the backend: %d", n)
+	}
+}
+
+func TestHandlerAuthorization(t *testing.T) {
+	var calls int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if r.URL.Path == "/public" {
+			w.Header().Set("Cache-Control", "public, max-age=60")
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(r.Header.Get("Authorization")))
+	}))
+	defer origin.Close()
+
+	h := newTestHandler(t, origin, nil)
+
+	get := func(path, auth string) string {
+		req := httptest.NewRequest(http.MethodGet, "http://www.example.com"+path, nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Body.String()
+	}
+
+	// The private responses are not stored neither served
+	if b := get("/private", "user1"); b != "user1" {
+		t.Errorf("Invalid response: %s", b)
+	}
+	if b := get("/private", "user2"); b != "user2" {
+		t.Errorf("The private response was shared: %s", b)
+	}
+	get("/private", "")
+	if b := get("/private", "user3"); b != "user3" {
+		t.Errorf("The anonymous response was served to an authorized request: %s", b)
+	}
+	if n := atomic.LoadInt32(&calls); n != 4 {
+		t.Errorf("Expected 4 requests to the backend: %d", n)
+	}
+
+	// The public responses are shared
+	get("/public", "user1")
+	if b := get("/public", "user2"); b != "user1" {
+		t.Errorf("The public response should be shared: %s", b)
+	}
+	if n := atomic.LoadInt32(&calls); n != 5 {
+		t.Errorf("Expected 5 requests to the backend: %d", n)
+	}
+}
+
+func TestHandlerSetCookie(t *testing.T) {
+	var calls int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: r.URL.Path})
+		w.Header().Set("WWW-Authenticate", "Basic")
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("hello"))
+	}))
+	defer origin.Close()
+
+	h := newTestHandler(t, origin, &cacherules.Rules{
+		Rule: []cacherules.Rule{
+			{Path: "/strip", SetCookie: cacherules.SetCookieStrip},
+			{Path: "/noreplay", SetCookie: cacherules.SetCookieNoReplay},
+		},
+	})
+
+	tests := []struct {
+		path   string
+		cookie []bool
+		calls  int32
+	}{
+		{"/nocache", []bool{true, true}, 2},
+		{"/strip", []bool{false, false}, 1},
+		{"/noreplay", []bool{true, false}, 1},
+	}
+	for _, v := range tests {
+		atomic.StoreInt32(&calls, 0)
+		for i, cookie := range v.cookie {
+			w := doTestRequest(h, http.MethodGet, "http://www.example.com"+v.path)
+			if (w.Header().Get("Set-Cookie") != "") != cookie {
+				t.Errorf("%s request %d Set-Cookie should be %v", v.path, i, cookie)
+			}
+			// The private headers are removed from the cachable responses
+			if cachable := v.calls == 1; cachable && w.Header().Get("WWW-Authenticate") != "" {
+				t.Errorf("%s request %d WWW-Authenticate should be removed", v.path, i)
+			}
+		}
+		if n := atomic.LoadInt32(&calls); n != v.calls {
+			t.Errorf("%s expected %d requests to the backend: %d", v.path, v.calls, n)
+		}
+	}
+}
+
+func TestHandlerProxyHeaders(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Age", "5")
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("hello"))
+	}))
+	defer origin.Close()
+
+	h := newTestHandler(t, origin, &cacherules.Rules{
+		InternalRules: cacherules.InternalRules{BrowserTTL: "1m"},
+	})
+
+	w := doTestRequest(h, http.MethodGet, "http://www.example.com/headers")
+	if w.Header().Get("X-Cache") != "MISS" || w.Header().Get("Via") != "1.1 elinproxy" {
+		t.Errorf("Invalid proxy headers: %v", w.Header())
+	}
+	if w.Header().Get("Cache-Control") != "public, max-age=60" {
+		t.Errorf("Invalid Cache-Control: %s", w.Header().Get("Cache-Control"))
+	}
+
+	w = doTestRequest(h, http.MethodGet, "http://www.example.com/headers")
+	if w.Header().Get("X-Cache") != "HIT" || w.Header().Get("Via") != "1.1 elinproxy" {
+		t.Errorf("Invalid proxy headers: %v", w.Header())
+	}
+	if age, _ := strconv.Atoi(w.Header().Get("Age")); age < 5 || age > 6 {
+		t.Errorf("Invalid Age: %s", w.Header().Get("Age"))
+	}
+	if w.Header().Get("Date") == "" {
+		t.Errorf("The Date should be defined")
+	}
+	if w.Header().Get("Cache-Control") != "public, max-age=60" {
+		t.Errorf("Invalid Cache-Control: %s", w.Header().Get("Cache-Control"))
+	}
+}
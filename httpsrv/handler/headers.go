@@ -0,0 +1,51 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gabrielperezs/elinproxy/lsm"
+)
+
+const (
+	headerAge    = "Age"
+	headerDate   = "Date"
+	headerVia    = "Via"
+	headerXCache = "X-Cache"
+
+	viaValue = "1.1 elinproxy"
+
+	xCacheHIT  = "HIT"
+	xCacheMISS = "MISS"
+)
+
+// addProxyHeaders add to the response the Via and X-Cache headers
+func addProxyHeaders(h http.Header, xCache string) {
+	h.Add(headerVia, viaValue)
+	h.Set(headerXCache, xCache)
+}
+
+// setAgeHeaders set the Age of the cached item, the time since it was
+// received from the backend plus the Age sent by the backend, RFC 7234, 4.2.3
+func setAgeHeaders(h http.Header, item lsm.Item) {
+	fetched := item.GetFetchedAt()
+	if fetched.UnixNano() <= 0 {
+		h.Del(headerAge)
+		return
+	}
+
+	age, _ := strconv.Atoi(h.Get(headerAge))
+	if age < 0 {
+		age = 0
+	}
+	if since := time.Since(fetched); since > 0 {
+		age += int(since / time.Second)
+	}
+	h.Set(headerAge, strconv.Itoa(age))
+
+	// The Date of the backend is kept, RFC 7231, 7.1.1.2
+	if h.Get(headerDate) == "" {
+		h.Set(headerDate, fetched.UTC().Format(http.TimeFormat))
+	}
+}
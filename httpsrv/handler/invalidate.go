@@ -0,0 +1,69 @@
+package handler
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/cespare/xxhash"
+)
+
+var (
+	unsafeMethods = map[string]bool{
+		http.MethodPost:   true,
+		http.MethodPut:    true,
+		http.MethodPatch:  true,
+		http.MethodDelete: true,
+	}
+	invalidateHeaders = []string{
+		"Location",
+		"Content-Location",
+	}
+)
+
+// purge remove from the cache the key of the request for all the schemes
+// and devices
+func (handler *Handler) purge(keyReq *http.Request) {
+	for _, key := range handler.rules.PurgeKeys(keyReq, handler.rules.Match(keyReq)) {
+		handler.cache.Delete(xxhash.Sum64String(key))
+	}
+}
+
+// invalidate remove from the cache the GET requests to the URL
+func (handler *Handler) invalidate(r *http.Request, u *url.URL) {
+	req := r.WithContext(r.Context())
+	req.Method = http.MethodGet
+	req.URL = u
+	keyReq, _ := handler.rules.NormalizeRequest(req)
+	handler.purge(keyReq)
+}
+
+// invalidateUnsafe remove from the cache the URL of the request and the
+// Location and Content-Location targets after a successful response to
+// an unsafe method, RFC 7234, 4.4
+func (handler *Handler) invalidateUnsafe(r *http.Request, resp *http.Response) {
+	if !unsafeMethods[r.Method] || resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return
+	}
+	if !handler.rules.InvalidateUnsafe(r.Host) {
+		return
+	}
+
+	handler.invalidate(r, r.URL)
+	for _, h := range invalidateHeaders {
+		v := resp.Header.Get(h)
+		if v == "" {
+			continue
+		}
+		u, err := r.URL.Parse(v)
+		if err != nil {
+			continue
+		}
+		// Only the URLs of the same host can be invalidated
+		if u.Host != "" && !strings.EqualFold(u.Host, r.Host) {
+			continue
+		}
+		u.Scheme, u.Host = "", ""
+		handler.invalidate(r, u)
+	}
+}
@@ -0,0 +1,219 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gabrielperezs/elinproxy/httpsrv/backend"
+)
+
+const (
+	parentPoolName     = "parent"
+	defaultParentHops  = 2
+	headerHops         = "X-Elinproxy-Hops"
+	headerFreshUntil   = "X-Elinproxy-Fresh-Until"
+	headerGraceUntil   = "X-Elinproxy-Grace-Until"
+	parentHopSeparator = ","
+)
+
+var (
+	errInvalidChild = errors.New("Invalid IP or network of the parent children")
+)
+
+// Parent is the cache tier (origin shield) between this node and the
+// origins. The misses are requested to the parents, and to the origins
+// if all the parents are unhealthy.
+type Parent struct {
+	// The nodes without parents, only with children, don't define the pool
+	Pool *backend.PoolConfig
+	// Name of the node in the loop detection header, the hostname by default
+	ID string
+	// Maximum number of caches that a request can cross, 2 by default
+	MaxHops int
+	// IPs or networks of the children of this node. The loop detection
+	// header is removed from the requests of other clients and the
+	// children are not rate limited, they send the requests of many clients.
+	Children []string
+
+	pool     *backend.Pool
+	children []*net.IPNet
+}
+
+func newParent(cfg *Parent, ru *reuse) (*Parent, error) {
+	p := *cfg
+	if p.ID == "" {
+		p.ID, _ = os.Hostname()
+	}
+	if p.MaxHops <= 0 {
+		p.MaxHops = defaultParentHops
+	}
+
+	var err error
+	if p.children, err = parseNetworks(p.Children); err != nil {
+		return nil, err
+	}
+	if p.Pool != nil {
+		if p.pool, err = ru.pool(parentPoolName, p.Pool); err != nil {
+			return nil, err
+		}
+	}
+	return &p, nil
+}
+
+// parseNetworks read a list of IPs or networks in CIDR notation
+func parseNetworks(list []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(list))
+	for _, v := range list {
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("%w: %s", errInvalidChild, v)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", errInvalidChild, v)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// child return true if the client of the request is a child of this node
+func (p *Parent) child(r *http.Request) bool {
+	if p == nil || len(p.children) == 0 {
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range p.children {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// trustHops remove the loop detection header if the request was not
+// sent by a child or a peer, the clients can't skip the parents with it
+// or receive the TTL headers
+func (p *Parent) trustHops(r *http.Request) {
+	if fromPeer(r) || p.child(r) {
+		return
+	}
+	r.Header.Del(headerHops)
+}
+
+func hops(r *http.Request) []string {
+	v := r.Header.Get(headerHops)
+	if v == "" {
+		return nil
+	}
+	return strings.Split(v, parentHopSeparator)
+}
+
+// fromChild return true if the request was sent by other elinproxy, the
+// loop detection header is only kept for the children and the peers
+func fromChild(r *http.Request) bool {
+	return r.Header.Get(headerHops) != "" || fromPeer(r)
+}
+
+// forward return true if the request can be sent to the parents without
+// create a loop
+func (p *Parent) forward(r *http.Request) bool {
+	if p == nil {
+		return false
+	}
+	hs := hops(r)
+	if len(hs) >= p.MaxHops {
+		return false
+	}
+	for _, h := range hs {
+		if strings.TrimSpace(h) == p.ID {
+			return false
+		}
+	}
+	return true
+}
+
+// next return the parent for the request, nil if all the parents are unhealthy
+func (p *Parent) next(r *http.Request, key cacheKey) *backend.Backend {
+	if p.pool == nil || !p.forward(r) {
+		return nil
+	}
+	return nextBackend(p.pool, r, key)
+}
+
+// forwardRequest send the request to other elinproxy, a parent or a
+// peer, with the original Host and scheme so it apply the vhosts, the
+// routes and the keys of the request
+func forwardRequest(req *http.Request, b *backend.Backend, id string) {
+	if req.TLS != nil {
+		req.Header.Set("X-Forwarded-Protocol", "https")
+	}
+	uri := fmt.Sprintf("%s://%s%s", b.Scheme, b.Address(), req.URL.EscapedPath())
+	if req.URL.RawQuery != "" {
+		uri += "?" + req.URL.RawQuery
+	}
+	req.URL, _ = url.ParseRequestURI(uri)
+
+	hs := append(hops(req), id)
+	req.Header.Set(headerHops, strings.Join(hs, parentHopSeparator))
+}
+
+// setTTLHeaders add to the response the time until the object is fresh
+// and until the end of the grace, so the children store the object
+// only the remaining time
+func setTTLHeaders(h http.Header, now time.Time, ttl, grace time.Duration) {
+	fresh := now.Add(ttl)
+	h.Set(headerFreshUntil, strconv.FormatInt(fresh.Unix(), 10))
+	h.Set(headerGraceUntil, strconv.FormatInt(fresh.Add(grace).Unix(), 10))
+}
+
+// delTTLHeaders remove the TTL headers, they are only sent to the children
+func delTTLHeaders(h http.Header) {
+	h.Del(headerFreshUntil)
+	h.Del(headerGraceUntil)
+}
+
+// parentTTL return the remaining TTL and grace of the object in the
+// parent, false if the parent didn't send them
+func parentTTL(h http.Header, now time.Time) (ttl, grace time.Duration, ok bool) {
+	fresh, err := strconv.ParseInt(h.Get(headerFreshUntil), 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	until, err := strconv.ParseInt(h.Get(headerGraceUntil), 10, 64)
+	if err != nil || until < fresh {
+		until = fresh
+	}
+
+	freshAt, graceAt := time.Unix(fresh, 0), time.Unix(until, 0)
+	if freshAt.After(now) {
+		ttl = freshAt.Sub(now)
+		grace = graceAt.Sub(freshAt)
+	} else if graceAt.After(now) {
+		// The object is stale in the parent
+		grace = graceAt.Sub(now)
+	}
+	return ttl, grace, true
+}
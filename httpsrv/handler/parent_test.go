@@ -0,0 +1,252 @@
+package handler
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gabrielperezs/elinproxy/httpsrv/backend"
+	"github.com/gabrielperezs/elinproxy/httpsrv/cacherules"
+)
+
+func testBackendConfig(s *httptest.Server) backend.Config {
+	u, _ := url.Parse(s.URL)
+	host, port, _ := net.SplitHostPort(u.Host)
+	return backend.Config{Host: host, Port: port}
+}
+
+func TestParentForward(t *testing.T) {
+	p := &Parent{ID: "edge1", MaxHops: 2}
+
+	tests := []struct {
+		hops    string
+		forward bool
+	}{
+		{"", true},
+		{"edge2", true},
+		{"edge2,edge1", false},
+		{"edge1", false},
+		{"edge2,edge3", false},
+	}
+	for _, v := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://www.example.com/", nil)
+		if v.hops != "" {
+			req.Header.Set(headerHops, v.hops)
+		}
+		if ok := p.forward(req); ok != v.forward {
+			t.Errorf("Hops %q forward should be %v", v.hops, v.forward)
+		}
+	}
+
+	var nilParent *Parent
+	if nilParent.forward(httptest.NewRequest(http.MethodGet, "http://www.example.com/", nil)) {
+		t.Errorf("The requests are never forwarded without parent")
+	}
+}
+
+func TestParentTrustHops(t *testing.T) {
+	p, err := newParent(&Parent{Children: []string{"10.0.0.1", "192.168.0.0/16", "2001:db8::/32"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		remoteAddr string
+		trusted    bool
+	}{
+		{"10.0.0.1:1234", true},
+		{"10.0.0.2:1234", false},
+		{"192.168.1.1:80", true},
+		{"[2001:db8::1]:80", true},
+		{"[2001:db9::1]:80", false},
+		{"invalid", false},
+	}
+	for _, v := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://www.example.com/", nil)
+		req.RemoteAddr = v.remoteAddr
+		req.Header.Set(headerHops, "edge")
+		p.trustHops(req)
+		if fromChild(req) != v.trusted {
+			t.Errorf("%s: the hops header should be trusted %v", v.remoteAddr, v.trusted)
+		}
+	}
+
+	if _, err := newParent(&Parent{Children: []string{"10.0.0"}}, nil); !errors.Is(err, errInvalidChild) {
+		t.Errorf("Expected errInvalidChild: %v", err)
+	}
+}
+
+func TestHandlerParentChildren(t *testing.T) {
+	origin, _ := newTestOrigin("origin")
+	defer origin.Close()
+
+	h := newTestHandler(t, origin, nil)
+	h.cfg.Parent = &Parent{Children: []string{"10.0.0.1"}}
+	h.cfg.VHosts = map[string]*VHost{"www.example.com": {RateLimit: 1}}
+	h.Reload(h.cfg)
+
+	post := func(remoteAddr string) int {
+		req := httptest.NewRequest(http.MethodPost, "http://www.example.com/children", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set(headerHops, "edge")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// The child send the requests of many clients
+	for i := 0; i < 3; i++ {
+		if code := post("10.0.0.1:1234"); code != http.StatusOK {
+			t.Fatalf("The child should not be rate limited: %d", code)
+		}
+	}
+	// Other clients can't skip the rate limit with the header
+	post("10.0.0.2:1234")
+	if code := post("10.0.0.2:1234"); code != http.StatusTooManyRequests {
+		t.Errorf("The client should be rate limited: %d", code)
+	}
+}
+
+func TestParentTTL(t *testing.T) {
+	now := time.Unix(1000, 0)
+	h := http.Header{}
+
+	if _, _, ok := parentTTL(h, now); ok {
+		t.Errorf("The response without TTL headers should be ignored")
+	}
+
+	setTTLHeaders(h, now.Add(-30*time.Second), time.Minute, time.Hour)
+	if ttl, grace, ok := parentTTL(h, now); !ok || ttl != 30*time.Second || grace != time.Hour {
+		t.Errorf("Invalid remaining TTL: %s %s", ttl, grace)
+	}
+
+	// Stale in the parent, only the remaining grace
+	if ttl, grace, ok := parentTTL(h, now.Add(time.Minute)); !ok || ttl != 0 || grace != time.Hour-30*time.Second {
+		t.Errorf("Invalid remaining grace: %s %s", ttl, grace)
+	}
+}
+
+func TestHandlerParent(t *testing.T) {
+	var originCalls, parentCalls int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&originCalls, 1)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("origin"))
+	}))
+	defer origin.Close()
+
+	parentHandler := newTestHandler(t, origin, &cacherules.Rules{
+		Rule: []cacherules.Rule{{Path: "/**", TTL: "1h"}},
+	})
+	parentHandler.cfg.Parent = &Parent{Children: []string{"127.0.0.0/8"}}
+	parentHandler.Reload(parentHandler.cfg)
+	var hops string
+	parent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&parentCalls, 1)
+		hops = r.Header.Get(headerHops)
+		parentHandler.ServeHTTP(w, r)
+	}))
+	defer parent.Close()
+
+	newChild := func() *Handler {
+		h := newTestHandler(t, origin, nil)
+		h.cfg.Parent = &Parent{
+			ID:   "child",
+			Pool: &backend.PoolConfig{Backends: []backend.Config{testBackendConfig(parent)}},
+		}
+		h.Reload(h.cfg)
+		return h
+	}
+
+	child := newChild()
+	w := doTestRequest(child, http.MethodGet, "http://www.example.com/parent")
+	if w.Body.String() != "origin" || w.Header().Get(headerFreshUntil) != "" {
+		t.Errorf("Invalid response: %s %v", w.Body.String(), w.Header())
+	}
+	if hops != "child" {
+		t.Errorf("Invalid hops header: %q", hops)
+	}
+
+	// Served from the cache of the child
+	doTestRequest(child, http.MethodGet, "http://www.example.com/parent")
+	// Served from the cache of the parent
+	w = doTestRequest(newChild(), http.MethodGet, "http://www.example.com/parent")
+	if w.Body.String() != "origin" {
+		t.Errorf("Invalid response: %s", w.Body.String())
+	}
+	if atomic.LoadInt32(&originCalls) != 1 || atomic.LoadInt32(&parentCalls) != 2 {
+		t.Errorf("Invalid requests: origin %d parent %d", originCalls, parentCalls)
+	}
+
+	// The non cachable requests go to the origin
+	doTestRequest(child, http.MethodPost, "http://www.example.com/parent")
+	if atomic.LoadInt32(&originCalls) != 2 || atomic.LoadInt32(&parentCalls) != 2 {
+		t.Errorf("Invalid requests: origin %d parent %d", originCalls, parentCalls)
+	}
+}
+
+func TestHandlerParentTLS(t *testing.T) {
+	origin, _ := newTestOrigin("origin")
+	defer origin.Close()
+
+	parentHandler := newTestHandler(t, origin, &cacherules.Rules{
+		Rule: []cacherules.Rule{{Path: "/**", TTL: "1h"}},
+	})
+	parentHandler.cfg.Parent = &Parent{Children: []string{"127.0.0.0/8"}}
+	parentHandler.Reload(parentHandler.cfg)
+	var proto string
+	parent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proto = r.Header.Get("X-Forwarded-Protocol")
+		parentHandler.ServeHTTP(w, r)
+	}))
+	defer parent.Close()
+
+	child := newTestHandler(t, origin, nil)
+	child.cfg.Parent = &Parent{
+		Pool: &backend.PoolConfig{Backends: []backend.Config{testBackendConfig(parent)}},
+	}
+	child.Reload(child.cfg)
+
+	// The child terminate the TLS, the parent use the https key
+	doTestRequest(child, http.MethodGet, "https://www.example.com/tls")
+	if proto != "https" {
+		t.Errorf("The scheme of the client should be sent to the parent: %q", proto)
+	}
+	if w := doTestRequest(parentHandler, http.MethodGet, "https://www.example.com/tls"); w.Header().Get(headerXCache) != xCacheHIT {
+		t.Errorf("The parent should store the object with the https key: %v", w.Header())
+	}
+}
+
+func TestHandlerParentUnhealthy(t *testing.T) {
+	origin, _ := newTestOrigin("origin")
+	defer origin.Close()
+	parent, _ := newTestOrigin("parent")
+	parentCfg := testBackendConfig(parent)
+	parent.Close()
+
+	h := newTestHandler(t, origin, nil)
+	h.cfg.Parent = &Parent{
+		Pool: &backend.PoolConfig{
+			Backends:    []backend.Config{parentCfg},
+			HealthCheck: &backend.HealthCheck{Interval: "10ms", Fall: 1},
+		},
+	}
+	h.Reload(h.cfg)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for h.parent().pool.Next(false, 0) != nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("The parent should be unhealthy")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if body := doTestRequest(h, http.MethodGet, "http://www.example.com/fallback").Body.String(); body != "origin" {
+		t.Errorf("The request should go to the origin: %s", body)
+	}
+}
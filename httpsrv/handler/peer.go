@@ -0,0 +1,58 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gabrielperezs/elinproxy/httpsrv/backend"
+	"github.com/gabrielperezs/elinproxy/httpsrv/cluster"
+)
+
+type peerCtxKey struct{}
+
+// PeerHandler is the internal API of the cluster, the peers request
+// here the objects owned by this node. It should not be public, the
+// requests without the token of the cluster are rejected.
+func (handler *Handler) PeerHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !handler.cluster().Authorized(r) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		r.Header.Del(cluster.TokenHeader)
+		r = r.WithContext(context.WithValue(r.Context(), peerCtxKey{}, true))
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// fromPeer return true if the request was received by the internal API
+func fromPeer(r *http.Request) bool {
+	v, _ := r.Context().Value(peerCtxKey{}).(bool)
+	return v
+}
+
+// cluster return the cluster of the handler, nil if it is not enabled
+func (handler *Handler) cluster() *cluster.Cluster {
+	return handler.vhosts.Load().(*vhosts).cluster
+}
+
+// owner return the peer that store the key, nil if the key is owned
+// by this node or the request was sent by other peer
+func (handler *Handler) owner(r *http.Request, key cacheKey) *backend.Backend {
+	if fromPeer(r) {
+		return nil
+	}
+	b, self := handler.cluster().Owner(key.hash)
+	if self {
+		return nil
+	}
+	return b
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
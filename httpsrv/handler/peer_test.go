@@ -0,0 +1,185 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/gabrielperezs/elinproxy/httpsrv/cluster"
+)
+
+// newTestCluster start n handlers on localhost with the internal API
+// of the cluster
+func newTestCluster(t *testing.T, origin *httptest.Server, n int, hot bool) []*Handler {
+	nodes := make([]*Handler, n)
+	servers := make([]*httptest.Server, n)
+	peers := make([]string, n)
+	for i := range servers {
+		i := i
+		servers[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			nodes[i].PeerHandler().ServeHTTP(w, r)
+		}))
+		t.Cleanup(servers[i].Close)
+		peers[i] = servers[i].Listener.Addr().String()
+	}
+
+	for i := range nodes {
+		h := newTestHandler(t, origin, nil)
+		h.cfg.Cluster = &cluster.Config{
+			Self:     peers[i],
+			Peers:    peers,
+			HotCache: hot,
+			Token:    "secret",
+		}
+		h.Reload(h.cfg)
+		t.Cleanup(h.cluster().Stop)
+		nodes[i] = h
+	}
+	return nodes
+}
+
+func TestHandlerCluster(t *testing.T) {
+	var mu sync.Mutex
+	calls := make(map[string]int)
+	var leaked bool
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls[r.URL.Path]++
+		leaked = leaked || r.Header.Get(cluster.TokenHeader) != ""
+		mu.Unlock()
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer origin.Close()
+
+	nodes := newTestCluster(t, origin, 3, false)
+
+	// Each object is requested only one time to the origin
+	for _, h := range nodes {
+		for i := 0; i < 20; i++ {
+			path := "/cluster/" + strconv.Itoa(i)
+			w := doTestRequest(h, http.MethodGet, "http://www.example.com"+path)
+			if w.Body.String() != path || w.Header().Get(headerFreshUntil) != "" {
+				t.Errorf("Invalid response: %s %v", w.Body.String(), w.Header())
+			}
+		}
+	}
+	for i := 0; i < 20; i++ {
+		if n := calls["/cluster/"+strconv.Itoa(i)]; n != 1 {
+			t.Errorf("The object %d was requested %d times to the origin", i, n)
+		}
+	}
+
+	// Only the owner store the object
+	hits := 0
+	for _, h := range nodes {
+		if doTestRequest(h, http.MethodGet, "http://www.example.com/cluster/0").Header().Get(headerXCache) == xCacheHIT {
+			hits++
+		}
+	}
+	if hits != 1 {
+		t.Errorf("The object should be stored only by the owner: %d", hits)
+	}
+	if leaked {
+		t.Errorf("The token of the cluster should not be sent to the origin")
+	}
+
+	// The internal API reject the requests without the token
+	for _, token := range []string{"", "other"} {
+		req := httptest.NewRequest(http.MethodGet, "http://www.example.com/cluster/0", nil)
+		if token != "" {
+			req.Header.Set(cluster.TokenHeader, token)
+		}
+		w := httptest.NewRecorder()
+		nodes[0].PeerHandler().ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%q: the request without the token should be rejected: %d", token, w.Code)
+		}
+	}
+
+	// The cluster is not enabled without the token
+	h := newTestHandler(t, origin, nil)
+	h.cfg.Cluster = &cluster.Config{Self: "127.0.0.1:1"}
+	h.Reload(h.cfg)
+	if h.cluster() != nil {
+		t.Errorf("The cluster without token should be invalid")
+	}
+	w := httptest.NewRecorder()
+	h.PeerHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://www.example.com/cluster/0", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("The internal API should be rejected without cluster: %d", w.Code)
+	}
+}
+
+func TestHandlerClusterTLS(t *testing.T) {
+	var mu sync.Mutex
+	calls := make(map[string]int)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls[r.URL.Path]++
+		mu.Unlock()
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer origin.Close()
+
+	nodes := newTestCluster(t, origin, 2, false)
+
+	// The owner store the object with the https key of the node that
+	// received the request, the next requests of the owner are hits
+	for _, h := range nodes {
+		for i := 0; i < 10; i++ {
+			doTestRequest(h, http.MethodGet, "https://www.example.com/tls/"+strconv.Itoa(i))
+		}
+	}
+	for i := 0; i < 10; i++ {
+		if n := calls["/tls/"+strconv.Itoa(i)]; n != 1 {
+			t.Errorf("The object %d was requested %d times to the origin", i, n)
+		}
+	}
+}
+
+func TestHandlerClusterHotCache(t *testing.T) {
+	origin, _ := newTestOrigin("hot")
+	defer origin.Close()
+
+	nodes := newTestCluster(t, origin, 2, true)
+
+	// The owner and the node with the hot copy serve the object
+	for i, h := range nodes {
+		doTestRequest(h, http.MethodGet, "http://www.example.com/hot")
+		w := doTestRequest(h, http.MethodGet, "http://www.example.com/hot")
+		if w.Body.String() != "hot" || w.Header().Get(headerXCache) != xCacheHIT {
+			t.Errorf("The node %d should serve the object from the cache: %v", i, w.Header())
+		}
+	}
+}
+
+func TestHandlerPeerRateLimit(t *testing.T) {
+	origin, _ := newTestOrigin("origin")
+	defer origin.Close()
+
+	h := newTestHandler(t, origin, nil)
+	h.cfg.VHosts = map[string]*VHost{"www.example.com": {RateLimit: 1}}
+	h.cfg.Cluster = &cluster.Config{Self: "127.0.0.1:1", Token: "secret"}
+	h.Reload(h.cfg)
+	t.Cleanup(h.cluster().Stop)
+
+	// The peer send the requests of many clients from the same IP
+	api := h.PeerHandler()
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest(http.MethodPost, "http://www.example.com/peer", nil)
+		req.Header.Set(cluster.TokenHeader, "secret")
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("The peer should not be rate limited: %d", w.Code)
+		}
+	}
+	doTestRequest(h, http.MethodPost, "http://www.example.com/peer")
+	if code := doTestRequest(h, http.MethodPost, "http://www.example.com/peer").Code; code != http.StatusTooManyRequests {
+		t.Errorf("The client should be rate limited: %d", code)
+	}
+}
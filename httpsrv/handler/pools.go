@@ -0,0 +1,16 @@
+package handler
+
+import (
+	"github.com/gabrielperezs/elinproxy/httpsrv/backend"
+)
+
+// legacyPool is the pool of the BackendHost and BackendTLSHost of the config
+func legacyPool(cfg *Config) *backend.PoolConfig {
+	pc := &backend.PoolConfig{
+		Backends: []backend.Config{{Host: cfg.BackendHost, Port: cfg.BackendPort}},
+	}
+	if cfg.BackendTLSHost != "" {
+		pc.TLSBackends = []backend.Config{{Host: cfg.BackendTLSHost, Port: cfg.BackendTLSPort}}
+	}
+	return pc
+}
@@ -0,0 +1,115 @@
+package handler
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gabrielperezs/elinproxy/httpsrv/backend"
+	"github.com/gabrielperezs/elinproxy/httpsrv/cacherules"
+)
+
+func newTestOrigin(name string) (*httptest.Server, backend.Config) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(name))
+	}))
+	u, _ := url.Parse(origin.URL)
+	host, port, _ := net.SplitHostPort(u.Host)
+	return origin, backend.Config{Host: host, Port: port}
+}
+
+func TestHandlerPools(t *testing.T) {
+	def, _ := newTestOrigin("default")
+	defer def.Close()
+	a, aCfg := newTestOrigin("a")
+	defer a.Close()
+	b, bCfg := newTestOrigin("b")
+	defer b.Close()
+
+	h := newTestHandler(t, def, nil)
+	h.cfg.Pools = map[string]*backend.PoolConfig{
+		"pool.example.com": {
+			Strategy: backend.StrategyHash,
+			Backends: []backend.Config{aCfg, bCfg},
+		},
+	}
+	h.setVHosts(h.cfg)
+
+	if body := doTestRequest(h, http.MethodGet, "http://www.example.com/").Body.String(); body != "default" {
+		t.Errorf("Invalid backend: %s", body)
+	}
+
+	count := make(map[string]int)
+	for _, path := range []string{"/1", "/2", "/3", "/4", "/5", "/6", "/7", "/8"} {
+		count[doTestRequest(h, http.MethodGet, "http://pool.example.com"+path).Body.String()]++
+	}
+	if count["default"] > 0 || count["a"]+count["b"] != 8 {
+		t.Errorf("Invalid distribution: %v", count)
+	}
+}
+
+func TestHandlerStaleOnBackendError(t *testing.T) {
+	origin, _ := newTestOrigin("cached")
+
+	h := newTestHandler(t, origin, &cacherules.Rules{
+		InternalRules: cacherules.InternalRules{
+			NoReqHeaders: map[string]string{"X-Bypass": ""},
+			// The POST use the key of the GET
+			CacheKey: []string{"host", "path"},
+		},
+	})
+
+	if body := doTestRequest(h, http.MethodGet, "http://www.example.com/stale").Body.String(); body != "cached" {
+		t.Fatalf("Invalid response: %s", body)
+	}
+	origin.Close()
+
+	if w := doTestRequest(h, http.MethodGet, "http://www.example.com/stale"); w.Code != http.StatusOK || w.Body.String() != "cached" {
+		t.Errorf("The cached object should be served: %d %s", w.Code, w.Body.String())
+	}
+
+	// The requests that don't use the cache never receive the cached object
+	req := httptest.NewRequest(http.MethodGet, "http://www.example.com/stale", nil)
+	req.Header.Set("X-Bypass", "1")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("The bypassed request should fail: %d %s", w.Code, w.Body.String())
+	}
+	if w := doTestRequest(h, http.MethodPost, "http://www.example.com/stale"); w.Code != http.StatusBadGateway {
+		t.Errorf("The POST should fail: %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestHandlerOutlier(t *testing.T) {
+	var calls int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer origin.Close()
+	u, _ := url.Parse(origin.URL)
+	host, port, _ := net.SplitHostPort(u.Host)
+
+	h := newTestHandler(t, origin, nil)
+	h.cfg.Pool = &backend.PoolConfig{
+		Backends: []backend.Config{{Host: host, Port: port}},
+		Outlier:  &backend.Outlier{ConsecutiveErrors: 2, BaseEjection: "1m"},
+	}
+	h.setVHosts(h.cfg)
+
+	for i := 0; i < 4; i++ {
+		doTestRequest(h, http.MethodGet, "http://www.example.com/outlier/"+strconv.Itoa(i))
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("The backend should be ejected after 2 errors: %d", n)
+	}
+	if w := doTestRequest(h, http.MethodGet, "http://www.example.com/outlier/5"); w.Code != http.StatusBadGateway {
+		t.Errorf("Invalid status: %d", w.Code)
+	}
+}
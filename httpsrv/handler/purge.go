@@ -0,0 +1,290 @@
+package handler
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash"
+
+	"github.com/gabrielperezs/elinproxy/httpsrv/purge"
+)
+
+const bearerPrefix = "Bearer "
+
+// invalidations are the bans and the tags applied, the objects fetched
+// before them are removed when they are requested
+type invalidations struct {
+	mu        sync.RWMutex
+	seq       int64
+	bans      []ban
+	tags      map[string]time.Time
+	retention time.Duration
+	tagHeader string
+}
+
+type ban struct {
+	host string
+	re   *regexp.Regexp
+	at   time.Time
+}
+
+func (b *ban) match(r *http.Request) bool {
+	if b.host != "" && !strings.EqualFold(b.host, r.Host) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil || !strings.EqualFold(b.host, host) {
+			return false
+		}
+	}
+	return b.re.MatchString(r.URL.RequestURI())
+}
+
+// expire remove the bans and the tags older than the retention of the
+// commands, the objects are not stored longer than the retention
+func (inv *invalidations) expire(now time.Time, retention time.Duration) {
+	limit := now.Add(-retention)
+	bans := inv.bans[:0]
+	for _, b := range inv.bans {
+		if b.at.After(limit) {
+			bans = append(bans, b)
+		}
+	}
+	inv.bans = bans
+	for tag, at := range inv.tags {
+		if !at.After(limit) {
+			delete(inv.tags, tag)
+		}
+	}
+}
+
+// maxTTL return the maximum time that the objects are stored, the bans
+// and the tags are only kept the retention of the commands
+func (handler *Handler) maxTTL() time.Duration {
+	inv := &handler.invalidations
+	inv.mu.RLock()
+	defer inv.mu.RUnlock()
+	return inv.retention
+}
+
+// Apply remove from the cache the objects of the command, the commands
+// with a sequence already applied are ignored. The sequence only advance
+// if the command is applied, so it can be applied again.
+func (handler *Handler) Apply(cmd purge.Command) error {
+	if err := cmd.Validate(); err != nil {
+		return err
+	}
+
+	inv := &handler.invalidations
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	if cmd.Seq > 0 && cmd.Seq <= inv.seq {
+		return nil
+	}
+
+	switch cmd.Type {
+	case purge.TypePurge:
+		if err := handler.purgeBefore(cmd.Host, cmd.URL, cmd.Time); err != nil {
+			return err
+		}
+	case purge.TypeBan:
+		inv.bans = append(inv.bans, ban{
+			host: cmd.Host,
+			re:   regexp.MustCompile(cmd.Pattern),
+			at:   cmd.Time,
+		})
+	case purge.TypeTag:
+		if inv.tags == nil {
+			inv.tags = make(map[string]time.Time)
+		}
+		for _, tag := range cmd.Tags {
+			if cmd.Time.After(inv.tags[tag]) {
+				inv.tags[tag] = cmd.Time
+			}
+		}
+	}
+	if cmd.Seq > 0 {
+		inv.seq = cmd.Seq
+	}
+	inv.expire(time.Now(), inv.retention)
+	return nil
+}
+
+// Applied return the sequence of the last command applied
+func (handler *Handler) Applied() int64 {
+	handler.invalidations.mu.RLock()
+	defer handler.invalidations.mu.RUnlock()
+	return handler.invalidations.seq
+}
+
+// purgeBefore remove the object of the URL for all the schemes and
+// devices if it was fetched before the time
+func (handler *Handler) purgeBefore(host, uri string, at time.Time) error {
+	req, err := http.NewRequest(http.MethodGet, "http://"+host+uri, nil)
+	if err != nil {
+		return err
+	}
+	keyReq, _ := handler.rules.NormalizeRequest(req)
+	for _, keyStr := range handler.rules.PurgeKeys(keyReq, handler.rules.Match(keyReq)) {
+		key := xxhash.Sum64String(keyStr)
+		if item, _, err := handler.cache.Peek(key, 0); err == nil {
+			fetched := item.GetFetchedAt()
+			item.Done()
+			if !fetched.Before(at) {
+				continue
+			}
+		}
+		handler.cache.Delete(key)
+	}
+	return nil
+}
+
+// invalidated return true if a ban or a tag applied after the fetch
+// of the object match with the request or the object
+func (handler *Handler) invalidated(r *http.Request, h http.Header, fetched time.Time) bool {
+	inv := &handler.invalidations
+	inv.mu.RLock()
+	defer inv.mu.RUnlock()
+
+	for i := range inv.bans {
+		if inv.bans[i].at.After(fetched) && inv.bans[i].match(r) {
+			return true
+		}
+	}
+	if len(inv.tags) == 0 {
+		return false
+	}
+	for _, v := range h.Values(inv.tagHeader) {
+		for _, tag := range strings.FieldsFunc(v, isTagSeparator) {
+			if inv.tags[tag].After(fetched) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isTagSeparator(r rune) bool {
+	return r == ',' || r == ' '
+}
+
+func (handler *Handler) getPurger() *purge.Purger {
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	return handler.purger
+}
+
+// setPurger start the propagation of the purges, it is restarted only
+// if the config changed
+func (handler *Handler) setPurger(cfg *Config) {
+	pc := purge.Config{}
+	if cfg.Purge != nil {
+		pc = *cfg.Purge
+	}
+	// The nodes of the cluster use the same name than in the ring
+	if pc.ID == "" && cfg.Cluster != nil {
+		pc.ID = cfg.Cluster.Self
+	}
+
+	handler.mu.Lock()
+	old, oldCfg := handler.purger, handler.purgeCfg
+	handler.mu.Unlock()
+	if old != nil && reflect.DeepEqual(pc, oldCfg) {
+		return
+	}
+
+	p, err := purge.New(&pc, handler)
+	if err != nil {
+		log.Printf("httpsrv/handler/purge ERROR: %s", err)
+		if old != nil {
+			return
+		}
+		// The purges are applied at least in this node
+		p, _ = purge.New(&purge.Config{}, handler)
+	}
+
+	inv := &handler.invalidations
+	inv.mu.Lock()
+	inv.retention, inv.tagHeader = p.Retention(), p.TagHeader()
+	inv.mu.Unlock()
+
+	handler.mu.Lock()
+	handler.purger, handler.purgeCfg = p, pc
+	handler.mu.Unlock()
+
+	if old != nil {
+		old.Stop()
+	}
+	p.Start()
+}
+
+// purgeAuthorized return true if the request send the token of the API
+func (handler *Handler) purgeAuthorized(r *http.Request) bool {
+	handler.mu.Lock()
+	token := handler.purgeCfg.Token
+	handler.mu.Unlock()
+	if token == "" {
+		return true
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, bearerPrefix) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(auth[len(bearerPrefix):]), []byte(token)) == 1
+}
+
+// Purge apply the command in all the nodes
+func (handler *Handler) Purge(ctx context.Context, cmd purge.Command) error {
+	return handler.getPurger().Publish(ctx, cmd)
+}
+
+// PurgeHandler is the API to remove objects from the cache of all the
+// nodes. The command is sent in the body as JSON:
+//
+//	{"Type": "purge", "Host": "www.example.com", "URL": "/a?b=1"}
+//	{"Type": "ban", "Host": "www.example.com", "Pattern": "^/img/"}
+//	{"Type": "tag", "Tags": ["product-1"]}
+//
+// The requests should send the token of the config, if it is defined.
+func (handler *Handler) PurgeHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !handler.purgeAuthorized(r) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var cmd purge.Command
+		if err := json.NewDecoder(r.Body).Decode(&cmd); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := cmd.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := handler.Purge(r.Context(), cmd); err != nil {
+			log.Printf("httpsrv/handler/purge ERROR %s %s: %s", cmd.Type, cmd.Host, err)
+			code := http.StatusInternalServerError
+			if errors.Is(err, purge.ErrNotAcknowledged) {
+				code = http.StatusGatewayTimeout
+			}
+			http.Error(w, err.Error(), code)
+			return
+		}
+		w.Write([]byte("OK\n"))
+	})
+}
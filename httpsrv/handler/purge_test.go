@@ -0,0 +1,226 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gabrielperezs/elinproxy/httpsrv/cacherules"
+	"github.com/gabrielperezs/elinproxy/httpsrv/purge"
+)
+
+func TestHandlerPurge(t *testing.T) {
+	var calls int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Cache-Tag", "all, path"+strings.Replace(r.URL.Path, "/", "-", -1))
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer origin.Close()
+
+	h := newTestHandler(t, origin, nil)
+	api := h.PurgeHandler()
+
+	paths := []string{"/a", "/b", "/img/c"}
+	fill := func() int32 {
+		before := atomic.LoadInt32(&calls)
+		for _, p := range paths {
+			doTestRequest(h, http.MethodGet, "http://www.example.com"+p)
+		}
+		return atomic.LoadInt32(&calls) - before
+	}
+	if n := fill(); n != 3 {
+		t.Fatalf("Expected 3 requests to the backend: %d", n)
+	}
+
+	tests := []struct {
+		cmd  string
+		miss int32
+	}{
+		{`{"Type": "purge", "Host": "www.example.com", "URL": "/a"}`, 1},
+		{`{"Type": "ban", "Host": "www.example.com", "Pattern": "^/img/"}`, 1},
+		{`{"Type": "ban", "Host": "other.example.com", "Pattern": "^/"}`, 0},
+		{`{"Type": "tag", "Tags": ["path-b"]}`, 1},
+		{`{"Type": "tag", "Tags": ["all"]}`, 3},
+	}
+	for _, v := range tests {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/purge", strings.NewReader(v.cmd)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Invalid status %d: %s", w.Code, w.Body.String())
+		}
+		if n := fill(); n != v.miss {
+			t.Errorf("%s: expected %d requests to the backend: %d", v.cmd, v.miss, n)
+		}
+		// The new copies are not affected by the old commands
+		if n := fill(); n != 0 {
+			t.Errorf("%s: the new copies should be served from the cache: %d", v.cmd, n)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/purge", strings.NewReader(`{"Type": "ban", "Pattern": "("}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("The invalid pattern should be rejected: %d", w.Code)
+	}
+}
+
+func TestHandlerPurgeTLS(t *testing.T) {
+	var calls int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("ok"))
+	}))
+	defer origin.Close()
+
+	rules := &cacherules.Rules{
+		InternalRules: cacherules.InternalRules{
+			CacheKey: []string{"scheme", "host", "path"},
+		},
+	}
+	h := newTestHandler(t, origin, rules)
+
+	// The object is stored over TLS, the purge don't know the scheme
+	doTestRequest(h, http.MethodGet, "https://www.example.com/a")
+	doTestRequest(h, http.MethodGet, "https://www.example.com/a")
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("The object should be cached: %d", n)
+	}
+
+	cmd := purge.Command{Type: purge.TypePurge, Host: "www.example.com", URL: "/a", Time: time.Now()}
+	if err := h.Apply(cmd); err != nil {
+		t.Fatal(err)
+	}
+	doTestRequest(h, http.MethodGet, "https://www.example.com/a")
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("The object stored over TLS should be purged: %d", n)
+	}
+}
+
+func TestHandlerPurgeRetention(t *testing.T) {
+	var calls int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("ok"))
+	}))
+	defer origin.Close()
+
+	h := newTestHandler(t, origin, &cacherules.Rules{
+		Rule: []cacherules.Rule{{Path: "/**", TTL: "1h"}},
+	})
+	h.cfg.Purge = &purge.Config{Retention: "1s"}
+	h.Reload(h.cfg)
+
+	doTestRequest(h, http.MethodGet, "http://www.example.com/a")
+	ban := purge.Command{Type: purge.TypeBan, Host: "www.example.com", Pattern: "^/a", Time: time.Now()}
+	if err := h.Apply(ban); err != nil {
+		t.Fatal(err)
+	}
+
+	// The object is not requested until the ban expires, the object
+	// expires with it
+	time.Sleep(1100 * time.Millisecond)
+	if err := h.Apply(purge.Command{Type: purge.TypeTag, Tags: []string{"other"}, Time: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for doTestRequest(h, http.MethodGet, "http://www.example.com/a").Header().Get(headerXCache) == xCacheHIT {
+		if time.Now().After(deadline) {
+			t.Fatalf("The banned object should not be served after the retention")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("The object should be requested again to the origin: %d", n)
+	}
+}
+
+func TestHandlerApplySeq(t *testing.T) {
+	var calls int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("ok"))
+	}))
+	defer origin.Close()
+
+	h := newTestHandler(t, origin, nil)
+	cmd := purge.Command{
+		Seq:  5,
+		Type: purge.TypeBan,
+		Host: "www.example.com",
+		// The command was published before the objects were fetched
+		Pattern: "^/",
+		Time:    time.Now().Add(-time.Minute),
+	}
+	if err := h.Apply(cmd); err != nil {
+		t.Fatal(err)
+	}
+
+	doTestRequest(h, http.MethodGet, "http://www.example.com/a")
+	doTestRequest(h, http.MethodGet, "http://www.example.com/a")
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("The old ban should not affect the new objects: %d", n)
+	}
+
+	// The commands already applied are ignored
+	cmd.Time = time.Now()
+	h.Apply(cmd)
+	doTestRequest(h, http.MethodGet, "http://www.example.com/a")
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("The sequence 5 was already applied: %d", n)
+	}
+	if h.Applied() != 5 {
+		t.Errorf("Invalid applied sequence: %d", h.Applied())
+	}
+
+	cmd.Seq = 6
+	h.Apply(cmd)
+	doTestRequest(h, http.MethodGet, "http://www.example.com/a")
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("The sequence 6 should ban the object: %d", n)
+	}
+
+	// The commands that fail can be applied again
+	failed := purge.Command{Seq: 7, Type: purge.TypePurge, Host: "www.example.com%zz", URL: "/a"}
+	if err := h.Apply(failed); err == nil {
+		t.Fatalf("The purge of an invalid URL should fail")
+	}
+	if h.Applied() != 6 {
+		t.Errorf("The failed sequence should not be applied: %d", h.Applied())
+	}
+}
+
+func TestHandlerPurgeToken(t *testing.T) {
+	origin, _ := newTestOrigin("origin")
+	defer origin.Close()
+
+	h := newTestHandler(t, origin, nil)
+	h.cfg.Purge = &purge.Config{Token: "secret"}
+	h.Reload(h.cfg)
+	api := h.PurgeHandler()
+
+	tests := map[string]int{
+		"":              http.StatusUnauthorized,
+		"secret":        http.StatusUnauthorized,
+		"Bearer other":  http.StatusUnauthorized,
+		"Bearer secret": http.StatusOK,
+	}
+	for auth, code := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/purge", strings.NewReader(`{"Type": "tag", "Tags": ["all"]}`))
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		if w.Code != code {
+			t.Errorf("%q: expected status %d: %d", auth, code, w.Code)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package handler
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gabrielperezs/elinproxy/httpsrv/backend"
+)
+
+const (
+	defaultRetryAttempts = 1
+	defaultRetryBudget   = 20
+	defaultRetryMin      = 3
+	retryBudgetWindow    = 10 * time.Second
+)
+
+var (
+	defaultRetryMethods  = []string{http.MethodGet, http.MethodHead, http.MethodOptions}
+	defaultRetryStatuses = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+)
+
+// Retry define when the failed requests are sent again to another
+// backend of the pool. The requests are never retried after send
+// the response to the client.
+type Retry struct {
+	// Retries after the first request, 1 by default
+	Attempts int
+	// Maximum time of each try to receive the headers of the response,
+	// the body is read without this limit. Empty use the timeouts of
+	// the transport.
+	PerTryTimeout string
+	// Maximum percentage of retries over the requests, 20 by default
+	Budget float64
+	// Retries per window allowed even if the budget is exceeded
+	MinRetries int
+	// Methods retried, GET, HEAD and OPTIONS by default. The writes like
+	// PUT or DELETE should be added explicitly, the backend can apply
+	// them before fail and they are sent twice.
+	Methods []string
+	// Status codes retried, 502, 503 and 504 by default
+	Statuses []int
+
+	perTryTimeout time.Duration
+	budget        *retryBudget
+}
+
+// newRetry return a compiled copy of the retry config, each copy
+// has its own budget
+func newRetry(cfg *Retry) (*Retry, error) {
+	rp := *cfg
+	if err := rp.parse(); err != nil {
+		return nil, err
+	}
+	return &rp, nil
+}
+
+func (rp *Retry) parse() (err error) {
+	if rp.Attempts <= 0 {
+		rp.Attempts = defaultRetryAttempts
+	}
+	if rp.Budget <= 0 {
+		rp.Budget = defaultRetryBudget
+	}
+	if rp.MinRetries <= 0 {
+		rp.MinRetries = defaultRetryMin
+	}
+	if len(rp.Methods) == 0 {
+		rp.Methods = defaultRetryMethods
+	}
+	if len(rp.Statuses) == 0 {
+		rp.Statuses = defaultRetryStatuses
+	}
+	if rp.PerTryTimeout != "" {
+		if rp.perTryTimeout, err = time.ParseDuration(rp.PerTryTimeout); err != nil {
+			return err
+		}
+	}
+	rp.budget = &retryBudget{
+		ratio: rp.Budget / 100,
+		min:   rp.MinRetries,
+	}
+	return nil
+}
+
+func (rp *Retry) method(m string) bool {
+	for _, v := range rp.Methods {
+		if v == m {
+			return true
+		}
+	}
+	return false
+}
+
+func (rp *Retry) status(code int) bool {
+	for _, v := range rp.Statuses {
+		if v == code {
+			return true
+		}
+	}
+	return false
+}
+
+// retryBudget limit the retries to a percentage of the requests, so
+// the retries don't overload the backends when all of them are failing
+type retryBudget struct {
+	mu       sync.Mutex
+	ratio    float64
+	min      int
+	start    time.Time
+	requests int
+	retries  int
+}
+
+func (rb *retryBudget) roll(now time.Time) {
+	if now.Sub(rb.start) > retryBudgetWindow {
+		rb.start = now
+		rb.requests = 0
+		rb.retries = 0
+	}
+}
+
+func (rb *retryBudget) request() {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.roll(time.Now())
+	rb.requests++
+}
+
+// allow return true and count the retry if it is in the budget
+func (rb *retryBudget) allow() bool {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.roll(time.Now())
+	if rb.retries >= rb.min && float64(rb.retries) >= rb.ratio*float64(rb.requests) {
+		return false
+	}
+	rb.retries++
+	return true
+}
+
+// retryTransport send the request again to other backends of the pool
+// if the backend fails. The ReverseProxy don't write nothing to the
+// client until the RoundTrip return, so the retries are safe.
+type retryTransport struct {
+	policy    *Retry
+	transport http.RoundTripper
+	pool      *backend.Pool
+	key       cacheKey
+	tls       bool
+	debug     bool
+
+	// Backend of the last try and all the backends tried, the first
+	// is the backend chosen by the handler
+	mu      sync.Mutex
+	backend *backend.Backend
+	tried   []*backend.Backend
+}
+
+func newRetryTransport(policy *Retry, transport http.RoundTripper, pool *backend.Pool, b *backend.Backend, key cacheKey, r *http.Request, debug bool) *retryTransport {
+	return &retryTransport{
+		policy:    policy,
+		transport: transport,
+		pool:      pool,
+		key:       key,
+		tls:       r.TLS != nil || r.Header.Get("X-Forwarded-Protocol") == "https",
+		debug:     debug,
+		backend:   b,
+		tried:     []*backend.Backend{b},
+	}
+}
+
+// last return the backend of the last try
+func (rt *retryTransport) last() *backend.Backend {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return rt.backend
+}
+
+// replayable return true if the body of the request can be sent again
+func replayable(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+func (rt *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.policy.budget.request()
+	retry := rt.policy.method(req.Method) && replayable(req)
+
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		resp, err := rt.try(req)
+
+		canRetry := retry && attempt < rt.policy.Attempts && req.Context().Err() == nil
+		if !canRetry || (err == nil && !rt.policy.status(resp.StatusCode)) {
+			return resp, err
+		}
+
+		prev := rt.last()
+		next := rt.pool.NextExcept(rt.tls, rt.key.hash, rt.tried)
+		if next == nil || !rt.policy.budget.allow() {
+			return resp, err
+		}
+
+		nextReq, rerr := rt.retryRequest(req, prev, next)
+		if rerr != nil {
+			return resp, err
+		}
+
+		if rt.debug {
+			log.Printf("httpsrv/handler/retry %s://%s%s: %s -> %s (%v %v)", req.URL.Scheme, req.Host, req.URL.Path, prev.Address(), next.Address(), resp != nil, err)
+		}
+		if resp != nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		// The ErrorHandler and the ModifyResponse report the result of the last try
+		prev.Report(false, time.Since(start))
+
+		next.Acquire()
+		rt.mu.Lock()
+		rt.tried = append(rt.tried, next)
+		rt.backend = next
+		rt.mu.Unlock()
+		req = nextReq
+	}
+}
+
+// try send the request to the backend with the per try timeout, the tries
+// without the headers of the response in time fail with
+// context.DeadlineExceeded. The timeout is stopped when the headers are
+// received, the body can't be retried once it is sent to the client.
+func (rt *retryTransport) try(req *http.Request) (*http.Response, error) {
+	if rt.policy.perTryTimeout <= 0 {
+		return rt.transport.RoundTrip(req)
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	timer := time.AfterFunc(rt.policy.perTryTimeout, cancel)
+	resp, err := rt.transport.RoundTrip(req.WithContext(ctx))
+	if !timer.Stop() {
+		// The timeout expired before the headers of the response
+		if err == nil {
+			resp.Body.Close()
+		}
+		cancel()
+		return nil, context.DeadlineExceeded
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// The context is alive until the body is read
+	resp.Body = cancelBody{resp.Body, cancel}
+	return resp, nil
+}
+
+// retryRequest return a copy of the request for the next backend
+func (rt *retryTransport) retryRequest(req *http.Request, prev, next *backend.Backend) (*http.Request, error) {
+	nr := req.Clone(req.Context())
+	nr.URL.Host = next.Address()
+	if nr.URL.Scheme == prev.Scheme {
+		nr.URL.Scheme = next.Scheme
+	}
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		nr.Body = body
+	}
+	return nr, nil
+}
+
+// release the backends used by the retries
+func (rt *retryTransport) release() {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	for _, b := range rt.tried[1:] {
+		b.Release()
+	}
+}
+
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,199 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gabrielperezs/elinproxy/httpsrv/backend"
+	"github.com/gabrielperezs/elinproxy/httpsrv/httplog"
+)
+
+func TestRetryBudget(t *testing.T) {
+	rp, err := newRetry(&Retry{Budget: 10, MinRetries: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allowed := 0
+	for i := 0; i < 100; i++ {
+		rp.budget.request()
+		if i%2 == 0 && rp.budget.allow() {
+			allowed++
+		}
+	}
+	if allowed != 10 {
+		t.Errorf("The retries should be limited to the 10%%: %d", allowed)
+	}
+
+	rp, _ = newRetry(&Retry{Budget: 10, MinRetries: 2})
+	if !rp.budget.allow() || !rp.budget.allow() || rp.budget.allow() {
+		t.Errorf("The min retries should be allowed without requests")
+	}
+}
+
+// lastBackendIP return the backend logged for the request
+func lastBackendIP(t *testing.T, h *Handler, target string) string {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	hl := httplog.New(req, httptest.NewRecorder(), h.customTags)
+	if err := h.reverseProxy(false, newCacheKey(target), nil, req, hl); err != nil {
+		t.Fatal(err)
+	}
+	return hl.BackendIP
+}
+
+func TestHandlerRetry(t *testing.T) {
+	var failCalls, okCalls int32
+	fail := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&failCalls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer fail.Close()
+	ok := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&okCalls, 1)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("ok"))
+	}))
+	// Other address than the failed backend
+	if l, err := net.Listen("tcp", "127.0.0.2:0"); err == nil {
+		ok.Listener.Close()
+		ok.Listener = l
+	}
+	ok.Start()
+	defer ok.Close()
+
+	cfg := func(s *httptest.Server) backend.Config {
+		u, _ := url.Parse(s.URL)
+		host, port, _ := net.SplitHostPort(u.Host)
+		return backend.Config{Host: host, Port: port}
+	}
+
+	h := newTestHandler(t, fail, nil)
+	h.cfg.Pool = &backend.PoolConfig{
+		Strategy: backend.StrategyLeastConn,
+		Backends: []backend.Config{cfg(fail), cfg(ok)},
+	}
+	h.cfg.Retry = &Retry{PerTryTimeout: "1s"}
+	h.Reload(h.cfg)
+
+	// The least conn always choose the first backend
+	w := doTestRequest(h, http.MethodGet, "http://www.example.com/retry")
+	if w.Code != http.StatusOK || w.Body.String() != "ok" {
+		t.Errorf("The request should be retried: %d %s", w.Code, w.Body.String())
+	}
+	if atomic.LoadInt32(&failCalls) != 1 || atomic.LoadInt32(&okCalls) != 1 {
+		t.Errorf("Invalid backend requests: %d %d", failCalls, okCalls)
+	}
+
+	// The log show the backend of the last try
+	if b := lastBackendIP(t, h, "http://www.example.com/retry-log"); b != cfg(ok).Host {
+		t.Errorf("The log should show the backend of the last try: %s", b)
+	}
+
+	// The POST requests are not idempotent
+	req := httptest.NewRequest(http.MethodPost, "http://www.example.com/retry", strings.NewReader("body"))
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("The POST should not be retried: %d", w.Code)
+	}
+
+	// The writes are only retried if they are enabled
+	if code := doTestRequest(h, http.MethodDelete, "http://www.example.com/retry").Code; code != http.StatusServiceUnavailable {
+		t.Errorf("The DELETE should not be retried by default: %d", code)
+	}
+	h.cfg.Retry = &Retry{Methods: []string{http.MethodDelete}}
+	h.Reload(h.cfg)
+	if code := doTestRequest(h, http.MethodDelete, "http://www.example.com/retry").Code; code != http.StatusOK {
+		t.Errorf("The DELETE should be retried if it is enabled: %d", code)
+	}
+}
+
+func TestHandlerReportOnce(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The body is shorter than the Content-Length, the response
+		// can't be stored and the ModifyResponse fails
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Length", "100")
+		w.Write([]byte("short"))
+	}))
+	defer origin.Close()
+
+	u, _ := url.Parse(origin.URL)
+	host, port, _ := net.SplitHostPort(u.Host)
+	h := newTestHandler(t, origin, nil)
+	h.cfg.Pool = &backend.PoolConfig{
+		Backends: []backend.Config{{Host: host, Port: port}},
+		Outlier:  &backend.Outlier{ConsecutiveErrors: 1},
+	}
+	h.Reload(h.cfg)
+
+	doTestRequest(h, http.MethodGet, "http://www.example.com/short")
+	b := h.vhosts.Load().(*vhosts).def.pool.Backends()[0]
+	if c := b.Circuit(); c != "closed" {
+		t.Errorf("The try should be reported once as a success: %s", c)
+	}
+}
+
+func TestRetryPerTryTimeout(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer slow.Close()
+
+	policy, err := newRetry(&Retry{PerTryTimeout: "50ms"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tries := &retryTransport{policy: policy, transport: http.DefaultTransport}
+
+	// The expired tries are not confused with the cancel of the client
+	req := httptest.NewRequest(http.MethodGet, slow.URL, nil)
+	req.RequestURI = ""
+	if _, err := tries.try(req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded: %v", err)
+	}
+	if req.Context().Err() != nil {
+		t.Errorf("The context of the client should be alive")
+	}
+}
+
+func TestRetryPerTryTimeoutBody(t *testing.T) {
+	slowBody := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first "))
+		w.(http.Flusher).Flush()
+		time.Sleep(150 * time.Millisecond)
+		w.Write([]byte("last"))
+	}))
+	defer slowBody.Close()
+
+	policy, err := newRetry(&Retry{PerTryTimeout: "50ms"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tries := &retryTransport{policy: policy, transport: http.DefaultTransport}
+
+	// The headers are received in time, the body is not cut
+	req := httptest.NewRequest(http.MethodGet, slowBody.URL, nil)
+	req.RequestURI = ""
+	resp, err := tries.try(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil || string(body) != "first last" {
+		t.Errorf("The body should be read after the per try timeout: %q %v", body, err)
+	}
+}
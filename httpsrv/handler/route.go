@@ -0,0 +1,216 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gabrielperezs/elinproxy/httpsrv/backend"
+	"github.com/gabrielperezs/elinproxy/httpsrv/cacherules"
+)
+
+var (
+	errInvalidRoute      = errors.New("The route should define PathPrefix or PathRegex")
+	errInvalidRouteCache = errors.New("Invalid route cache action")
+)
+
+// Route send the requests of a path to its own backends, the routes of
+// the vhost are ordered and the first route that match is used
+type Route struct {
+	Name string
+	// Prefix of the path on the segments, "/api" match with "/api" and
+	// "/api/users" but not with "/apix"
+	PathPrefix string
+	PathRegex  string
+	// Remove the PathPrefix before send the request to the backend
+	StripPrefix bool
+	// Replacement of the PathPrefix, or the template of the PathRegex
+	// with the groups like "$1"
+	Rewrite string
+	// Backends of the route, nil use the pool of the vhost
+	Pool *backend.PoolConfig
+	// "cache" or "bypass" override the decision of the cache rules,
+	// the deny lists like NoReqCookieContains are always applied
+	Cache string
+	// Time to wait the response headers of the backend
+	Timeout string
+
+	pathRe    *regexp.Regexp
+	pool      *backend.Pool
+	transport *http.Transport
+}
+
+func (rt *Route) parse(vh *VHost, ru *reuse) (err error) {
+	if err = rt.parseMatch(); err != nil {
+		return err
+	}
+
+	rt.pool = vh.pool
+	if rt.Pool != nil {
+		if rt.pool, err = ru.pool(vh.name+"/"+rt.Name, rt.Pool); err != nil {
+			return err
+		}
+	}
+
+	rt.transport = vh.transport
+	if rt.Timeout != "" {
+		d, err := time.ParseDuration(rt.Timeout)
+		if err != nil {
+			return err
+		}
+		rt.transport = vh.transport.Clone()
+		rt.transport.ResponseHeaderTimeout = d
+	}
+	if rt.Pool != nil {
+		rt.pool.SetTLSConfig(rt.transport.TLSClientConfig)
+	}
+	return nil
+}
+
+// parseMatch compile the matchers and the cache override of the route
+func (rt *Route) parseMatch() (err error) {
+	if rt.PathPrefix == "" && rt.PathRegex == "" {
+		return errInvalidRoute
+	}
+	if rt.Name == "" {
+		rt.Name = rt.PathPrefix + rt.PathRegex
+	}
+
+	switch rt.Cache {
+	case "", cacherules.ActionCache, cacherules.ActionBypass:
+	default:
+		return errInvalidRouteCache
+	}
+
+	if rt.PathRegex != "" {
+		if rt.pathRe, err = regexp.Compile(rt.PathRegex); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// match return true if the path of the request match with the route
+func (rt *Route) match(r *http.Request) bool {
+	if rt.PathPrefix != "" && !matchPrefix(r.URL.Path, rt.PathPrefix) {
+		return false
+	}
+	if rt.pathRe != nil && !rt.pathRe.MatchString(r.URL.Path) {
+		return false
+	}
+	return true
+}
+
+// matchPrefix return true if the path start with the prefix on a
+// boundary of the segments
+func matchPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+// rewrite change the path of the request sent to the backend
+func (rt *Route) rewrite(req *http.Request) {
+	p := req.URL.Path
+	switch {
+	case rt.pathRe != nil && rt.Rewrite != "":
+		p = rt.pathRe.ReplaceAllString(p, rt.Rewrite)
+	case rt.PathPrefix != "" && rt.Rewrite != "":
+		p = rt.Rewrite + strings.TrimPrefix(p, rt.PathPrefix)
+	case rt.PathPrefix != "" && rt.StripPrefix:
+		p = strings.TrimPrefix(p, rt.PathPrefix)
+	}
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	req.URL.Path = p
+	req.URL.RawPath = ""
+}
+
+// cachable apply the cache override of the route to the decision
+// of the cache rules
+func (rt *Route) cachable(r *http.Request, cachable bool) bool {
+	if rt == nil {
+		return cachable
+	}
+	switch rt.Cache {
+	case cacherules.ActionBypass:
+		return false
+	case cacherules.ActionCache:
+		return r.Method == http.MethodGet || r.Method == http.MethodHead
+	}
+	return cachable
+}
+
+// override apply the cache override of the route of the request to the
+// decision of the cache rules
+func (t *vhosts) override(r *http.Request, cachable bool) (bool, string) {
+	rt := t.get(r.Host).route(r)
+	if c := rt.cachable(r, cachable); c != cachable {
+		return c, "route:" + rt.Name
+	}
+	return cachable, ""
+}
+
+// CacheOverride return the cache override of the routes of the config
+// without start the backends, it is used to simulate the rules
+func CacheOverride(cfg *Config) (cacherules.Override, error) {
+	newVHost := func(name string, routes []Route) (*VHost, error) {
+		vh := &VHost{name: name}
+		for _, rt := range routes {
+			rt := rt
+			if err := rt.parseMatch(); err != nil {
+				return nil, err
+			}
+			vh.routes = append(vh.routes, &rt)
+		}
+		return vh, nil
+	}
+
+	def, err := newVHost(defaultVHostName, cfg.Routes)
+	if err != nil {
+		return nil, err
+	}
+	table := &vhosts{def: def, hosts: make(map[string]*VHost)}
+	for host := range cfg.Pools {
+		table.hosts[strings.ToLower(host)] = &VHost{name: strings.ToLower(host)}
+	}
+	for host, v := range cfg.VHosts {
+		host = strings.ToLower(host)
+		vh, err := newVHost(host, v.Routes)
+		if err != nil {
+			return nil, err
+		}
+		table.hosts[host] = vh
+	}
+	for host, vh := range table.hosts {
+		if strings.HasPrefix(host, wildcardPrefix) {
+			delete(table.hosts, host)
+			table.wildcards = append(table.wildcards, vh)
+		}
+	}
+	sortWildcards(table.wildcards)
+	return table.override, nil
+}
+
+// route return the first route of the vhost that match with the
+// request, nil if the request use the backends of the vhost
+func (vh *VHost) route(r *http.Request) *Route {
+	for _, rt := range vh.routes {
+		if rt.match(r) {
+			return rt
+		}
+	}
+	return nil
+}
+
+// upstream return the pool and the transport of the request
+func (vh *VHost) upstream(rt *Route) (*backend.Pool, *http.Transport) {
+	if rt == nil {
+		return vh.pool, vh.transport
+	}
+	return rt.pool, rt.transport
+}
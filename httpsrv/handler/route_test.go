@@ -0,0 +1,189 @@
+package handler
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gabrielperezs/elinproxy/httpsrv/backend"
+	"github.com/gabrielperezs/elinproxy/httpsrv/cacherules"
+)
+
+func TestRouteRewrite(t *testing.T) {
+	tests := []struct {
+		route Route
+		path  string
+		want  string
+	}{
+		{Route{PathPrefix: "/api/"}, "/api/users", "/api/users"},
+		{Route{PathPrefix: "/api/", StripPrefix: true}, "/api/users", "/users"},
+		{Route{PathPrefix: "/api", StripPrefix: true}, "/api", "/"},
+		{Route{PathPrefix: "/api/", Rewrite: "/v2/"}, "/api/users", "/v2/users"},
+		{Route{PathRegex: `^/static/(\w+)/(.*)$`, Rewrite: "/bucket-$1/$2"}, "/static/img/a.png", "/bucket-img/a.png"},
+	}
+	vh := &VHost{}
+	for _, v := range tests {
+		if err := v.route.parse(vh, nil); err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest(http.MethodGet, "http://www.example.com"+v.path, nil)
+		if !v.route.match(req) {
+			t.Errorf("%s should match with %s", v.route.Name, v.path)
+			continue
+		}
+		v.route.rewrite(req)
+		if req.URL.Path != v.want {
+			t.Errorf("%s rewrite %s: %s, expected %s", v.route.Name, v.path, req.URL.Path, v.want)
+		}
+	}
+}
+
+func TestRouteMatchPrefix(t *testing.T) {
+	tests := []struct {
+		prefix string
+		path   string
+		want   bool
+	}{
+		{"/api", "/api", true},
+		{"/api", "/api/users", true},
+		{"/api", "/apix", false},
+		{"/api", "/ap", false},
+		{"/api/", "/api/users", true},
+		{"/api/", "/api", false},
+		{"/", "/index.html", true},
+	}
+	for _, v := range tests {
+		rt := Route{PathPrefix: v.prefix}
+		req := httptest.NewRequest(http.MethodGet, "http://www.example.com"+v.path, nil)
+		if got := rt.match(req); got != v.want {
+			t.Errorf("%s match with %s: %v, expected %v", v.prefix, v.path, got, v.want)
+		}
+	}
+}
+
+func TestRoutePoolName(t *testing.T) {
+	ru := &reuse{next: &vhosts{shared: make(map[string]*shared)}}
+	defer ru.next.stop(nil)
+
+	// "a.com"+"x" and "a.co"+"mx" should not share the name of the pool
+	pc := &backend.PoolConfig{Backends: []backend.Config{{Host: "127.0.0.1", Port: "1"}}}
+	for _, v := range []struct{ vhost, route string }{{"a.com", "x"}, {"a.co", "mx"}} {
+		rt := Route{Name: v.route, PathPrefix: "/", Pool: pc}
+		if err := rt.parse(&VHost{name: v.vhost, transport: &http.Transport{}}, ru); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(ru.next.shared) != 2 {
+		t.Errorf("The routes should have their own pool: %d", len(ru.next.shared))
+	}
+}
+
+func TestRouteInvalid(t *testing.T) {
+	for _, rt := range []Route{
+		{},
+		{PathPrefix: "/", Cache: "refresh"},
+		{PathRegex: "("},
+		{PathPrefix: "/", Timeout: "10"},
+	} {
+		if err := rt.parse(&VHost{transport: &http.Transport{}}, nil); err == nil {
+			t.Errorf("The route %+v should be invalid", rt)
+		}
+	}
+}
+
+func TestCacheOverride(t *testing.T) {
+	override, err := CacheOverride(&Config{
+		Routes: []Route{{PathPrefix: "/api/", Cache: cacherules.ActionBypass}},
+		VHosts: map[string]*VHost{
+			"*.Example.com": {Routes: []Route{{Name: "static", PathPrefix: "/static/", Cache: cacherules.ActionCache}}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		url      string
+		rules    bool
+		cachable bool
+		name     string
+	}{
+		{"http://other.org/api/a", true, false, "route:/api/"},
+		{"http://other.org/a", true, true, ""},
+		{"http://www.example.com/static/a.js", false, true, "route:static"},
+		{"http://www.example.com/api/a", true, true, ""},
+	}
+	for _, v := range tests {
+		req := httptest.NewRequest(http.MethodGet, v.url, nil)
+		if cachable, name := override(req, v.rules); cachable != v.cachable || name != v.name {
+			t.Errorf("%s: %v %q", v.url, cachable, name)
+		}
+	}
+}
+
+func TestHandlerRoutes(t *testing.T) {
+	def, _ := newTestOrigin("default")
+	defer def.Close()
+
+	var apiCalls int32
+	var apiPath string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&apiCalls, 1)
+		apiPath = r.URL.Path
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("api"))
+	}))
+	defer api.Close()
+	u, _ := url.Parse(api.URL)
+	host, port, _ := net.SplitHostPort(u.Host)
+	apiCfg := backend.Config{Host: host, Port: port}
+
+	h := newTestHandler(t, def, &cacherules.Rules{
+		InternalRules: cacherules.InternalRules{NoReqCookieContains: []string{"logged"}},
+		Rule:          []cacherules.Rule{{Path: "/static/**", Action: cacherules.ActionBypass}},
+	})
+	h.cfg.Routes = []Route{
+		{
+			PathPrefix:  "/api/",
+			StripPrefix: true,
+			Cache:       cacherules.ActionBypass,
+			Pool:        &backend.PoolConfig{Backends: []backend.Config{apiCfg}},
+		},
+		{PathPrefix: "/static/", Cache: cacherules.ActionCache},
+	}
+	h.Reload(h.cfg)
+
+	for i := 0; i < 2; i++ {
+		if body := doTestRequest(h, http.MethodGet, "http://www.example.com/api/users").Body.String(); body != "api" {
+			t.Errorf("Invalid backend: %s", body)
+		}
+	}
+	if apiPath != "/users" {
+		t.Errorf("The prefix should be stripped: %s", apiPath)
+	}
+	if n := atomic.LoadInt32(&apiCalls); n != 2 {
+		t.Errorf("The route should bypass the cache: %d", n)
+	}
+
+	// The deny lists win over the route, the personal pages are not cached
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodGet, "http://www.example.com/static/a.css", nil)
+		req.AddCookie(&http.Cookie{Name: "logged_in", Value: "1"})
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Header().Get("X-Cache") == xCacheHIT {
+			t.Errorf("The logged-in request should not be served from the cache")
+		}
+	}
+	if w := doTestRequest(h, http.MethodGet, "http://www.example.com/static/a.css"); w.Header().Get("X-Cache") == xCacheHIT {
+		t.Errorf("The logged-in response should not be cached")
+	}
+
+	w := doTestRequest(h, http.MethodGet, "http://www.example.com/static/a.css")
+	if w.Body.String() != "default" || w.Header().Get("X-Cache") != xCacheHIT {
+		t.Errorf("The route should cache the response: %s %s", w.Body.String(), w.Header().Get("X-Cache"))
+	}
+}
@@ -0,0 +1,498 @@
+package handler
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/didip/tollbooth"
+	tollboothErrors "github.com/didip/tollbooth/errors"
+	"github.com/didip/tollbooth/limiter"
+
+	"github.com/gabrielperezs/elinproxy/httpsrv/backend"
+	"github.com/gabrielperezs/elinproxy/httpsrv/cluster"
+)
+
+const (
+	defaultVHostName = "default"
+	wildcardPrefix   = "*."
+)
+
+var (
+	errInvalidScheme = errors.New("Invalid vhost scheme")
+)
+
+// VHost is the origin of the requests of one host, the hosts can
+// start with "*." to match with all the subdomains
+type VHost struct {
+	// Backends of the host, nil use the default pool
+	Pool *backend.PoolConfig
+	// Scheme used in the requests to the backends, empty use the
+	// scheme of the pool
+	Scheme string
+	// Host header sent to the backends, empty use the host of the request
+	HostHeader string
+	// Server name sent in the TLS handshake with the backends
+	SNI                   string
+	DialTimeout           string
+	ResponseHeaderTimeout string
+
+	ReqAddHeaders     map[string]string
+	ReqRemoveHeaders  []string
+	RespRemoveHeaders []string
+
+	// Requests per second of each client IP, zero use the global limit
+	RateLimit int
+
+	// Ordered routes by path to other backends
+	Routes []Route
+
+	// Retries of the failed requests, nil use the Retry of the config
+	Retry *Retry
+
+	name      string
+	pool      *backend.Pool
+	transport *http.Transport
+	limiter   *limiter.Limiter
+	routes    []*Route
+	retry     *Retry
+}
+
+// vhosts is the routing table from the host of the request to the vhost
+type vhosts struct {
+	def       *VHost
+	hosts     map[string]*VHost
+	wildcards []*VHost
+	parent    *Parent
+	cluster   *cluster.Cluster
+
+	// Pools, retries and cluster created for the table, by kind and
+	// name, with the JSON of their config
+	shared map[string]*shared
+}
+
+// shared is a pool, a retry or the cluster of the table, the next
+// table reuse it if the config don't change. The constructors set the
+// defaults in the config, it is kept before and after them.
+type shared struct {
+	configs [2]string
+	value   interface{}
+}
+
+// reuse keep the pools, the retries and the cluster of the current table
+// in the reloads when their config don't change, so they keep the health
+// of the backends, the circuit breakers, the retry budget and the
+// registration of the node in etcd
+type reuse struct {
+	old  *vhosts
+	next *vhosts
+}
+
+func (ru *reuse) get(key string, cfg interface{}, create func() (interface{}, error)) (interface{}, error) {
+	if ru == nil {
+		return create()
+	}
+	before, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if ru.old != nil {
+		if s, ok := ru.old.shared[key]; ok && (s.configs[0] == string(before) || s.configs[1] == string(before)) {
+			ru.next.shared[key] = s
+			return s.value, nil
+		}
+	}
+	v, err := create()
+	if err != nil {
+		return nil, err
+	}
+	after, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	ru.next.shared[key] = &shared{configs: [2]string{string(before), string(after)}, value: v}
+	return v, nil
+}
+
+func (ru *reuse) pool(name string, pc *backend.PoolConfig) (*backend.Pool, error) {
+	v, err := ru.get("pool/"+name, pc, func() (interface{}, error) {
+		return backend.NewPool(name, pc)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*backend.Pool), nil
+}
+
+func (ru *reuse) retry(name string, cfg *Retry) (*Retry, error) {
+	v, err := ru.get("retry/"+name, cfg, func() (interface{}, error) {
+		return newRetry(cfg)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*Retry), nil
+}
+
+func (ru *reuse) cluster(cfg *cluster.Config) (*cluster.Cluster, error) {
+	v, err := ru.get("cluster", cfg, func() (interface{}, error) {
+		return cluster.New(cfg)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*cluster.Cluster), nil
+}
+
+func (vh *VHost) parse(handler *Handler, name string, def *backend.Pool, retry *Retry, ru *reuse) (err error) {
+	vh.name = name
+
+	switch strings.ToLower(vh.Scheme) {
+	case "", "http", "https":
+		vh.Scheme = strings.ToLower(vh.Scheme)
+	default:
+		return errInvalidScheme
+	}
+
+	vh.pool = def
+	if vh.Pool != nil {
+		if vh.pool, err = ru.pool(name, vh.Pool); err != nil {
+			return err
+		}
+	}
+
+	vh.transport = handler.roundTripper
+	if vh.SNI != "" || vh.DialTimeout != "" || vh.ResponseHeaderTimeout != "" {
+		if vh.transport, err = vh.newTransport(handler.roundTripper); err != nil {
+			return err
+		}
+	}
+	// The probes of the pool use the TLS config and the SNI of the requests
+	if vh.Pool != nil {
+		vh.pool.SetTLSConfig(vh.transport.TLSClientConfig)
+	}
+
+	vh.limiter = handler.limiter
+	if vh.RateLimit > 0 {
+		vh.limiter = newLimiter(vh.RateLimit)
+	}
+
+	vh.retry = retry
+	if vh.Retry != nil {
+		if vh.retry, err = ru.retry(name, vh.Retry); err != nil {
+			return err
+		}
+	}
+
+	// The compiled routes are copies, the config can be reloaded again
+	vh.routes = make([]*Route, 0, len(vh.Routes))
+	for _, rt := range vh.Routes {
+		rt := rt
+		if err := rt.parse(vh, ru); err != nil {
+			return err
+		}
+		vh.routes = append(vh.routes, &rt)
+	}
+	return nil
+}
+
+// newTransport return a copy of the default transport with the
+// timeouts and the SNI of the vhost
+func (vh *VHost) newTransport(def *http.Transport) (*http.Transport, error) {
+	t := def.Clone()
+	if vh.DialTimeout != "" {
+		d, err := time.ParseDuration(vh.DialTimeout)
+		if err != nil {
+			return nil, err
+		}
+		t.DialContext = (&net.Dialer{
+			Timeout:   d,
+			KeepAlive: 30 * time.Second,
+			DualStack: true,
+		}).DialContext
+	}
+	if vh.ResponseHeaderTimeout != "" {
+		d, err := time.ParseDuration(vh.ResponseHeaderTimeout)
+		if err != nil {
+			return nil, err
+		}
+		t.ResponseHeaderTimeout = d
+	}
+	if vh.SNI != "" {
+		t.TLSClientConfig = &tls.Config{
+			InsecureSkipVerify: true,
+			ServerName:         vh.SNI,
+		}
+	}
+	return t, nil
+}
+
+// modifyRequest apply the header rules of the vhost to the request
+// sent to the backend
+func (vh *VHost) modifyRequest(req *http.Request) {
+	for _, v := range vh.ReqRemoveHeaders {
+		req.Header.Del(v)
+	}
+	for k, v := range vh.ReqAddHeaders {
+		req.Header.Set(k, v)
+	}
+	if vh.HostHeader != "" {
+		req.Host = vh.HostHeader
+	}
+}
+
+// modifyResponse apply the header rules of the vhost before
+// store the response
+func (vh *VHost) modifyResponse(resp *http.Response) {
+	for _, v := range vh.RespRemoveHeaders {
+		resp.Header.Del(v)
+	}
+}
+
+// limit return an error if the client is over the rate limit of the vhost
+func (vh *VHost) limit(w http.ResponseWriter, r *http.Request) *tollboothErrors.HTTPError {
+	return tollbooth.LimitByRequest(vh.limiter, w, r)
+}
+
+func newLimiter(rate int) *limiter.Limiter {
+	l := tollbooth.NewLimiter(float64(rate), &limiter.ExpirableOptions{
+		DefaultExpirationTTL: time.Hour,
+	})
+	l.SetIPLookups([]string{"RemoteAddr"})
+	return l
+}
+
+// newVHosts build the routing table of the config, the pools, the retries
+// and the cluster of the old table are reused if their config don't change.
+// The ones created for an invalid table are stopped.
+func (handler *Handler) newVHosts(cfg *Config, old *vhosts) (_ *vhosts, err error) {
+	table := &vhosts{
+		def:    &VHost{Routes: cfg.Routes},
+		hosts:  make(map[string]*VHost),
+		shared: make(map[string]*shared),
+	}
+	ru := &reuse{old: old, next: table}
+	defer func() {
+		if err != nil {
+			table.stop(old)
+		}
+	}()
+
+	pc := cfg.Pool
+	if pc == nil {
+		pc = legacyPool(cfg)
+	}
+	def, err := ru.pool(defaultVHostName, pc)
+	if err != nil {
+		return nil, err
+	}
+	def.SetTLSConfig(handler.roundTripper.TLSClientConfig)
+
+	// The vhosts without Retry share the budget of the global retries
+	var retry *Retry
+	if cfg.Retry != nil {
+		if retry, err = ru.retry("", cfg.Retry); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Parent != nil {
+		if table.parent, err = newParent(cfg.Parent, ru); err != nil {
+			return nil, err
+		}
+		if table.parent.pool != nil {
+			table.parent.pool.SetTLSConfig(handler.roundTripper.TLSClientConfig)
+		}
+	}
+	if err := table.def.parse(handler, defaultVHostName, def, retry, ru); err != nil {
+		return nil, err
+	}
+
+	// The Pools are vhosts with only the backends
+	routes := make(map[string]*VHost, len(cfg.Pools)+len(cfg.VHosts))
+	for host, pc := range cfg.Pools {
+		routes[strings.ToLower(host)] = &VHost{Pool: pc}
+	}
+	for host, vh := range cfg.VHosts {
+		// The compiled vhost is a copy, the config can be reloaded again
+		v := *vh
+		routes[strings.ToLower(host)] = &v
+	}
+
+	for host, vh := range routes {
+		if err := vh.parse(handler, host, def, retry, ru); err != nil {
+			log.Printf("httpsrv/handler/vhosts %s: %s", host, err)
+			return nil, err
+		}
+		if strings.HasPrefix(host, wildcardPrefix) {
+			table.wildcards = append(table.wildcards, vh)
+			continue
+		}
+		table.hosts[host] = vh
+	}
+	sortWildcards(table.wildcards)
+
+	if cfg.Cluster != nil {
+		if table.cluster, err = ru.cluster(cfg.Cluster); err != nil {
+			return nil, err
+		}
+	}
+	return table, nil
+}
+
+// sortWildcards put the most specific wildcard first
+func sortWildcards(wildcards []*VHost) {
+	sort.Slice(wildcards, func(i, j int) bool {
+		return len(wildcards[i].name) > len(wildcards[j].name)
+	})
+}
+
+// start the pools created for the table, the pools reused from the old
+// table are already running
+func (t *vhosts) start(old *vhosts) {
+	for key, sh := range t.shared {
+		if old != nil && old.shared[key] == sh {
+			continue
+		}
+		if p, ok := sh.value.(*backend.Pool); ok {
+			p.Start()
+		}
+	}
+}
+
+// stop the pools and the cluster that are not reused by the next table,
+// and close the idle connections of the transports that it don't use
+func (t *vhosts) stop(next *vhosts) {
+	for key, sh := range t.shared {
+		if next != nil && next.shared[key] == sh {
+			continue
+		}
+		switch v := sh.value.(type) {
+		case *backend.Pool:
+			v.Stop()
+		case *cluster.Cluster:
+			v.Stop()
+		}
+	}
+	used := next.transports()
+	for tr := range t.transports() {
+		if !used[tr] {
+			tr.CloseIdleConnections()
+		}
+	}
+}
+
+// transports return the transports of the vhosts and the routes
+func (t *vhosts) transports() map[*http.Transport]bool {
+	list := make(map[*http.Transport]bool)
+	if t == nil {
+		return list
+	}
+	add := func(vh *VHost) {
+		if vh == nil {
+			return
+		}
+		if vh.transport != nil {
+			list[vh.transport] = true
+		}
+		for _, rt := range vh.routes {
+			if rt.transport != nil {
+				list[rt.transport] = true
+			}
+		}
+	}
+	add(t.def)
+	for _, vh := range t.hosts {
+		add(vh)
+	}
+	for _, vh := range t.wildcards {
+		add(vh)
+	}
+	return list
+}
+
+// get return the vhost of the host, exact hosts have preference
+// over the wildcards
+func (t *vhosts) get(host string) *VHost {
+	if len(t.hosts) == 0 && len(t.wildcards) == 0 {
+		return t.def
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	if vh, ok := t.hosts[host]; ok {
+		return vh
+	}
+	for _, vh := range t.wildcards {
+		if strings.HasSuffix(host, vh.name[1:]) {
+			return vh
+		}
+	}
+	return t.def
+}
+
+// vhost return the vhost of the request
+func (handler *Handler) vhost(r *http.Request) *VHost {
+	return handler.vhosts.Load().(*vhosts).get(r.Host)
+}
+
+// parent return the parent cache tier, nil if it is not defined
+func (handler *Handler) parent() *Parent {
+	return handler.vhosts.Load().(*vhosts).parent
+}
+
+// nextBackend return the backend of the pool for the request, nil if
+// all the backends of the pool are unhealthy or there is no pool
+func nextBackend(p *backend.Pool, r *http.Request, key cacheKey) *backend.Backend {
+	if p == nil {
+		return nil
+	}
+	tls := r.TLS != nil || r.Header.Get("X-Forwarded-Protocol") == "https"
+	return p.Next(tls, key.hash)
+}
+
+// emptyVHosts return a routing table without backends, all the
+// requests that go to the backend get a 502
+func (handler *Handler) emptyVHosts() *vhosts {
+	return &vhosts{
+		def: &VHost{
+			name:      defaultVHostName,
+			transport: handler.roundTripper,
+			limiter:   handler.limiter,
+		},
+		hosts:  make(map[string]*VHost),
+		shared: make(map[string]*shared),
+	}
+}
+
+// setVHosts build the routing table of the config. If the config is not
+// valid the current table is kept and the error is returned. In the first
+// load the table of the legacy backend is used, or an empty table if it
+// is not valid too, the handler always has a table.
+func (handler *Handler) setVHosts(cfg *Config) error {
+	old, _ := handler.vhosts.Load().(*vhosts)
+	table, err := handler.newVHosts(cfg, old)
+	if err != nil {
+		if old != nil {
+			return err
+		}
+		log.Printf("httpsrv/handler/vhosts ERROR: %s", err)
+		if table, err = handler.newVHosts(&Config{BackendHost: cfg.BackendHost, BackendPort: cfg.BackendPort}, nil); err != nil {
+			log.Printf("httpsrv/handler/vhosts ERROR legacy backend: %s", err)
+			table = handler.emptyVHosts()
+		}
+	}
+	table.start(old)
+	handler.vhosts.Store(table)
+	if old != nil {
+		old.stop(table)
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package handler
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gabrielperezs/elinproxy/httpsrv/backend"
+)
+
+func TestVHostsGet(t *testing.T) {
+	table := &vhosts{
+		def: &VHost{name: defaultVHostName},
+		hosts: map[string]*VHost{
+			"www.example.com": {name: "www.example.com"},
+		},
+		wildcards: []*VHost{
+			{name: "*.static.example.com"},
+			{name: "*.example.com"},
+		},
+	}
+
+	tests := map[string]string{
+		"www.example.com":          "www.example.com",
+		"WWW.example.com:8080":     "www.example.com",
+		"img.example.com":          "*.example.com",
+		"a.static.example.com":     "*.static.example.com",
+		"example.com":              defaultVHostName,
+		"www.example.org":          defaultVHostName,
+		"www.notexample.com":       defaultVHostName,
+		"a.b.static.example.com:1": "*.static.example.com",
+	}
+	for host, name := range tests {
+		if vh := table.get(host); vh.name != name {
+			t.Errorf("%s should use the vhost %s: %s", host, name, vh.name)
+		}
+	}
+}
+
+func TestHandlerVHosts(t *testing.T) {
+	var headers http.Header
+	var host string
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers, host = r.Header, r.Host
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("X-Internal", "1")
+		w.Write([]byte("origin"))
+	}))
+	defer origin.Close()
+	other, otherCfg := newTestOrigin("other")
+	defer other.Close()
+
+	h := newTestHandler(t, origin, nil)
+	h.cfg.VHosts = map[string]*VHost{
+		"*.example.com": {
+			HostHeader:        "origin.internal",
+			ReqAddHeaders:     map[string]string{"X-Site": "example"},
+			ReqRemoveHeaders:  []string{"X-Remove"},
+			RespRemoveHeaders: []string{"X-Internal"},
+		},
+		"www.example.org": {
+			Pool: &backend.PoolConfig{Backends: []backend.Config{otherCfg}},
+		},
+	}
+	h.Reload(h.cfg)
+
+	req := httptest.NewRequest(http.MethodGet, "http://www.example.com/vhost", nil)
+	req.Header.Set("X-Remove", "1")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Body.String() != "origin" || w.Header().Get("X-Internal") != "" {
+		t.Errorf("Invalid response: %s %v", w.Body.String(), w.Header())
+	}
+	if host != "origin.internal" || headers.Get("X-Site") != "example" || headers.Get("X-Remove") != "" {
+		t.Errorf("Invalid request to the backend: %s %v", host, headers)
+	}
+
+	if body := doTestRequest(h, http.MethodGet, "http://www.example.org/vhost").Body.String(); body != "other" {
+		t.Errorf("Invalid backend: %s", body)
+	}
+
+	// The invalid config keep the current routing table
+	h.cfg.VHosts["www.example.net"] = &VHost{Scheme: "ftp"}
+	h.Reload(h.cfg)
+	if body := doTestRequest(h, http.MethodGet, "http://www.example.org/reload").Body.String(); body != "other" {
+		t.Errorf("Invalid backend after reload: %s", body)
+	}
+}
+
+func TestHandlerVHostsReuse(t *testing.T) {
+	origin, originCfg := newTestOrigin("origin")
+	defer origin.Close()
+
+	h := newTestHandler(t, origin, nil)
+	newCfg := func(weight int) *Config {
+		cfg := *h.cfg
+		cfg.Retry = &Retry{Attempts: 2}
+		b := originCfg
+		b.Weight = weight
+		cfg.VHosts = map[string]*VHost{
+			"www.example.org": {Pool: &backend.PoolConfig{Backends: []backend.Config{b}}},
+		}
+		return &cfg
+	}
+	current := func() (*backend.Pool, *backend.Pool, *Retry) {
+		table := h.vhosts.Load().(*vhosts)
+		return table.def.pool, table.get("www.example.org").pool, table.def.retry
+	}
+
+	h.Reload(newCfg(1))
+	def, pool, retry := current()
+
+	// The same config, already parsed or loaded again
+	h.Reload(h.cfg)
+	h.Reload(newCfg(1))
+	if d, p, r := current(); d != def || p != pool || r != retry {
+		t.Errorf("The pools and the retries should be reused when the config don't change")
+	}
+
+	h.Reload(newCfg(2))
+	if d, p, r := current(); d != def || p == pool || r != retry {
+		t.Errorf("Only the pool with a new config should be created again")
+	}
+	if body := doTestRequest(h, http.MethodGet, "http://www.example.org/reuse").Body.String(); body != "origin" {
+		t.Errorf("Invalid backend after reload: %s", body)
+	}
+}
+
+func TestHandlerVHostsInvalidReload(t *testing.T) {
+	origin, _ := newTestOrigin("origin")
+	defer origin.Close()
+
+	h := newTestHandler(t, origin, nil)
+
+	// The config with an invalid table is not applied
+	cfg := *h.cfg
+	cfg.RespRemoveHeaders = []string{"Content-Type"}
+	cfg.VHosts = map[string]*VHost{"www.example.net": {Scheme: "ftp"}}
+	h.Reload(&cfg)
+	if len(h.cfg.RespRemoveHeaders) != 0 || len(h.cfg.VHosts) != 0 {
+		t.Errorf("The config should not be applied: %+v", h.cfg)
+	}
+	if w := doTestRequest(h, http.MethodGet, "http://www.example.net/"); w.Body.String() != "origin" || w.Header().Get("Content-Type") == "" {
+		t.Errorf("Invalid response after reload: %s %v", w.Body.String(), w.Header())
+	}
+}
+
+func TestHandlerVHostsEmpty(t *testing.T) {
+	origin, _ := newTestOrigin("origin")
+	defer origin.Close()
+
+	h := newTestHandler(t, origin, nil)
+	h.vhosts.Store(h.emptyVHosts())
+	if w := doTestRequest(h, http.MethodGet, "http://www.example.com/"); w.Code != http.StatusBadGateway {
+		t.Errorf("The table without backends should respond 502: %d", w.Code)
+	}
+}
+
+func TestHandlerVHostsReloadKeepConns(t *testing.T) {
+	var conns int32
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("origin"))
+	}))
+	origin.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	origin.Start()
+	defer origin.Close()
+
+	h := newTestHandler(t, origin, nil)
+	h.cfg.VHosts = map[string]*VHost{"www.example.org": {ResponseHeaderTimeout: "10s"}}
+	h.Reload(h.cfg)
+
+	// The shared transport is not replaced, only the one of the vhost keep the idle connections
+	doTestRequest(h, http.MethodPost, "http://www.example.com/")
+	h.Reload(h.cfg)
+	doTestRequest(h, http.MethodPost, "http://www.example.com/")
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Errorf("The connection should be reused after the reload: %d", n)
+	}
+}
@@ -1,13 +1,14 @@
 package httplog
 
 import (
+	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"os"
-	"strconv"
 	"strings"
 	"time"
 
@@ -130,17 +131,6 @@ func New(r *http.Request, w http.ResponseWriter, fnHeaders func(w http.ResponseW
 	return hl
 }
 
-// GetKeyStr return a uniq string for each url
-// IMPORTANT: This is the key of the cache engine, if this
-// do not generate the correct string will fuck the cache
-func (hl *HTTPLog) GetKeyStr() string {
-	return hl.GetKeyStrDevice(hl.Device)
-}
-
-func (hl *HTTPLog) GetKeyStrDevice(device int) string {
-	return strconv.Itoa(device) + hl.Method + hl.URL
-}
-
 func (hl *HTTPLog) end() {
 	hl.RespTimeMS = float64(time.Now().Sub(hl.Time).Nanoseconds()) / 1000 / 1000
 }
@@ -190,3 +180,19 @@ func (hl *HTTPLog) WriteHeader(statusCode int) {
 	hl.CustomTags = hl.fnHeaders(hl.w)
 	hl.w.WriteHeader(statusCode)
 }
+
+// Flush send the buffered data to the client
+func (hl *HTTPLog) Flush() {
+	if f, ok := hl.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack return the connection of the wrapped writer, for the upgrades
+// like WebSocket
+func (hl *HTTPLog) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hj, ok := hl.w.(http.Hijacker); ok {
+		return hj.Hijack()
+	}
+	return nil, nil, errors.New("httplog: the writer don't support hijack")
+}
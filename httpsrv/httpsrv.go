@@ -28,6 +28,8 @@ type Config struct {
 type SRV struct {
 	sync.Mutex
 	cfg         *Config
+	peerListen  string
+	purgeListen string
 	done        chan struct{}
 	openSockets []net.Listener
 	tlsCfg      *tls.Config
@@ -49,6 +51,18 @@ func New(cfg *Config) *SRV {
 		},
 	}
 
+	clusterEtcd(cfg)
+	purgeEtcd(cfg)
+	if hc := cfg.Handler.Cluster; hc != nil {
+		s.peerListen = hc.Listen
+		if s.peerListen == "" {
+			s.peerListen = hc.Self
+		}
+	}
+	if pc := cfg.Handler.Purge; pc != nil {
+		s.purgeListen = pc.Listen
+	}
+
 	s.handler = handler.New(cfg.Handler)
 	s.certs = certs.New(cfg.Certs)
 
@@ -82,9 +96,31 @@ func New(cfg *Config) *SRV {
 	return s
 }
 
+// clusterEtcd use the etcd of the certificates for the discovery of
+// the peers if the cluster don't define other endpoints
+func clusterEtcd(cfg *Config) {
+	hc := cfg.Handler.Cluster
+	if hc == nil || !hc.Etcd || len(hc.EtcdEndpoints) > 0 || cfg.Certs == nil {
+		return
+	}
+	hc.EtcdEndpoints = cfg.Certs.EtcdEndpoints
+}
+
+// purgeEtcd use the etcd of the certificates for the purges if they
+// don't define other endpoints
+func purgeEtcd(cfg *Config) {
+	pc := cfg.Handler.Purge
+	if pc == nil || !pc.Etcd || len(pc.EtcdEndpoints) > 0 || cfg.Certs == nil {
+		return
+	}
+	pc.EtcdEndpoints = cfg.Certs.EtcdEndpoints
+}
+
 func (s *SRV) Reload(cfg *Config) {
 	s.cfg.Reuse = cfg.Reuse
 	s.cfg.Debug = cfg.Debug
+	clusterEtcd(cfg)
+	purgeEtcd(cfg)
 	s.handler.Reload(cfg.Handler)
 	s.certs.Reload(s.cfg.Certs)
 }
@@ -131,7 +167,39 @@ func (s *SRV) runListenTLS(p string, reuse bool) {
 
 }
 
+// runListenInternal serve an internal API, the API of the cluster or
+// the API of the purges
+func (s *SRV) runListenInternal(name, p string, h http.Handler) {
+	ln, err := net.Listen("tcp", p)
+	if err != nil {
+		log.Printf("Error listen %s: %s - %s", name, p, err)
+		return
+	}
+	s.Lock()
+	s.openSockets = append(s.openSockets, ln)
+	s.Unlock()
+	srv := &http.Server{
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+		Handler:           h,
+	}
+	srv.Serve(ln)
+}
+
 func (s *SRV) Listen() {
+	if s.peerListen != "" {
+		log.Printf("httpsrv listen cluster: %s", s.peerListen)
+		go s.runListenInternal("cluster", s.peerListen, s.handler.PeerHandler())
+	}
+	if s.purgeListen != "" {
+		log.Printf("httpsrv listen purge: %s", s.purgeListen)
+		mux := http.NewServeMux()
+		mux.Handle("/purge", s.handler.PurgeHandler())
+		go s.runListenInternal("purge", s.purgeListen, mux)
+	}
+
 	if s.cfg.Reuse {
 		for i := 0; i <= runtime.NumCPU(); i++ {
 			for _, p := range s.cfg.Listen {
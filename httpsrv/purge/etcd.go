@@ -0,0 +1,319 @@
+package purge
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.etcd.io/etcd/clientv3"
+	"go.etcd.io/etcd/mvcc/mvccpb"
+)
+
+const (
+	etcdTimeout     = 2 * time.Second
+	etcdRetry       = 5 * time.Second
+	defaultLeaseTTL = 10
+)
+
+// etcdBus publish the commands in etcd and apply the commands of all
+// the nodes in order. The revision of the command is its sequence, the
+// node catch up the commands after the last applied when it connects.
+//
+// Keys under the prefix:
+//
+//	cmds/<node>/<time>  the commands, removed after the retention
+//	nodes/<node>        the live nodes, with the lease of the session
+//	acks/<node>         the sequence of the last command processed by
+//	                    the node, with the lease of the session
+type etcdBus struct {
+	p       *Purger
+	cli     *clientv3.Client
+	ctx     context.Context
+	cancel  context.CancelFunc
+	done    chan struct{}
+	started bool
+	// Lease of the session, only used by the goroutine of the session
+	lease clientv3.LeaseID
+
+	// Lease of the commands, shared by the commands published in the
+	// same retention window
+	mu       sync.Mutex
+	cmdLease clientv3.LeaseID
+	cmdGrant time.Time
+}
+
+func newEtcdBus(p *Purger) (*etcdBus, error) {
+	cli, err := clientv3.New(clientv3.Config{
+		Endpoints:   p.cfg.EtcdEndpoints,
+		DialTimeout: etcdTimeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	b := &etcdBus{
+		p:    p,
+		cli:  cli,
+		done: make(chan struct{}),
+	}
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+	return b, nil
+}
+
+func (b *etcdBus) prefix(dir string) string {
+	return b.p.cfg.EtcdPrefix + dir + "/"
+}
+
+func (b *etcdBus) nodeKey() string {
+	return b.prefix("nodes") + b.p.cfg.ID
+}
+
+func (b *etcdBus) ackKey() string {
+	return b.prefix("acks") + b.p.cfg.ID
+}
+
+// register the node with a lease that is renewed while the node is alive
+func (b *etcdBus) register() (<-chan *clientv3.LeaseKeepAliveResponse, error) {
+	ctx, cancel := context.WithTimeout(b.ctx, etcdTimeout)
+	defer cancel()
+
+	lease, err := b.cli.Grant(ctx, defaultLeaseTTL)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := b.cli.Put(ctx, b.nodeKey(), b.p.cfg.ID, clientv3.WithLease(lease.ID)); err != nil {
+		return nil, err
+	}
+	b.lease = lease.ID
+	return b.cli.KeepAlive(b.ctx, lease.ID)
+}
+
+// catchUp apply the commands published after the last applied and
+// return the revision to watch the new commands
+func (b *etcdBus) catchUp() (int64, error) {
+	ctx, cancel := context.WithTimeout(b.ctx, etcdTimeout)
+	defer cancel()
+
+	opts := []clientv3.OpOption{
+		clientv3.WithPrefix(),
+		clientv3.WithSort(clientv3.SortByModRevision, clientv3.SortAscend),
+	}
+	if applied := b.p.store.Applied(); applied > 0 {
+		opts = append(opts, clientv3.WithMinModRev(applied+1))
+	}
+	resp, err := b.cli.Get(ctx, b.prefix("cmds"), opts...)
+	if err != nil {
+		return 0, err
+	}
+	for _, kv := range resp.Kvs {
+		if err := b.apply(kv); err != nil {
+			return 0, err
+		}
+	}
+	return resp.Header.Revision, nil
+}
+
+// apply the command once and acknowledge it. The invalid commands are
+// skipped, the others are applied again in the next session if they fail.
+func (b *etcdBus) apply(kv *mvccpb.KeyValue) error {
+	seq := kv.ModRevision
+	if seq > b.p.store.Applied() {
+		var cmd Command
+		err := json.Unmarshal(kv.Value, &cmd)
+		if err == nil {
+			err = cmd.Validate()
+		}
+		if err != nil {
+			log.Printf("httpsrv/purge/etcd ERROR %s: %s", kv.Key, err)
+		} else {
+			cmd.Seq = seq
+			if err := b.p.store.Apply(cmd); err != nil {
+				return fmt.Errorf("%s: %w", kv.Key, err)
+			}
+		}
+	}
+	return b.ack(seq)
+}
+
+// ack the commands until the sequence, they are applied in order
+func (b *etcdBus) ack(seq int64) error {
+	ctx, cancel := context.WithTimeout(b.ctx, etcdTimeout)
+	defer cancel()
+
+	_, err := b.cli.Put(ctx, b.ackKey(), strconv.FormatInt(seq, 10), clientv3.WithLease(b.lease))
+	return err
+}
+
+func (b *etcdBus) start() {
+	b.started = true
+	go b.run()
+}
+
+func (b *etcdBus) run() {
+	defer close(b.done)
+	for {
+		if err := b.session(); err != nil {
+			log.Printf("httpsrv/purge/etcd ERROR: %s", err)
+		}
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-time.After(etcdRetry):
+		}
+	}
+}
+
+// session register the node and apply the commands until the lease
+// or the watch fails
+func (b *etcdBus) session() error {
+	keepAlive, err := b.register()
+	if err != nil {
+		return err
+	}
+	rev, err := b.catchUp()
+	if err != nil {
+		return err
+	}
+
+	// The compacted watch fails and the next session catch up again
+	watch := b.cli.Watch(b.ctx, b.prefix("cmds"), clientv3.WithPrefix(), clientv3.WithRev(rev+1))
+	for {
+		select {
+		case <-b.ctx.Done():
+			return nil
+		case _, ok := <-keepAlive:
+			if !ok {
+				return nil
+			}
+		case resp, ok := <-watch:
+			if !ok {
+				return resp.Err()
+			}
+			if err := resp.Err(); err != nil {
+				return err
+			}
+			for _, ev := range resp.Events {
+				if ev.Type != clientv3.EventTypePut {
+					continue
+				}
+				if err := b.apply(ev.Kv); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// publish the command and wait until all the live nodes apply it
+func (b *etcdBus) publish(ctx context.Context, cmd Command) error {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, b.p.cfg.ackTimeout)
+	defer cancel()
+
+	lease, err := b.commandLease(ctx)
+	if err != nil {
+		return err
+	}
+	key := b.prefix("cmds") + b.p.cfg.ID + "/" + strconv.FormatInt(cmd.Time.UnixNano(), 10)
+	resp, err := b.cli.Put(ctx, key, string(data), clientv3.WithLease(lease))
+	if err != nil {
+		return err
+	}
+	return b.wait(ctx, resp.Header.Revision)
+}
+
+// commandLease return the lease of the commands. The lease last two
+// retention periods and it is rotated after one, so the commands are
+// kept at least the retention with one lease per window.
+func (b *etcdBus) commandLease(ctx context.Context) (clientv3.LeaseID, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.cmdLease != clientv3.NoLease && time.Since(b.cmdGrant) < b.p.cfg.retention {
+		return b.cmdLease, nil
+	}
+	now := time.Now()
+	lease, err := b.cli.Grant(ctx, int64(2*b.p.cfg.retention.Seconds()))
+	if err != nil {
+		return clientv3.NoLease, err
+	}
+	b.cmdLease, b.cmdGrant = lease.ID, now
+	return b.cmdLease, nil
+}
+
+// wait until all the live nodes acknowledge the command, the list of
+// nodes is checked again when a node or an ack change
+func (b *etcdBus) wait(ctx context.Context, seq int64) error {
+	watch := b.cli.Watch(ctx, b.p.cfg.EtcdPrefix, clientv3.WithPrefix(), clientv3.WithRev(seq))
+	for {
+		missing, err := b.missing(ctx, seq)
+		if err == nil && len(missing) == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			if err != nil {
+				return err
+			}
+			return fmt.Errorf("%w: %s", ErrNotAcknowledged, strings.Join(missing, ", "))
+		case _, ok := <-watch:
+			if !ok {
+				watch = nil
+			}
+		}
+	}
+}
+
+// missing return the live nodes that didn't acknowledge the command
+func (b *etcdBus) missing(ctx context.Context, seq int64) ([]string, error) {
+	nodes, err := b.cli.Get(ctx, b.prefix("nodes"), clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return nil, err
+	}
+	acks, err := b.cli.Get(ctx, b.prefix("acks"), clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	acked := make(map[string]bool, len(acks.Kvs))
+	for _, kv := range acks.Kvs {
+		if v, err := strconv.ParseInt(string(kv.Value), 10, 64); err == nil && v >= seq {
+			acked[strings.TrimPrefix(string(kv.Key), b.prefix("acks"))] = true
+		}
+	}
+	var missing []string
+	for _, kv := range nodes.Kvs {
+		if id := strings.TrimPrefix(string(kv.Key), b.prefix("nodes")); !acked[id] {
+			missing = append(missing, id)
+		}
+	}
+	sort.Strings(missing)
+	return missing, nil
+}
+
+func (b *etcdBus) stop() {
+	b.cancel()
+	if b.started {
+		<-b.done
+	}
+
+	// The publishers don't wait for this node until the lease expires,
+	// the revoke remove the node and its ack
+	ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+	if b.lease != clientv3.NoLease {
+		b.cli.Revoke(ctx, b.lease)
+	}
+	cancel()
+	b.cli.Close()
+}
@@ -0,0 +1,206 @@
+package purge
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/clientv3"
+	"go.etcd.io/etcd/integration"
+)
+
+type testStore struct {
+	mu   sync.Mutex
+	seq  int64
+	cmds []Command
+}
+
+func (s *testStore) Apply(cmd Command) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cmd.Seq > 0 {
+		if cmd.Seq <= s.seq {
+			return nil
+		}
+		s.seq = cmd.Seq
+	}
+	s.cmds = append(s.cmds, cmd)
+	return nil
+}
+
+func (s *testStore) Applied() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.seq
+}
+
+func (s *testStore) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.cmds)
+}
+
+func waitApplied(t *testing.T, s *testStore, n int) {
+	deadline := time.Now().Add(10 * time.Second)
+	for s.len() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d commands applied: %d", n, s.len())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPurgeLocal(t *testing.T) {
+	s := &testStore{}
+	p, err := New(&Config{}, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Start()
+	defer p.Stop()
+
+	if err := p.Publish(context.Background(), Command{Type: "refresh"}); err != ErrUnknownType {
+		t.Errorf("Expected ErrUnknownType: %v", err)
+	}
+	if err := p.Publish(context.Background(), Command{Type: TypeTag}); err != ErrEmptyCommand {
+		t.Errorf("Expected ErrEmptyCommand: %v", err)
+	}
+	if err := p.Publish(context.Background(), Command{Type: TypeTag, Tags: []string{"a"}}); err != nil {
+		t.Fatal(err)
+	}
+	if s.len() != 1 || s.cmds[0].Seq != 0 || s.cmds[0].Time.IsZero() {
+		t.Errorf("Invalid local command: %+v", s.cmds)
+	}
+}
+
+func TestPurgeEtcd(t *testing.T) {
+	clus := integration.NewClusterV3(t, &integration.ClusterConfig{Size: 1})
+	defer clus.Terminate(t)
+
+	newNode := func(id string, s *testStore) *Purger {
+		p, err := New(&Config{
+			ID:            id,
+			Etcd:          true,
+			EtcdEndpoints: []string{clus.Members[0].GRPCAddr()},
+			AckTimeout:    "3s",
+		}, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.Start()
+		return p
+	}
+
+	sa, sb := &testStore{}, &testStore{}
+	a := newNode("a", sa)
+	defer a.Stop()
+	b := newNode("b", sb)
+
+	// Wait the registration of the nodes
+	cli := clus.RandClient()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		resp, err := cli.Get(context.Background(), defaultEtcdPrefix+"nodes/", clientv3.WithPrefix())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Count == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("The nodes are not registered: %d", resp.Count)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The publish return when all the nodes applied the command
+	if err := b.Publish(context.Background(), Command{Type: TypePurge, Host: "www.example.com", URL: "/a"}); err != nil {
+		t.Fatal(err)
+	}
+	if sa.len() != 1 || sb.len() != 1 {
+		t.Fatalf("The command was not applied in all the nodes: %d %d", sa.len(), sb.len())
+	}
+	if sa.Applied() != sb.Applied() || sa.cmds[0].URL != "/a" {
+		t.Errorf("Invalid sequence: %d %d", sa.Applied(), sb.Applied())
+	}
+
+	// The acks use the lease of the nodes, the commands of the window
+	// share one lease
+	if err := b.Publish(context.Background(), Command{Type: TypePurge, Host: "www.example.com", URL: "/b"}); err != nil {
+		t.Fatal(err)
+	}
+	leases, err := cli.Leases(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leases.Leases) != 3 {
+		t.Errorf("Expected the leases of the nodes and the commands: %d", len(leases.Leases))
+	}
+
+	// The offline node catch up when it connects again
+	b.Stop()
+	if err := a.Publish(context.Background(), Command{Type: TypeTag, Tags: []string{"x"}}); err != nil {
+		t.Fatal(err)
+	}
+	b = newNode("b", sb)
+	defer b.Stop()
+	waitApplied(t, sb, 3)
+	if sb.cmds[2].Tags[0] != "x" || sb.Applied() != sa.Applied() {
+		t.Errorf("Invalid command after catch up: %+v", sb.cmds[2])
+	}
+}
+
+func TestPurgeStopNotStarted(t *testing.T) {
+	clus := integration.NewClusterV3(t, &integration.ClusterConfig{Size: 1})
+	defer clus.Terminate(t)
+
+	p, err := New(&Config{
+		ID:            "a",
+		Etcd:          true,
+		EtcdEndpoints: []string{clus.Members[0].GRPCAddr()},
+	}, &testStore{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		p.Stop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop blocked without Start")
+	}
+}
+
+func TestPurgeNotAcknowledged(t *testing.T) {
+	clus := integration.NewClusterV3(t, &integration.ClusterConfig{Size: 1})
+	defer clus.Terminate(t)
+
+	p, err := New(&Config{
+		ID:            "a",
+		Etcd:          true,
+		EtcdEndpoints: []string{clus.Members[0].GRPCAddr()},
+		AckTimeout:    "500ms",
+	}, &testStore{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Start()
+	defer p.Stop()
+
+	// A live node that never apply the commands
+	cli := clus.RandClient()
+	if _, err := cli.Put(context.Background(), defaultEtcdPrefix+"nodes/dead", "dead"); err != nil {
+		t.Fatal(err)
+	}
+
+	err = p.Publish(context.Background(), Command{Type: TypeTag, Tags: []string{"x"}})
+	if !errors.Is(err, ErrNotAcknowledged) {
+		t.Errorf("Expected ErrNotAcknowledged: %v", err)
+	}
+}
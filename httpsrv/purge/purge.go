@@ -0,0 +1,211 @@
+package purge
+
+import (
+	"context"
+	"errors"
+	"os"
+	"regexp"
+	"time"
+)
+
+// Types of the commands
+const (
+	TypePurge = "purge"
+	TypeBan   = "ban"
+	TypeTag   = "tag"
+)
+
+const (
+	defaultEtcdPrefix    = "/elinproxy/purge/"
+	defaultEtcdEndpoints = "http://localhost:2379"
+	defaultRetention     = 24 * time.Hour
+	defaultAckTimeout    = 5 * time.Second
+	defaultTagHeader     = "Cache-Tag"
+)
+
+var (
+	// ErrUnknownType is returned when the type of the command is not valid
+	ErrUnknownType = errors.New("Unknown type of purge")
+	// ErrEmptyCommand is returned when the command don't define what to remove
+	ErrEmptyCommand = errors.New("The purge don't define the objects to remove")
+	// ErrNotAcknowledged is returned when some live nodes didn't apply
+	// the command before the timeout
+	ErrNotAcknowledged = errors.New("The purge was not acknowledged by all the nodes")
+)
+
+// Command remove objects from the cache. Only the objects fetched
+// before the Time of the command are removed, so apply the same
+// command again don't remove the new copies.
+type Command struct {
+	// Sequence of the command, the revision in etcd. Zero for the
+	// commands applied only in this node.
+	Seq  int64 `json:"-"`
+	Type string
+	Host string
+	// Path and query of the purged object
+	URL string
+	// Regular expression of the path and query of the banned objects
+	Pattern string
+	// Tags of the objects in the TagHeader of the responses
+	Tags []string
+	Time time.Time
+}
+
+// Validate return an error if the command can't be applied
+func (cmd *Command) Validate() error {
+	switch cmd.Type {
+	case TypePurge:
+		if cmd.Host == "" || cmd.URL == "" {
+			return ErrEmptyCommand
+		}
+	case TypeBan:
+		if cmd.Pattern == "" {
+			return ErrEmptyCommand
+		}
+		if _, err := regexp.Compile(cmd.Pattern); err != nil {
+			return err
+		}
+	case TypeTag:
+		if len(cmd.Tags) == 0 {
+			return ErrEmptyCommand
+		}
+	default:
+		return ErrUnknownType
+	}
+	return nil
+}
+
+// Store apply the commands, usually to the cache of the handler
+type Store interface {
+	// Apply the command, the commands with a Seq already applied
+	// should be ignored
+	Apply(cmd Command) error
+	// Applied return the Seq of the last command applied
+	Applied() int64
+}
+
+// Config of the propagation of the purges
+type Config struct {
+	// Name of the node in etcd, the hostname by default
+	ID string
+	// Publish the commands in etcd, all the nodes apply them
+	Etcd          bool
+	EtcdEndpoints []string
+	EtcdPrefix    string
+	// Time that the commands are kept, the nodes that were offline
+	// longer don't apply them. The objects are not stored longer than
+	// the bans and the tags that remove them. 24h by default.
+	Retention string
+	// Time to wait that all the live nodes apply a command, 5s by default
+	AckTimeout string
+	// Response header with the tags of the object, Cache-Tag by default
+	TagHeader string
+	// Address of the API of the purges, it is not served if it is empty.
+	// It should not be public, the changes need a restart.
+	Listen string
+	// Token of the API, the requests should send the header
+	// "Authorization: Bearer <token>" if it is not empty
+	Token string
+
+	retention  time.Duration
+	ackTimeout time.Duration
+}
+
+func (cfg *Config) parse() (err error) {
+	if cfg.ID == "" {
+		cfg.ID, _ = os.Hostname()
+	}
+	if cfg.EtcdPrefix == "" {
+		cfg.EtcdPrefix = defaultEtcdPrefix
+	}
+	if len(cfg.EtcdEndpoints) == 0 {
+		cfg.EtcdEndpoints = []string{defaultEtcdEndpoints}
+	}
+	if cfg.TagHeader == "" {
+		cfg.TagHeader = defaultTagHeader
+	}
+	cfg.retention = defaultRetention
+	if cfg.Retention != "" {
+		if cfg.retention, err = time.ParseDuration(cfg.Retention); err != nil {
+			return err
+		}
+	}
+	cfg.ackTimeout = defaultAckTimeout
+	if cfg.AckTimeout != "" {
+		if cfg.ackTimeout, err = time.ParseDuration(cfg.AckTimeout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Purger publish the commands and apply the commands of the other nodes
+type Purger struct {
+	cfg   *Config
+	store Store
+	etcd  *etcdBus
+}
+
+// New return the purger of the config, the commands published in etcd
+// are applied after Start. Without etcd the commands are only applied
+// in this node.
+func New(cfg *Config, store Store) (*Purger, error) {
+	c := *cfg
+	if err := c.parse(); err != nil {
+		return nil, err
+	}
+
+	p := &Purger{
+		cfg:   &c,
+		store: store,
+	}
+	if c.Etcd {
+		etcd, err := newEtcdBus(p)
+		if err != nil {
+			return nil, err
+		}
+		p.etcd = etcd
+	}
+	return p, nil
+}
+
+// Start to apply the commands of the other nodes
+func (p *Purger) Start() {
+	if p.etcd != nil {
+		p.etcd.start()
+	}
+}
+
+// Retention return the time that the commands are kept
+func (p *Purger) Retention() time.Duration {
+	return p.cfg.retention
+}
+
+// TagHeader return the response header with the tags of the objects
+func (p *Purger) TagHeader() string {
+	return p.cfg.TagHeader
+}
+
+// Publish apply the command in all the nodes. With etcd it return
+// when all the live nodes applied the command, or ErrNotAcknowledged.
+func (p *Purger) Publish(ctx context.Context, cmd Command) error {
+	if err := cmd.Validate(); err != nil {
+		return err
+	}
+	if cmd.Time.IsZero() {
+		cmd.Time = time.Now()
+	}
+	cmd.Seq = 0
+
+	if p.etcd == nil {
+		return p.store.Apply(cmd)
+	}
+	return p.etcd.publish(ctx, cmd)
+}
+
+// Stop apply the commands of the other nodes
+func (p *Purger) Stop() {
+	if p.etcd != nil {
+		p.etcd.stop()
+	}
+}
@@ -8,4 +8,5 @@ type Config struct {
 	Dir             string
 	ExtraTTLString  string
 	ExtraTTL        time.Duration
+	MaxVariants     int
 }
@@ -5,6 +5,7 @@ import (
 	"io"
 	"net/http"
 	"sync"
+	"time"
 )
 
 var (
@@ -19,6 +20,8 @@ type Item interface {
 	ValidRange(reqStart, reqEnd int64) (from, to, length int64, err error)
 	Bytes() []byte
 	GetHIT() uint64
+	Stale() bool
+	GetFetchedAt() time.Time
 	Len() int
 	GetStatusCode() int
 	GetHeader() http.Header
@@ -65,8 +68,11 @@ func putItemMem(itm *ItemMem) {
 		delete(itm.Header, k)
 	}
 	itm.Key = 0
+	itm.Check = 0
 	itm.Data = itm.Data[:0]
 	itm.HIT = 0
+	itm.StaleAt = 0
+	itm.FetchedAt = 0
 	itm.StatusCode = 0
 	itm.inUse = 0
 	itm.Close()
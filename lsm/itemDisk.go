@@ -9,6 +9,7 @@ import (
 	"net/textproto"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 const (
@@ -32,8 +33,11 @@ func getItemDisk() *ItemDisk {
 func putItemDisk(v *ItemDisk) {
 	v.BodySize = 0
 	v.HIT = 0
+	v.StaleAt = 0
+	v.FetchedAt = 0
 	v.HeadSize = 0
 	v.Key = 0
+	v.Check = 0
 	v.Off = 0
 	v.StatusCode = 0
 	v.VFile = nil
@@ -45,12 +49,15 @@ func putItemDisk(v *ItemDisk) {
 // file where is stored and also the possition in the file for each element
 type ItemDisk struct {
 	Key        uint64
+	Check      uint64
 	StatusCode int
 	VFile      *VFile
 	Off        int64
 	HeadSize   int64
 	BodySize   int64
 	HIT        uint64
+	StaleAt    int64
+	FetchedAt  int64
 	inUse      int64
 }
 
@@ -192,6 +199,16 @@ func (itd *ItemDisk) Bytes() []byte {
 	return b.Bytes()
 }
 
+// Stale return true if the item is in the grace period
+func (itd *ItemDisk) Stale() bool {
+	return itd.StaleAt > 0 && time.Now().UnixNano() > itd.StaleAt
+}
+
+// GetFetchedAt return the time when the item was received from the backend
+func (itd *ItemDisk) GetFetchedAt() time.Time {
+	return time.Unix(0, itd.FetchedAt)
+}
+
 // GetHIT will return the total hits accumulated by this item
 func (itd *ItemDisk) GetHIT() uint64 {
 	return atomic.LoadUint64(&itd.HIT)
@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"os"
 	"sync/atomic"
+	"time"
 )
 
 // ItemMem is the struct that store all the information related
@@ -14,10 +15,13 @@ import (
 // a temporary file that is also defined in the struct
 type ItemMem struct {
 	Key        uint64
+	Check      uint64
 	StatusCode int
 	Header     http.Header
 	Data       []byte
 	HIT        uint64
+	StaleAt    int64
+	FetchedAt  int64
 	inUse      int64
 	written    int64
 	w          *os.File
@@ -185,6 +189,17 @@ func (itm *ItemMem) Bytes() []byte {
 	return b
 }
 
+// Stale return true if the item is in the grace period, it can be
+// served while a fresh copy is requested to the backend
+func (itm *ItemMem) Stale() bool {
+	return itm.StaleAt > 0 && time.Now().UnixNano() > itm.StaleAt
+}
+
+// GetFetchedAt return the time when the item was received from the backend
+func (itm *ItemMem) GetFetchedAt() time.Time {
+	return time.Unix(0, itm.FetchedAt)
+}
+
 // GetHIT will return the total hits accumulated by this item
 func (itm *ItemMem) GetHIT() uint64 {
 	return atomic.LoadUint64(&itm.HIT)
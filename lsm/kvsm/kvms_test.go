@@ -116,3 +116,23 @@ func BenchmarkKVSMDelete(b *testing.B) {
 		}
 	})
 }
+
+func TestKVSMRemoveReplacedEntry(t *testing.T) {
+	kv := New()
+	k := xxhash.Sum64String("replaced")
+	kv.Set(k, "old", 1*time.Second)
+	kv.Set(k, "new", 10*time.Second)
+
+	// The expiration of the old entry don't remove the new one
+	deadline := time.Now().Add(5 * time.Second)
+	for kv.Len() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("The old entry should expire: %d", kv.Len())
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	v, _, ok := kv.Get(k)
+	if !ok || v.(string) != "new" {
+		t.Errorf("The new entry should be kept: %v %v", v, ok)
+	}
+}
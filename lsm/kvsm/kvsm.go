@@ -91,7 +91,10 @@ func (kv *KVSM) Swap(k uint64, v interface{}, ttl time.Duration) bool {
 }
 
 func (kv *KVSM) Remove(e *entry) {
-	kv.items.Delete(e.key)
+	// The key could be stored again with a new entry
+	if cur, ok := kv.items.Load(e.key); ok && cur == e {
+		kv.items.Delete(e.key)
+	}
 	atomic.AddInt64(&kv.n, -1)
 	kv.eviction(e)
 }
@@ -2,6 +2,7 @@ package lsm
 
 import (
 	"errors"
+	"hash/fnv"
 	"log"
 	"os"
 	"path/filepath"
@@ -18,6 +19,8 @@ const (
 
 var (
 	ErrItemNotFound = errors.New("Item not found")
+	// ErrKeyCollision is returned when the item of the key belongs to other key
+	ErrKeyCollision = errors.New("Item with a different key check")
 )
 
 type EvictFunc func(key interface{}, value interface{})
@@ -27,6 +30,7 @@ type LSM struct {
 	cfg             *Config
 	vlog            *VLog
 	mem             *kvsm.KVSM
+	variants        sync.Map
 	retryEvictionCh chan interface{}
 }
 
@@ -39,6 +43,7 @@ func New(cfg *Config) *LSM {
 	*c.cfg = *cfg
 
 	go c.retryEviction()
+	go c.sweepVariants()
 
 	RemoveContents(c.cfg.Dir)
 
@@ -107,24 +112,59 @@ func (c *LSM) Set(key uint64, itm *ItemMem, ttl time.Duration) {
 	}
 }
 
-func (c *LSM) Get(key uint64) (Item, bool, error) {
+// KeyCheck return a second hash of the key, independent of the hash used
+// to address the items, to detect the collisions
+func KeyCheck(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// Get return the item of the key. The check of the item should be the same
+// than the check of the request, if not the item is from other key and
+// ErrKeyCollision is returned. Zero check skip the verification.
+func (c *LSM) Get(key, check uint64) (Item, bool, error) {
+	return c.get(key, check, true)
+}
+
+// Peek return the item of the key like Get but the lookup is not
+// counted as a hit of the item
+func (c *LSM) Peek(key, check uint64) (Item, bool, error) {
+	return c.get(key, check, false)
+}
+
+func (c *LSM) get(key, check uint64, hit bool) (Item, bool, error) {
 	if x, expired, ok := c.mem.Get(key); ok {
 		switch item := x.(type) {
 		case *ItemMem:
+			if check != 0 && item.Check != check {
+				keyCollisions.Inc()
+				return nil, false, ErrKeyCollision
+			}
 			atomic.AddInt64(&item.inUse, 1)
-			atomic.AddUint64(&item.HIT, 1)
+			if hit {
+				atomic.AddUint64(&item.HIT, 1)
+			}
 			return item, expired, nil
 		case *ItemDisk:
+			if check != 0 && item.Check != check {
+				keyCollisions.Inc()
+				return nil, false, ErrKeyCollision
+			}
 			atomic.AddInt64(&item.inUse, 1)
-			atomic.AddUint64(&item.HIT, 1)
+			if hit {
+				atomic.AddUint64(&item.HIT, 1)
+			}
 			return item, expired, nil
 		}
 	}
 	return nil, false, ErrItemNotFound
 }
 
+// Delete remove the key and all the variants stored under the same key
 func (c *LSM) Delete(key uint64) {
 	c.mem.RemoveByKey(key)
+	c.deleteVariants(key)
 }
 
 func RemoveContents(dir string) error {
@@ -62,6 +62,7 @@ func TestMultipleReaders(t *testing.T) {
 				key := fmt.Sprintf("key+%09d", i)
 				itm := l.NewItem(0)
 				itm.Key = xxhash.Sum64String(key)
+				itm.Check = KeyCheck(key)
 				itm.StatusCode = 200
 				itm.Header = http.Header{
 					"Content-Type": []string{"text/plain"},
@@ -85,7 +86,7 @@ func TestMultipleReaders(t *testing.T) {
 			buf := bytes.NewBuffer(make([]byte, 0))
 
 			key := fmt.Sprintf("key+%09d", i%10)
-			item, _, err := l.Get(xxhash.Sum64String(key))
+			item, _, err := l.Get(xxhash.Sum64String(key), KeyCheck(key))
 			if err != nil {
 				t.Fatalf("Error key %s: %s - %v", key, err, item)
 			}
@@ -140,3 +141,57 @@ func BenchmarkLsmWrite(b *testing.B) {
 		}
 	})
 }
+
+func TestGetKeyCollision(t *testing.T) {
+	l := New(&Config{
+		Dir:       os.TempDir(),
+		MinLSMTTL: time.Hour,
+	})
+
+	itm := l.NewItem(0)
+	itm.Key = xxhash.Sum64String("key-a")
+	itm.Check = KeyCheck("key-a")
+	itm.StatusCode = http.StatusOK
+	l.Set(itm.Key, itm, time.Minute)
+
+	item, _, err := l.Get(itm.Key, KeyCheck("key-a"))
+	if err != nil {
+		t.Fatalf("Get: %s", err)
+	}
+	item.Done()
+
+	// Other key with the same hash
+	if _, _, err := l.Get(itm.Key, KeyCheck("key-b")); err != ErrKeyCollision {
+		t.Errorf("Expected ErrKeyCollision: %v", err)
+	}
+}
+
+func TestPeekNotHit(t *testing.T) {
+	l := New(&Config{
+		Dir:       os.TempDir(),
+		MinLSMTTL: time.Hour,
+	})
+
+	itm := l.NewItem(0)
+	itm.Key = xxhash.Sum64String("key-peek")
+	itm.StatusCode = http.StatusOK
+	l.Set(itm.Key, itm, time.Minute)
+
+	item, _, err := l.Peek(itm.Key, 0)
+	if err != nil {
+		t.Fatalf("Peek: %s", err)
+	}
+	item.Done()
+	if hits := item.GetHIT(); hits != 0 {
+		t.Errorf("Peek should not count hits: %d", hits)
+	}
+
+	item, _, err = l.Get(itm.Key, 0)
+	if err != nil {
+		t.Fatalf("Get: %s", err)
+	}
+	item.Done()
+	if hits := item.GetHIT(); hits != 1 {
+		t.Errorf("Get should count one hit: %d", hits)
+	}
+}
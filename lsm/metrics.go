@@ -0,0 +1,27 @@
+package lsm
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	metricKeyCollisions   = "key_collisions"
+	metricTooManyVariants = "too_many_variants"
+)
+
+var (
+	keyCollisions = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "elinproxy",
+		Subsystem: "lsm",
+		Name:      metricKeyCollisions,
+		Help:      "Items found with the same key but a different check",
+	})
+
+	tooManyVariants = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "elinproxy",
+		Subsystem: "lsm",
+		Name:      metricTooManyVariants,
+		Help:      "Responses not stored because the key already have MaxVariants",
+	})
+)
@@ -0,0 +1,239 @@
+package lsm
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash"
+)
+
+const (
+	defaultMaxVariants  = 32
+	varySweeperInterval = 1 * time.Minute
+	varyKeySeparator    = "\x00"
+	varySeparator       = ","
+	varyAll             = "*"
+)
+
+var (
+	// ErrVaryAll is returned when the response have "Vary: *", that
+	// response can't be served from a shared cache
+	ErrVaryAll = errors.New("Vary: * is not cachable")
+	// ErrTooManyVariants is returned when the base key already have
+	// the max number of variants defined in the config
+	ErrTooManyVariants = errors.New("Too many variants for the same key")
+)
+
+// varyIndex store the list of headers defined in the Vary header of
+// the response and all the variant keys stored under the same base key
+type varyIndex struct {
+	mu       sync.Mutex
+	headers  []string
+	variants map[uint64]int64
+}
+
+// ParseVary will return the canonical header names, sorted and without
+// duplicates, of the values of a Vary header
+func ParseVary(values []string) ([]string, error) {
+	seen := make(map[string]bool)
+	headers := make([]string, 0)
+	for _, v := range values {
+		for _, h := range strings.Split(v, varySeparator) {
+			h = strings.TrimSpace(h)
+			if h == "" {
+				continue
+			}
+			if h == varyAll {
+				return nil, ErrVaryAll
+			}
+			h = http.CanonicalHeaderKey(h)
+			if seen[h] {
+				continue
+			}
+			seen[h] = true
+			headers = append(headers, h)
+		}
+	}
+	if len(headers) == 0 {
+		return nil, nil
+	}
+	sort.Strings(headers)
+	return headers, nil
+}
+
+// normalizeVaryValue lower case the values of the header and sort
+// the elements, so "gzip, br" and "br,gzip" are the same variant
+func normalizeVaryValue(values []string) string {
+	elems := make([]string, 0, len(values))
+	for _, v := range values {
+		for _, e := range strings.Split(v, varySeparator) {
+			e = strings.ToLower(strings.TrimSpace(e))
+			if e == "" {
+				continue
+			}
+			elems = append(elems, e)
+		}
+	}
+	sort.Strings(elems)
+	return strings.Join(elems, varySeparator)
+}
+
+// variantKey calculate the key of the variant based in the base key
+// and the normalized values of the request headers
+func variantKey(base uint64, headers []string, h http.Header) uint64 {
+	var b strings.Builder
+	b.WriteString(strconv.FormatUint(base, 10))
+	for _, k := range headers {
+		b.WriteString(varyKeySeparator)
+		b.WriteString(k)
+		b.WriteString(varyKeySeparator)
+		b.WriteString(normalizeVaryValue(h[k]))
+	}
+	return xxhash.Sum64String(b.String())
+}
+
+func sameHeaders(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// VariantKey return the key of the variant that match with the request
+// headers. If the base key don't have variants return the base key.
+func (c *LSM) VariantKey(base uint64, h http.Header) uint64 {
+	x, ok := c.variants.Load(base)
+	if !ok {
+		return base
+	}
+	vi := x.(*varyIndex)
+	vi.mu.Lock()
+	headers := vi.headers
+	vi.mu.Unlock()
+	if len(headers) == 0 {
+		return base
+	}
+	return variantKey(base, headers, h)
+}
+
+// SetVariant register the variant for the request headers under the base
+// key and return the key that should be used to store the item. If the
+// list of headers changed, the previous variants are removed.
+func (c *LSM) SetVariant(base uint64, vary []string, h http.Header, ttl time.Duration) (uint64, error) {
+	if len(vary) == 0 {
+		// The response don't vary anymore, the lookups should use the base key
+		c.resetVariants(base)
+		return base, nil
+	}
+
+	c.mu.Lock()
+	max := c.cfg.MaxVariants
+	c.mu.Unlock()
+	if max <= 0 {
+		max = defaultMaxVariants
+	}
+
+	x, _ := c.variants.LoadOrStore(base, &varyIndex{
+		headers:  vary,
+		variants: make(map[uint64]int64),
+	})
+	vi := x.(*varyIndex)
+
+	vi.mu.Lock()
+	defer vi.mu.Unlock()
+
+	if !sameHeaders(vi.headers, vary) {
+		for k := range vi.variants {
+			c.mem.RemoveByKey(k)
+		}
+		vi.headers = vary
+		vi.variants = make(map[uint64]int64)
+	}
+
+	key := variantKey(base, vi.headers, h)
+	if _, ok := vi.variants[key]; !ok && len(vi.variants) >= max {
+		tooManyVariants.Inc()
+		return 0, ErrTooManyVariants
+	}
+	vi.variants[key] = time.Now().Add(ttl).UnixNano()
+	return key, nil
+}
+
+// resetVariants remove the index of the base key if it has the variants
+// of a previous response with Vary
+func (c *LSM) resetVariants(base uint64) {
+	x, ok := c.variants.Load(base)
+	if !ok {
+		return
+	}
+	vi := x.(*varyIndex)
+	vi.mu.Lock()
+	headers := vi.headers
+	vi.mu.Unlock()
+	if len(headers) > 0 {
+		c.deleteVariants(base)
+	}
+}
+
+// Link register the key under the base key, so it will be removed when
+// the base key is deleted. The linked keys are not limited by MaxVariants.
+func (c *LSM) Link(base, key uint64, ttl time.Duration) {
+	x, _ := c.variants.LoadOrStore(base, &varyIndex{
+		variants: make(map[uint64]int64),
+	})
+	vi := x.(*varyIndex)
+	vi.mu.Lock()
+	vi.variants[key] = time.Now().Add(ttl).UnixNano()
+	vi.mu.Unlock()
+}
+
+// deleteVariants remove from the memory all the variants of the base key
+func (c *LSM) deleteVariants(base uint64) {
+	x, ok := c.variants.Load(base)
+	if !ok {
+		return
+	}
+	c.variants.Delete(base)
+
+	vi := x.(*varyIndex)
+	vi.mu.Lock()
+	for k := range vi.variants {
+		c.mem.RemoveByKey(k)
+	}
+	vi.mu.Unlock()
+}
+
+// sweepVariants remove the expired variants from the index and the
+// index of the keys without variants
+func (c *LSM) sweepVariants() {
+	t := time.NewTicker(varySweeperInterval)
+	defer t.Stop()
+	for range t.C {
+		now := time.Now().UnixNano()
+		c.variants.Range(func(k, x interface{}) bool {
+			vi := x.(*varyIndex)
+			vi.mu.Lock()
+			for vk, expireAt := range vi.variants {
+				if expireAt < now {
+					delete(vi.variants, vk)
+				}
+			}
+			empty := len(vi.variants) == 0
+			vi.mu.Unlock()
+			if empty {
+				c.variants.Delete(k)
+			}
+			return true
+		})
+	}
+}
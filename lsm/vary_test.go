@@ -0,0 +1,125 @@
+package lsm
+
+import (
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cespare/xxhash"
+)
+
+func TestParseVary(t *testing.T) {
+	headers, err := ParseVary([]string{"accept-language, Accept-Encoding", "Accept-Language"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(headers) != 2 || headers[0] != "Accept-Encoding" || headers[1] != "Accept-Language" {
+		t.Errorf("Invalid headers: %v", headers)
+	}
+
+	if _, err := ParseVary([]string{"Accept-Encoding, *"}); err != ErrVaryAll {
+		t.Errorf("Vary: * should return ErrVaryAll: %v", err)
+	}
+
+	if headers, _ := ParseVary(nil); headers != nil {
+		t.Errorf("Empty vary should return nil: %v", headers)
+	}
+}
+
+func TestVariantKeyNormalized(t *testing.T) {
+	base := xxhash.Sum64String("key+variant")
+	vary := []string{"Accept-Language"}
+
+	a := variantKey(base, vary, http.Header{"Accept-Language": []string{"ES, en"}})
+	b := variantKey(base, vary, http.Header{"Accept-Language": []string{"en,es"}})
+	if a != b {
+		t.Errorf("Same values in different order should be the same variant: %d/%d", a, b)
+	}
+
+	c := variantKey(base, vary, http.Header{"Accept-Language": []string{"fr"}})
+	if a == c {
+		t.Errorf("Different values should be different variants: %d/%d", a, c)
+	}
+}
+
+func TestSetVariantAndDelete(t *testing.T) {
+	ttl := 1 * time.Minute
+	l := New(&Config{
+		Dir:         os.TempDir(),
+		MinLSMTTL:   ttl,
+		MaxVariants: 2,
+	})
+
+	base := xxhash.Sum64String("key+variants")
+	vary := []string{"Accept-Language"}
+
+	es := http.Header{"Accept-Language": []string{"es"}}
+	en := http.Header{"Accept-Language": []string{"en"}}
+	fr := http.Header{"Accept-Language": []string{"fr"}}
+
+	if l.VariantKey(base, es) != base {
+		t.Errorf("Without variants the key should be the base key")
+	}
+
+	for _, h := range []http.Header{es, en} {
+		key, err := l.SetVariant(base, vary, h, ttl)
+		if err != nil {
+			t.Fatalf("SetVariant: %s", err)
+		}
+		if key != l.VariantKey(base, h) {
+			t.Errorf("The lookup key don't match with the stored key")
+		}
+		itm := l.NewItem(0)
+		itm.Key = key
+		itm.StatusCode = http.StatusOK
+		l.Set(key, itm, ttl)
+	}
+
+	if _, err := l.SetVariant(base, vary, fr, ttl); err != ErrTooManyVariants {
+		t.Errorf("Expected ErrTooManyVariants: %v", err)
+	}
+
+	l.Delete(base)
+	for _, h := range []http.Header{es, en} {
+		if _, _, err := l.Get(variantKey(base, vary, h), 0); err == nil {
+			t.Errorf("The variant should be deleted: %v", h)
+		}
+	}
+	if l.VariantKey(base, es) != base {
+		t.Errorf("The variants index should be deleted")
+	}
+}
+
+func TestSetVariantWithoutVary(t *testing.T) {
+	ttl := 1 * time.Minute
+	l := New(&Config{
+		Dir:       os.TempDir(),
+		MinLSMTTL: ttl,
+	})
+
+	base := xxhash.Sum64String("key+vary-removed")
+	vary := []string{"Accept-Language"}
+	es := http.Header{"Accept-Language": []string{"es"}}
+
+	key, err := l.SetVariant(base, vary, es, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	itm := l.NewItem(0)
+	itm.Key = key
+	itm.StatusCode = http.StatusOK
+	l.Set(key, itm, ttl)
+
+	// The origin answer now without Vary
+	key, err = l.SetVariant(base, nil, es, ttl)
+	if err != nil || key != base {
+		t.Fatalf("The response without Vary should use the base key: %d %v", key, err)
+	}
+	if l.VariantKey(base, es) != base {
+		t.Errorf("The lookups should use the base key after the response without Vary")
+	}
+	if _, _, err := l.Get(variantKey(base, vary, es), 0); err == nil {
+		t.Errorf("The old variant should be deleted")
+	}
+}
@@ -110,12 +110,15 @@ func (vl *VLog) transform(w *VFile, itm *ItemMem) (*ItemDisk, error) {
 
 	itd := getItemDisk()
 	itd.Key = itm.Key
+	itd.Check = itm.Check
 	itd.StatusCode = itm.StatusCode
 	itd.Off = w.Seek()
 	itd.HeadSize = 0
 	itd.BodySize = 0
 	itd.VFile = w
 	itd.HIT = atomic.LoadUint64(&itm.HIT)
+	itd.StaleAt = itm.StaleAt
+	itd.FetchedAt = itm.FetchedAt
 
 	if err := itm.Header.Write(w); err != nil {
 		log.Printf("ERROR lsm/vlog write header: %v", err)
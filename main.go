@@ -3,6 +3,7 @@ package main
 import (
 	"flag"
 	"log"
+	"os"
 	"time"
 
 	"net/http"
@@ -12,6 +13,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"github.com/gabrielperezs/elinproxy/httpsrv"
+	"github.com/gabrielperezs/elinproxy/httpsrv/backend"
 	"github.com/gabrielperezs/elinproxy/httpsrv/cacherules"
 )
 
@@ -28,6 +30,11 @@ var (
 )
 
 func main() {
+	// Subcommand to check the cache rules without the server
+	if len(os.Args) > 2 && os.Args[1] == "rules" && os.Args[2] == "test" {
+		os.Exit(rulesTest(os.Args[3:], os.Stdout))
+	}
+
 	flag.StringVar(&serverConfFile, "server", "server.conf", "Config for the server")
 	flag.StringVar(&cacheConfFile, "cache", "cache.conf", "Cache rules")
 	flag.BoolVar(&pprof, "pprof", false, "Enable pprof in :6060")
@@ -49,6 +56,7 @@ func main() {
 				}
 			}()
 			http.Handle("/metrics", promhttp.Handler())
+			http.Handle("/backends", backend.StatusHandler())
 			http.ListenAndServe(prometheusPort, nil)
 		}()
 	}
@@ -102,6 +110,8 @@ func loadCacheRules(file string) (*cacherules.Rules, error) {
 	if _, err := toml.DecodeFile(file, cacheConf); err != nil {
 		return nil, err
 	}
-	cacheConf.Parse()
+	if err := cacheConf.Parse(); err != nil {
+		return nil, err
+	}
 	return cacheConf, nil
 }
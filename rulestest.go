@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/BurntSushi/toml"
+
+	"github.com/gabrielperezs/elinproxy/httpsrv"
+	"github.com/gabrielperezs/elinproxy/httpsrv/cacherules"
+	"github.com/gabrielperezs/elinproxy/httpsrv/handler"
+)
+
+// fixture is a request and the response of the backend
+type fixture struct {
+	req  *http.Request
+	resp *http.Response
+}
+
+type harHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harFile struct {
+	Log struct {
+		Entries []struct {
+			Request struct {
+				Method   string      `json:"method"`
+				URL      string      `json:"url"`
+				Headers  []harHeader `json:"headers"`
+				PostData *struct {
+					Text string `json:"text"`
+				} `json:"postData"`
+			} `json:"request"`
+			Response struct {
+				Status  int         `json:"status"`
+				Headers []harHeader `json:"headers"`
+			} `json:"response"`
+		} `json:"entries"`
+	} `json:"log"`
+}
+
+// logFixture is the JSON of httplog.HTTPLog with the headers
+type logFixture struct {
+	Method      string
+	URL         string
+	UserAgent   string
+	StatusCode  int
+	Body        string
+	ReqHeaders  http.Header
+	RespHeaders http.Header
+}
+
+func newFixture(method, rawURL, body string, reqHeader http.Header, status int, respHeader http.Header) (fixture, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fixture{}, err
+	}
+	if method == "" {
+		method = http.MethodGet
+	}
+	if reqHeader == nil {
+		reqHeader = http.Header{}
+	}
+	if respHeader == nil {
+		respHeader = http.Header{}
+	}
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	req := &http.Request{
+		Method: method,
+		URL:    u,
+		Host:   u.Host,
+		Header: reqHeader,
+		Body:   ioutil.NopCloser(strings.NewReader(body)),
+	}
+	// The scheme of the rules and the keys is the one of the connection
+	if u.Scheme == "https" {
+		req.TLS = &tls.ConnectionState{ServerName: u.Hostname()}
+	}
+	resp := &http.Response{
+		StatusCode: status,
+		Header:     respHeader,
+		Request:    req,
+	}
+	return fixture{req: req, resp: resp}, nil
+}
+
+func harHeaders(headers []harHeader) http.Header {
+	h := http.Header{}
+	for _, v := range headers {
+		// HTTP/2 pseudo headers
+		if strings.HasPrefix(v.Name, ":") {
+			continue
+		}
+		h.Add(v.Name, v.Value)
+	}
+	return h
+}
+
+// loadFixtures read a HAR file or a file with one HTTPLog per line
+func loadFixtures(file string) ([]fixture, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	fixtures := make([]fixture, 0)
+
+	har := harFile{}
+	if err := json.Unmarshal(b, &har); err == nil && len(har.Log.Entries) > 0 {
+		for _, e := range har.Log.Entries {
+			body := ""
+			if e.Request.PostData != nil {
+				body = e.Request.PostData.Text
+			}
+			f, err := newFixture(e.Request.Method, e.Request.URL, body, harHeaders(e.Request.Headers),
+				e.Response.Status, harHeaders(e.Response.Headers))
+			if err != nil {
+				return nil, err
+			}
+			fixtures = append(fixtures, f)
+		}
+		return fixtures, nil
+	}
+
+	d := json.NewDecoder(bytes.NewReader(b))
+	for {
+		lf := logFixture{}
+		if err := d.Decode(&lf); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if lf.UserAgent != "" {
+			if lf.ReqHeaders == nil {
+				lf.ReqHeaders = http.Header{}
+			}
+			lf.ReqHeaders.Set("User-Agent", lf.UserAgent)
+		}
+		f, err := newFixture(lf.Method, lf.URL, lf.Body, lf.ReqHeaders, lf.StatusCode, lf.RespHeaders)
+		if err != nil {
+			return nil, err
+		}
+		fixtures = append(fixtures, f)
+	}
+	return fixtures, nil
+}
+
+// clone return a copy of the fixture, the rules modify the request
+func (f fixture) clone() fixture {
+	req := f.req.Clone(f.req.Context())
+	if f.req.Body != nil {
+		body, _ := ioutil.ReadAll(f.req.Body)
+		f.req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	resp := *f.resp
+	resp.Header = f.resp.Header.Clone()
+	resp.Request = req
+	return fixture{req: req, resp: &resp}
+}
+
+func formatSimulation(s cacherules.Simulation) string {
+	rule := s.Rule
+	if rule == "" {
+		rule = "-"
+	}
+	cc := s.CacheControl
+	if cc == "" {
+		cc = "-"
+	}
+	return fmt.Sprintf("%v\t%s\t%s\t%s\t%s\t%s", s.Cachable, s.TTL, cc, rule, s.Key, strings.Join(s.Trace, ","))
+}
+
+// loadCacheOverride read the routes of the server config, the backends
+// are not started
+func loadCacheOverride(file string) (cacherules.Override, error) {
+	srvConf := &httpsrv.Config{}
+	if _, err := toml.DecodeFile(file, srvConf); err != nil {
+		return nil, err
+	}
+	if srvConf.Handler == nil {
+		return nil, nil
+	}
+	return handler.CacheOverride(srvConf.Handler)
+}
+
+// rulesTest is the subcommand "rules test", print in out the decision of
+// the rules for each fixture, or the differences between two rules files
+func rulesTest(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("rules test", flag.ExitOnError)
+	rulesFile := fs.String("cache", "cache.conf", "Cache rules")
+	compareFile := fs.String("compare", "", "Cache rules to compare with, only the differences are printed")
+	serverFile := fs.String("server", "", "Server config with the routes that override the rules")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: elinproxy rules test [-cache cache.conf] [-compare new.conf] [-server server.conf] fixtures.har|httplog.json ...\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	rules, err := loadCacheRules(*rulesFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR Cache Config %s: %v\n", *rulesFile, err)
+		return 1
+	}
+
+	var compare *cacherules.Rules
+	if *compareFile != "" {
+		compare, err = loadCacheRules(*compareFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR Cache Config %s: %v\n", *compareFile, err)
+			return 1
+		}
+	}
+
+	var override cacherules.Override
+	if *serverFile != "" {
+		override, err = loadCacheOverride(*serverFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR Server Config %s: %v\n", *serverFile, err)
+			return 1
+		}
+	}
+
+	fixtures := make([]fixture, 0)
+	for _, file := range fs.Args() {
+		f, err := loadFixtures(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR Fixtures %s: %v\n", file, err)
+			return 1
+		}
+		fixtures = append(fixtures, f...)
+	}
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+
+	if compare == nil {
+		fmt.Fprintln(w, "METHOD\tURL\tCACHABLE\tTTL\tBROWSER\tRULE\tKEY\tTRACE")
+		for _, f := range fixtures {
+			s := rules.Simulate(f.req, f.resp, override)
+			fmt.Fprintf(w, "%s\t%s\t%s\n", f.req.Method, f.req.URL, formatSimulation(s))
+		}
+		return 0
+	}
+
+	diffs := 0
+	fmt.Fprintln(w, "\tMETHOD\tURL\tCACHABLE\tTTL\tBROWSER\tRULE\tKEY\tTRACE")
+	for _, f := range fixtures {
+		a, b := f.clone(), f.clone()
+		before := formatSimulation(rules.Simulate(a.req, a.resp, override))
+		after := formatSimulation(compare.Simulate(b.req, b.resp, override))
+		if before == after {
+			continue
+		}
+		diffs++
+		fmt.Fprintf(w, "-\t%s\t%s\t%s\n", f.req.Method, f.req.URL, before)
+		fmt.Fprintf(w, "+\t%s\t%s\t%s\n", f.req.Method, f.req.URL, after)
+	}
+	fmt.Fprintf(w, "%d/%d fixtures with differences\n", diffs, len(fixtures))
+	return 0
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gabrielperezs/elinproxy/httpsrv/cacherules"
+)
+
+func writeFixtures(t *testing.T, name, content string) string {
+	dir, err := ioutil.TempDir("", "elinproxy-rulestest-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	file := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestLoadFixtures(t *testing.T) {
+	har := `{"log": {"entries": [
+		{"request": {"method": "GET", "url": "https://www.example.com/a?b=1",
+			"headers": [{"name": ":authority", "value": "www.example.com"}, {"name": "User-Agent", "value": "Mozilla/5.0"}]},
+		 "response": {"status": 404, "headers": [{"name": "Cache-Control", "value": "max-age=60"}]}},
+		{"request": {"method": "POST", "url": "https://www.example.com/search",
+			"headers": [], "postData": {"text": "q=1"}},
+		 "response": {"status": 200, "headers": []}}
+	]}}`
+	httplog := `{"Method": "GET", "URL": "http://www.example.com/c", "UserAgent": "Mozilla/5.0", "StatusCode": 301}
+{"URL": "http://www.example.com/d", "RespHeaders": {"Set-Cookie": ["s=1"]}}
+`
+
+	type expected struct {
+		method, url string
+		status      int
+		header      string
+	}
+	tests := []struct {
+		name     string
+		content  string
+		expected []expected
+	}{
+		{"fixtures.har", har, []expected{
+			{http.MethodGet, "https://www.example.com/a?b=1", http.StatusNotFound, "Cache-Control"},
+			{http.MethodPost, "https://www.example.com/search", http.StatusOK, ""},
+		}},
+		{"httplog.json", httplog, []expected{
+			{http.MethodGet, "http://www.example.com/c", http.StatusMovedPermanently, ""},
+			{http.MethodGet, "http://www.example.com/d", http.StatusOK, "Set-Cookie"},
+		}},
+	}
+
+	for _, v := range tests {
+		fixtures, err := loadFixtures(writeFixtures(t, v.name, v.content))
+		if err != nil {
+			t.Fatalf("%s: %s", v.name, err)
+		}
+		if len(fixtures) != len(v.expected) {
+			t.Fatalf("%s: expected %d fixtures: %d", v.name, len(v.expected), len(fixtures))
+		}
+		for i, f := range fixtures {
+			e := v.expected[i]
+			if f.req.Method != e.method || f.req.URL.String() != e.url || f.req.Host != f.req.URL.Host || f.resp.StatusCode != e.status {
+				t.Errorf("%s: invalid fixture %d: %s %s %d", v.name, i, f.req.Method, f.req.URL, f.resp.StatusCode)
+			}
+			if e.header != "" && f.resp.Header.Get(e.header) == "" {
+				t.Errorf("%s: the fixture %d should have the header %s", v.name, i, e.header)
+			}
+			if https := f.req.URL.Scheme == "https"; (f.req.TLS != nil) != https {
+				t.Errorf("%s: the fixture %d should be simulated with TLS %v", v.name, i, https)
+			}
+		}
+	}
+}
+
+func TestRulesTestFixtures(t *testing.T) {
+	file := writeFixtures(t, "fixtures.har", `{"log": {"entries": [
+		{"request": {"method": "POST", "url": "http://www.example.com/search",
+			"headers": [{"name": "Content-Type", "value": "application/x-www-form-urlencoded"}],
+			"postData": {"text": "q=1"}},
+		 "response": {"status": 200, "headers": []}}
+	]}}`)
+	fixtures, err := loadFixtures(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rules := &cacherules.Rules{InternalRules: cacherules.InternalRules{
+		CachePOST: []cacherules.PostRule{{PathPrefix: "/search"}},
+	}}
+	if err := rules.Parse(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The clones of the fixture get the same decision, the body is read
+	// to build the key
+	a, b := fixtures[0].clone(), fixtures[0].clone()
+	sa, sb := rules.Simulate(a.req, a.resp, nil), rules.Simulate(b.req, b.resp, nil)
+	if !sa.Cachable || sa.Key == "" {
+		t.Fatalf("The POST of the fixture should be cachable: %+v", sa)
+	}
+	if formatSimulation(sa) != formatSimulation(sb) {
+		t.Errorf("The clones should get the same decision:\n%s\n%s", formatSimulation(sa), formatSimulation(sb))
+	}
+}
+
+func TestRulesTest(t *testing.T) {
+	fixtures := writeFixtures(t, "fixtures.har", `{"log": {"entries": [
+		{"request": {"method": "GET", "url": "https://www.example.com/static/a.css", "headers": []},
+		 "response": {"status": 200, "headers": [{"name": "Cache-Control", "value": "max-age=60"}]}},
+		{"request": {"method": "GET", "url": "https://www.example.com/page", "headers": []},
+		 "response": {"status": 200, "headers": [{"name": "Cache-Control", "value": "max-age=60"}]}}
+	]}}`)
+	current := writeFixtures(t, "cache.conf", `
+[[Rule]]
+Path = "/static/**"
+TTL = "1h"
+`)
+	next := writeFixtures(t, "new.conf", `
+[[Rule]]
+Path = "/static/**"
+Action = "bypass"
+`)
+
+	// The table with the decision of each fixture
+	out := &bytes.Buffer{}
+	if code := rulesTest([]string{"-cache", current, fixtures}, out); code != 0 {
+		t.Fatalf("Invalid exit code: %d", code)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "METHOD") {
+		t.Fatalf("Invalid table:\n%s", out)
+	}
+	for _, l := range lines[1:] {
+		if !strings.HasPrefix(l, "GET") || !strings.Contains(l, "|https|www.example.com|") {
+			t.Errorf("Invalid row, the fixtures use https: %s", l)
+		}
+	}
+
+	// Only the fixtures with a different decision are printed
+	out.Reset()
+	if code := rulesTest([]string{"-cache", current, "-compare", next, fixtures}, out); code != 0 {
+		t.Fatalf("Invalid exit code: %d", code)
+	}
+	lines = strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("Invalid diff:\n%s", out)
+	}
+	for i, prefix := range []string{"-", "+"} {
+		l := lines[i+1]
+		if !strings.HasPrefix(l, prefix) || !strings.Contains(l, "https://www.example.com/static/a.css") {
+			t.Errorf("Invalid %s line: %s", prefix, l)
+		}
+	}
+	if !strings.Contains(lines[1], "true") || !strings.Contains(lines[2], "false") {
+		t.Errorf("The diff should show the decisions of both rules:\n%s", out)
+	}
+	if lines[3] != "1/2 fixtures with differences" {
+		t.Errorf("Invalid summary: %s", lines[3])
+	}
+}